@@ -1,5 +1,5 @@
-{ path }:
+{ path, nixpkgsFlake ? "github:nixos/nixpkgs/nixos-21.05", system ? builtins.currentSystem }:
 let
-  nixpkgs = builtins.getFlake "github:nixos/nixpkgs/nixos-21.05";
-  inherit (nixpkgs.legacyPackages.x86_64-linux) buildPackages;
+  nixpkgs = builtins.getFlake nixpkgsFlake;
+  inherit (nixpkgs.legacyPackages.${system}) buildPackages;
 in buildPackages.closureInfo { rootPaths = builtins.storePath path; }
@@ -2,5 +2,25 @@ log_level = "TRACE"
 
 plugin "nix-driver" {
   config {
+    # Reject new tasks while keeping running ones, e.g. during maintenance.
+    # Can also be toggled at runtime by sending SIGUSR1 (start) or SIGUSR2
+    # (stop) to the plugin process.
+    # drain = true
+
+    # Allow tasks to set nested = true and run containers themselves.
+    # allow_nested = true
+
+    # Reuse builds of packages and NixOS flakes that aren't locked to a
+    # revision for this long. Locked flakes are reused while they're in the
+    # store.
+    # nix_build_cache_ttl = "5m"
+
+    # Lines of the output of a failed nix build shown in the task events,
+    # the complete output is in the log of the plugin.
+    # nix_build_error_lines = 20
+
+    # Let containers forward IPv6 traffic, adding their rules with
+    # ip6tables too.
+    # ipv6 = true
   }
 }
@@ -1,12 +1,29 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/plugins"
 	"github.com/input-output-hk/nomad-driver-nix/nix"
 )
 
 func main() {
+	// List the images downloaded by the driver for operators
+	if len(os.Args) > 1 && os.Args[1] == "images" {
+		flags := flag.NewFlagSet("images", flag.ExitOnError)
+		stateDir := flags.String("state-dir", nix.DefaultStateDir, "state_dir of the plugin config")
+		flags.Parse(os.Args[2:])
+
+		if err := nix.ListImages(os.Stdout, *stateDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Serve the plugin
 	plugins.Serve(factory)
 }
@@ -0,0 +1,137 @@
+package nix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultNixBuildCacheTTL is how long builds of flakes that aren't locked to
+// a revision are reused, see nix_build_cache_ttl
+const defaultNixBuildCacheTTL = 5 * time.Minute
+
+// lockedFlakeRegexp matches flake references pinned to a revision or hash,
+// whose builds never change.
+var lockedFlakeRegexp = regexp.MustCompile(`(^|[/?&=])[0-9a-f]{40}($|[/?&])|[?&]narHash=`)
+
+// nixBuildCache remembers the store paths built for the flakes of tasks, so
+// allocations with the same flakes skip evaluating and building them again.
+// Entries are kept in the state directory and only used while their store
+// paths are valid; builds of flakes that aren't locked are reused for ttl.
+type nixBuildCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// nixBuildCacheEntry is a cached build, with the store paths it produced by
+// name and the requisites of the closure.
+type nixBuildCacheEntry struct {
+	Flakes     []string          `json:"flakes"`
+	Paths      map[string]string `json:"paths"`
+	Requisites []string          `json:"requisites"`
+	Locked     bool              `json:"locked"`
+	BuiltAt    time.Time         `json:"built_at"`
+}
+
+func newNixBuildCache(stateDir string, ttl time.Duration) *nixBuildCache {
+	return &nixBuildCache{dir: filepath.Join(stateDir, "nix-builds"), ttl: ttl}
+}
+
+// isLockedFlake reports whether every flake reference is pinned.
+func isLockedFlake(flakes []string) bool {
+	for _, flake := range flakes {
+		if !lockedFlakeRegexp.MatchString(strings.SplitN(flake, "#", 2)[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// nixBuildKey identifies a build of the flakes with the options that affect
+// its result: the nixpkgs the closure is built with, the system and the
+// binary caches.
+func nixBuildKey(kind string, flakes []string, opts *nixOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", kind, opts.NixpkgsFlake, opts.System)
+	for _, flake := range flakes {
+		fmt.Fprintf(h, "flake=%s\x00", flake)
+	}
+	names := make([]string, 0, len(opts.Settings))
+	for name := range opts.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\x00", name, opts.Settings[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the entry for key if it's still valid. A nil cache has no
+// entries.
+func (c *nixBuildCache) Get(key string) *nixBuildCacheEntry {
+	if c == nil {
+		return nil
+	}
+
+	path := filepath.Join(c.dir, key+".json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	entry := &nixBuildCacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		os.Remove(path)
+		return nil
+	}
+
+	if !entry.Locked && time.Since(entry.BuiltAt) > c.ttl {
+		os.Remove(path)
+		return nil
+	}
+	// paths of finished tasks may have been garbage collected
+	for _, p := range entry.Paths {
+		if _, err := os.Stat(p); err != nil {
+			os.Remove(path)
+			return nil
+		}
+	}
+	return entry
+}
+
+// Put stores the entry for key, replacing the file atomically. Builds that
+// aren't locked aren't stored without a ttl.
+func (c *nixBuildCache) Put(key string, entry *nixBuildCacheEntry) error {
+	if c == nil {
+		return nil
+	}
+	entry.Locked = isLockedFlake(entry.Flakes)
+	if !entry.Locked && c.ttl <= 0 {
+		return nil
+	}
+	if entry.BuiltAt.IsZero() {
+		entry.BuiltAt = time.Now().UTC()
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create nix build cache: %v", err)
+	}
+	path := filepath.Join(c.dir, key+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write nix build cache: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,76 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsLockedFlake(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	require.True(isLockedFlake([]string{"github:NixOS/nixpkgs/0d1f5b5e1a6ad2c6f4c1c6e1a7e3b2a9f8d4c3b2#hello"}))
+	require.True(isLockedFlake([]string{"git+https://example.com/app?rev=0d1f5b5e1a6ad2c6f4c1c6e1a7e3b2a9f8d4c3b2#app"}))
+	require.True(isLockedFlake([]string{"https://example.com/app.tar.gz?narHash=sha256-AAAA#app"}))
+	require.False(isLockedFlake([]string{"github:NixOS/nixpkgs/nixos-21.05#hello"}))
+	require.False(isLockedFlake([]string{"github:NixOS/nixpkgs/0d1f5b5e1a6ad2c6f4c1c6e1a7e3b2a9f8d4c3b2#hello", "nixpkgs#bash"}))
+}
+
+func TestNixBuildKey(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	opts := &nixOptions{Settings: map[string]string{}, NixpkgsFlake: DefaultNixpkgsFlake, System: "x86_64-linux"}
+	key := nixBuildKey("packages", []string{"nixpkgs#hello"}, opts)
+	require.Equal(key, nixBuildKey("packages", []string{"nixpkgs#hello"}, opts))
+	require.NotEqual(key, nixBuildKey("nixos", []string{"nixpkgs#hello"}, opts))
+	require.NotEqual(key, nixBuildKey("packages", []string{"nixpkgs#bash"}, opts))
+
+	opts.Settings["substituters"] = "https://cache.example.com"
+	require.NotEqual(key, nixBuildKey("packages", []string{"nixpkgs#hello"}, opts))
+}
+
+func TestNixBuildCache(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	store := t.TempDir()
+	profile := filepath.Join(store, "profile")
+	require.NoError(ioutil.WriteFile(profile, nil, 0644))
+	paths := map[string]string{"profile": profile}
+
+	cache := newNixBuildCache(t.TempDir(), time.Hour)
+	require.Nil(cache.Get("hello"))
+	require.NoError(cache.Put("hello", &nixBuildCacheEntry{Flakes: []string{"nixpkgs#hello"}, Paths: paths, Requisites: []string{profile}}))
+	entry := cache.Get("hello")
+	require.NotNil(entry)
+	require.Equal(paths, entry.Paths)
+	require.Equal([]string{profile}, entry.Requisites)
+	require.False(entry.Locked)
+
+	// builds of unlocked flakes expire
+	require.NoError(cache.Put("old", &nixBuildCacheEntry{Flakes: []string{"nixpkgs#hello"}, Paths: paths, BuiltAt: time.Now().Add(-2 * time.Hour)}))
+	require.Nil(cache.Get("old"))
+	locked := []string{"github:NixOS/nixpkgs/0d1f5b5e1a6ad2c6f4c1c6e1a7e3b2a9f8d4c3b2#hello"}
+	require.NoError(cache.Put("locked", &nixBuildCacheEntry{Flakes: locked, Paths: paths, BuiltAt: time.Now().Add(-2 * time.Hour)}))
+	require.NotNil(cache.Get("locked"))
+
+	// and without a ttl only builds of locked flakes are cached
+	noTTL := newNixBuildCache(t.TempDir(), 0)
+	require.NoError(noTTL.Put("hello", &nixBuildCacheEntry{Flakes: []string{"nixpkgs#hello"}, Paths: paths}))
+	require.Nil(noTTL.Get("hello"))
+
+	// collected store paths invalidate the entry
+	require.NoError(os.Remove(profile))
+	require.Nil(cache.Get("hello"))
+
+	// a nil cache has no entries
+	var none *nixBuildCache
+	require.Nil(none.Get("hello"))
+	require.NoError(none.Put("hello", &nixBuildCacheEntry{}))
+}
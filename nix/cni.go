@@ -0,0 +1,340 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// netnsDir is where `ip netns add` creates named network namespaces
+	netnsDir = "/var/run/netns"
+)
+
+// cniNetwork is a CNI network configuration list as read from a .conflist
+// file. Single plugin .conf files are converted into a list of one.
+type cniNetwork struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// cniResult is the subset of a CNI ADD result we care about. ips is used
+// since spec 0.3.0, ip4 by older versions.
+type cniResult struct {
+	IPs []struct {
+		Address string `json:"address"`
+	} `json:"ips"`
+	IP4 *struct {
+		IP string `json:"ip"`
+	} `json:"ip4"`
+}
+
+// cniPortMapping is the portMappings capability argument understood by the
+// portmap plugin.
+type cniPortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// cniPortMappings converts nspawn style "host:container" port mappings.
+func cniPortMappings(ports map[string]string) ([]cniPortMapping, error) {
+	mappings := []cniPortMapping{}
+	for label, port := range ports {
+		m := cniPortMapping{Protocol: "tcp"}
+		if _, err := fmt.Sscanf(port, "%d:%d", &m.HostPort, &m.ContainerPort); err != nil {
+			return nil, fmt.Errorf("invalid port mapping %q for %s", port, label)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// loadCNINetwork looks for the network with the given name in the CNI
+// configuration directory.
+func loadCNINetwork(dir, name string) (*cniNetwork, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CNI config directory: %v", err)
+	}
+
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if f.IsDir() || (ext != ".conflist" && ext != ".conf" && ext != ".json") {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		network := &cniNetwork{}
+		if err := json.Unmarshal(content, network); err != nil {
+			return nil, fmt.Errorf("failed to parse CNI config %s: %v", f.Name(), err)
+		}
+		if network.Name != name {
+			continue
+		}
+
+		if ext != ".conflist" {
+			plugin := map[string]interface{}{}
+			if err := json.Unmarshal(content, &plugin); err != nil {
+				return nil, err
+			}
+			network.Plugins = []map[string]interface{}{plugin}
+		}
+
+		if len(network.Plugins) == 0 {
+			return nil, fmt.Errorf("CNI network %q has no plugins", name)
+		}
+		return network, nil
+	}
+
+	return nil, fmt.Errorf("CNI network %q not found in %s", name, dir)
+}
+
+// supportsPortMappings reports whether a plugin of the network declares the
+// portMappings capability.
+func (n *cniNetwork) supportsPortMappings() bool {
+	for _, plugin := range n.Plugins {
+		if capabilities, ok := plugin["capabilities"].(map[string]interface{}); ok && capabilities["portMappings"] == true {
+			return true
+		}
+	}
+	return false
+}
+
+// Add runs the ADD command of every plugin in the network against the
+// namespace and returns the result of the last plugin.
+func (n *cniNetwork) Add(cniPath string, a *CNIAttachment) (json.RawMessage, error) {
+	var prevResult json.RawMessage
+	for _, plugin := range n.Plugins {
+		out, err := n.invoke("ADD", plugin, prevResult, cniPath, a)
+		if err != nil {
+			return nil, err
+		}
+		prevResult = out
+	}
+
+	return prevResult, nil
+}
+
+// parseCNIResult returns the IPv4 address assigned by a CNI ADD command.
+func parseCNIResult(network string, out []byte) (net.IP, error) {
+	result := &cniResult{}
+	if err := json.Unmarshal(out, result); err != nil {
+		return nil, fmt.Errorf("failed to parse CNI result: %v", err)
+	}
+
+	for _, ip := range result.IPs {
+		addr, _, err := net.ParseCIDR(ip.Address)
+		if err == nil && addr.To4() != nil {
+			return addr, nil
+		}
+	}
+	if result.IP4 != nil {
+		if addr, _, err := net.ParseCIDR(result.IP4.IP); err == nil {
+			return addr, nil
+		}
+	}
+
+	return nil, fmt.Errorf("CNI network %q did not assign an IPv4 address", network)
+}
+
+// Del runs the DEL command of every plugin in the network in reverse order,
+// passing the result of ADD as prevResult. All plugins are invoked even if one
+// of them fails.
+func (n *cniNetwork) Del(cniPath string, a *CNIAttachment) error {
+	var errs []string
+	for i := len(n.Plugins) - 1; i >= 0; i-- {
+		if _, err := n.invoke("DEL", n.Plugins[i], a.Result, cniPath, a); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (n *cniNetwork) invoke(command string, plugin map[string]interface{}, prevResult json.RawMessage, cniPath string, a *CNIAttachment) ([]byte, error) {
+	pluginType, ok := plugin["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("CNI plugin in network %q has no type", n.Name)
+	}
+
+	conf := map[string]interface{}{}
+	for k, v := range plugin {
+		conf[k] = v
+	}
+	conf["name"] = n.Name
+	conf["cniVersion"] = n.CNIVersion
+	if prevResult != nil {
+		conf["prevResult"] = prevResult
+	}
+	if capabilities, ok := plugin["capabilities"].(map[string]interface{}); ok && capabilities["portMappings"] == true && len(a.PortMappings) > 0 {
+		conf["runtimeConfig"] = map[string]interface{}{"portMappings": a.PortMappings}
+	}
+
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	binary := ""
+	for _, dir := range filepath.SplitList(cniPath) {
+		if _, err := os.Stat(filepath.Join(dir, pluginType)); err == nil {
+			binary = filepath.Join(dir, pluginType)
+			break
+		}
+	}
+	if binary == "" {
+		return nil, fmt.Errorf("CNI plugin %q not found in %s", pluginType, cniPath)
+	}
+
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+a.ContainerID,
+		"CNI_NETNS="+a.Netns,
+		"CNI_IFNAME="+a.IfName,
+		"CNI_PATH="+cniPath,
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		// plugins report errors as JSON on stdout
+		return nil, fmt.Errorf("%v %s failed: %s%s. Err: %v", cmd.Args, command, stdout.String(), stderr.String(), err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// createNetns creates a named network namespace and returns its path.
+func createNetns(name string) (string, error) {
+	cmd := exec.Command("ip", "netns", "add", name)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v failed: %s. Err: %v", cmd.Args, stderr.String(), err)
+	}
+
+	return filepath.Join(netnsDir, name), nil
+}
+
+// deleteNetns removes a network namespace created by createNetns.
+func deleteNetns(name string) error {
+	cmd := exec.Command("ip", "netns", "delete", name)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v failed: %s. Err: %v", cmd.Args, stderr.String(), err)
+	}
+
+	return nil
+}
+
+// CNIAttachment records how a task was attached to a CNI network, so it can
+// be detached again when the task is destroyed, also after recovery.
+type CNIAttachment struct {
+	Network     string
+	ContainerID string
+	Netns       string
+	IfName      string
+
+	// CreatedNetns is the name of the namespace created for the task, empty
+	// if the task joined the group network namespace
+	CreatedNetns string
+
+	// PortMappings are passed to plugins with the portMappings capability
+	PortMappings []cniPortMapping
+
+	// Result of the ADD command, passed to DEL as prevResult
+	Result json.RawMessage
+}
+
+// cniIfName derives the name of the interface added to a group network
+// namespace, which may be shared by several tasks. Interface names are
+// limited to 15 characters.
+func cniIfName(containerID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(containerID))
+	return fmt.Sprintf("cni%08x", h.Sum32())
+}
+
+// attachCNI creates a namespace for the task unless it joins the group
+// network, and runs the CNI network's plugins against it.
+func (d *Driver) attachCNI(name, containerID, groupNetns string, ports []cniPortMapping) (*CNIAttachment, net.IP, error) {
+	network, err := loadCNINetwork(d.config.CNIConfigDir, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(ports) > 0 && !network.supportsPortMappings() {
+		return nil, nil, fmt.Errorf("CNI network %q has no plugin with the portMappings capability, ports can't be mapped", name)
+	}
+
+	a := &CNIAttachment{
+		Network:      name,
+		ContainerID:  containerID,
+		Netns:        groupNetns,
+		IfName:       cniIfName(containerID),
+		PortMappings: ports,
+	}
+
+	if groupNetns == "" {
+		if a.Netns, err = createNetns(containerID); err != nil {
+			return nil, nil, err
+		}
+		a.CreatedNetns = containerID
+		a.IfName = "eth0"
+	}
+
+	// on failure let the plugins release whatever they allocated
+	if a.Result, err = network.Add(d.config.CNIPath, a); err != nil {
+		d.detachCNI(a)
+		return nil, nil, err
+	}
+
+	ip, err := parseCNIResult(name, a.Result)
+	if err != nil {
+		d.detachCNI(a)
+		return nil, nil, err
+	}
+
+	return a, ip, nil
+}
+
+// detachCNI undoes attachCNI.
+func (d *Driver) detachCNI(a *CNIAttachment) {
+	network, err := loadCNINetwork(d.config.CNIConfigDir, a.Network)
+	if err != nil {
+		d.logger.Error("failed to load CNI network", "network", a.Network, "error", err)
+	} else if err := network.Del(d.config.CNIPath, a); err != nil {
+		d.logger.Error("failed to detach from CNI network", "network", a.Network, "error", err)
+	}
+
+	if a.CreatedNetns != "" {
+		if err := deleteNetns(a.CreatedNetns); err != nil {
+			d.logger.Error("failed to delete network namespace", "error", err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCNINetwork(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	dir := t.TempDir()
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "10-list.conflist"), []byte(`{
+		"cniVersion": "0.4.0",
+		"name": "list",
+		"plugins": [{"type": "bridge"}, {"type": "portmap"}]
+	}`), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "20-single.conf"), []byte(`{
+		"cniVersion": "0.4.0",
+		"name": "single",
+		"type": "macvlan",
+		"master": "eth0"
+	}`), 0644))
+
+	network, err := loadCNINetwork(dir, "list")
+	require.NoError(err)
+	require.Len(network.Plugins, 2)
+	require.Equal("portmap", network.Plugins[1]["type"])
+
+	network, err = loadCNINetwork(dir, "single")
+	require.NoError(err)
+	require.Len(network.Plugins, 1)
+	require.Equal("macvlan", network.Plugins[0]["type"])
+	require.Equal("eth0", network.Plugins[0]["master"])
+
+	_, err = loadCNINetwork(dir, "missing")
+	require.Error(err)
+}
+
+const fakeCNIResult = `echo '{"cniVersion": "0.4.0", "ips": [{"version": "4", "address": "10.22.0.5/24"}]}'`
+
+// fakeCNIPlugin writes a plugin to dir that records its stdin as
+// <type>.<command>.json, logs the invocation and prints result on ADD.
+func fakeCNIPlugin(t *testing.T, dir, pluginType, result string) {
+	script := fmt.Sprintf(`#!/bin/sh
+cat > "%[1]s/%[2]s.$CNI_COMMAND.json"
+echo "$CNI_COMMAND %[2]s $CNI_IFNAME" >> "%[1]s/log"
+if [ "$CNI_COMMAND" = ADD ]; then
+  %[3]s
+fi
+`, dir, pluginType, result)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, pluginType), []byte(script), 0755))
+}
+
+func TestCNINetwork_AddDel(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	dir := t.TempDir()
+	fakeCNIPlugin(t, dir, "fake-bridge", fakeCNIResult)
+	fakeCNIPlugin(t, dir, "fake-portmap", fakeCNIResult)
+
+	network := &cniNetwork{
+		CNIVersion: "0.4.0",
+		Name:       "test",
+		Plugins: []map[string]interface{}{
+			{"type": "fake-bridge"},
+			{"type": "fake-portmap", "capabilities": map[string]interface{}{"portMappings": true}},
+		},
+	}
+	require.True(network.supportsPortMappings())
+
+	a := &CNIAttachment{
+		Network:      "test",
+		ContainerID:  "task",
+		Netns:        "/var/run/netns/group",
+		IfName:       cniIfName("task"),
+		PortMappings: []cniPortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+	}
+
+	result, err := network.Add(dir, a)
+	require.NoError(err)
+	a.Result = result
+
+	ip, err := parseCNIResult(network.Name, a.Result)
+	require.NoError(err)
+	require.Equal("10.22.0.5", ip.String())
+
+	readConf := func(name string) map[string]interface{} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(err)
+		conf := map[string]interface{}{}
+		require.NoError(json.Unmarshal(content, &conf))
+		return conf
+	}
+
+	// only plugins declaring the capability get the port mappings
+	require.NotContains(readConf("fake-bridge.ADD.json"), "runtimeConfig")
+	portmap := readConf("fake-portmap.ADD.json")
+	require.Equal("test", portmap["name"])
+	require.Contains(portmap, "prevResult")
+	require.Equal(map[string]interface{}{
+		"portMappings": []interface{}{
+			map[string]interface{}{"hostPort": float64(8080), "containerPort": float64(80), "protocol": "tcp"},
+		},
+	}, portmap["runtimeConfig"])
+
+	require.NoError(network.Del(dir, a))
+
+	// DEL gets the result of ADD and runs the plugins in reverse order
+	require.Contains(readConf("fake-bridge.DEL.json"), "prevResult")
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	require.NoError(err)
+	ifName := cniIfName("task")
+	require.Equal(fmt.Sprintf("ADD fake-bridge %[1]s\nADD fake-portmap %[1]s\nDEL fake-portmap %[1]s\nDEL fake-bridge %[1]s\n", ifName), string(log))
+}
+
+func TestParseCNIResult(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ip, err := parseCNIResult("test", []byte(`{"ips": [{"address": "fd00::5/64"}, {"address": "10.22.0.5/24"}]}`))
+	require.NoError(err)
+	require.Equal("10.22.0.5", ip.String())
+
+	// results of spec versions before 0.3.0
+	ip, err = parseCNIResult("test", []byte(`{"ip4": {"ip": "10.22.0.6/24"}}`))
+	require.NoError(err)
+	require.Equal("10.22.0.6", ip.String())
+
+	_, err = parseCNIResult("test", []byte(`{"ips": [{"address": "fd00::5/64"}]}`))
+	require.Error(err)
+
+	_, err = parseCNIResult("test", []byte(`not json`))
+	require.Error(err)
+}
+
+func TestCNIIfName(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a := cniIfName("web-5c3e2bd6-8b6f-2f66-1e2b-5f1d3a6f2a3c")
+	b := cniIfName("api-5c3e2bd6-8b6f-2f66-1e2b-5f1d3a6f2a3c")
+	require.LessOrEqual(len(a), 15)
+	require.NotEqual(a, b)
+	require.Equal(a, cniIfName("web-5c3e2bd6-8b6f-2f66-1e2b-5f1d3a6f2a3c"))
+}
+
+func TestCNIPortMappings(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mappings, err := cniPortMappings(map[string]string{"http": "8080:80"})
+	require.NoError(err)
+	require.Equal([]cniPortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}, mappings)
+
+	_, err = cniPortMappings(map[string]string{"http": "http"})
+	require.Error(err)
+}
+
+func TestAttachCNI_Cleanup(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	dir := t.TempDir()
+	fakeCNIPlugin(t, dir, "fake-bridge", fakeCNIResult)
+	fakeCNIPlugin(t, dir, "fake-broken", `echo '{"code": 11, "msg": "broken"}'; exit 1`)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "broken.conflist"), []byte(`{
+		"cniVersion": "0.4.0",
+		"name": "broken",
+		"plugins": [{"type": "fake-bridge"}, {"type": "fake-broken"}]
+	}`), 0644))
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+	d.config.CNIPath = dir
+	d.config.CNIConfigDir = dir
+
+	// ports can't be mapped without a plugin supporting them
+	_, _, err := d.attachCNI("broken", "task", "/var/run/netns/group", []cniPortMapping{{HostPort: 8080, ContainerPort: 80}})
+	require.Error(err)
+	require.Contains(err.Error(), "portMappings")
+
+	// a failing ADD is rolled back
+	_, _, err = d.attachCNI("broken", "task", "/var/run/netns/group", nil)
+	require.Error(err)
+	require.Contains(err.Error(), "broken")
+
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	require.NoError(err)
+	require.Contains(string(log), "DEL fake-bridge")
+}
@@ -0,0 +1,85 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+)
+
+// diagnosticsCommand can be passed to `nomad alloc exec` for any task of this
+// driver to get the diagnostics of the node instead of running a command in
+// the container.
+const diagnosticsCommand = "nix-driver-diagnostics"
+
+// Diagnostics describes the runtime environment of the driver on a node.
+type Diagnostics struct {
+	PluginVersion  string          `json:"plugin_version"`
+	SystemdVersion string          `json:"systemd_version"`
+	NixVersion     string          `json:"nix_version"`
+	Features       map[string]bool `json:"features"`
+
+	CapabilityPresets  []string `json:"capability_presets"`
+	DefaultLinkJournal string   `json:"default_link_journal"`
+	CNIPath            string   `json:"cni_path"`
+	CNIConfigDir       string   `json:"cni_config_dir"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (d *Driver) diagnostics() *Diagnostics {
+	_, cniErr := os.Stat(d.config.CNIConfigDir)
+
+	diag := &Diagnostics{
+		PluginVersion: pluginVersion,
+		Features: map[string]bool{
+			"enabled":              d.config.Enabled,
+			"volumes":              d.config.Volumes,
+			"capability_presets":   len(d.config.CapabilityPresets) > 0,
+			"default_link_journal": d.config.DefaultLinkJournal != "",
+			"cni":                  cniErr == nil,
+		},
+		CapabilityPresets:  []string{},
+		DefaultLinkJournal: d.config.DefaultLinkJournal,
+		CNIPath:            d.config.CNIPath,
+		CNIConfigDir:       d.config.CNIConfigDir,
+	}
+
+	for name := range d.config.CapabilityPresets {
+		diag.CapabilityPresets = append(diag.CapabilityPresets, name)
+	}
+	sort.Strings(diag.CapabilityPresets)
+
+	var err error
+	if diag.SystemdVersion, err = systemdVersion(); err != nil {
+		diag.Errors = append(diag.Errors, "systemd: "+err.Error())
+	}
+	if diag.NixVersion, err = nixVersion(); err != nil {
+		diag.Errors = append(diag.Errors, "nix: "+err.Error())
+	}
+
+	return diag
+}
+
+// diagnosticsJSON renders the diagnostics as indented JSON.
+func (d *Driver) diagnosticsJSON() ([]byte, error) {
+	out, err := json.MarshalIndent(d.diagnostics(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// nixVersion returns the version reported by `nix --version`, e.g. "2.4" for
+// "nix (Nix) 2.4".
+func nixVersion() (string, error) {
+	if _, err := exec.LookPath("nix"); err != nil {
+		return "", err
+	}
+	out, err := exec.Command("nix", "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("nix --version failed: %v", err)
+	}
+	return parseNixVersion(string(out))
+}
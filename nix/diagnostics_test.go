@@ -0,0 +1,52 @@
+package nix
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/helper/uuid"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNspawnDriver_ExecTask_Diagnostics(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+	require.NoError(setConfig(d, &Config{
+		Enabled: true,
+		CapabilityPresets: map[string][]string{
+			"network": {"CAP_NET_ADMIN"},
+			"debug":   {"CAP_SYS_PTRACE"},
+		},
+		DefaultLinkJournal: "try-guest",
+		CNIPath:            "/opt/cni/bin",
+		CNIConfigDir:       t.TempDir(),
+	}))
+
+	// the sentinel is answered by the driver, the task is never touched
+	taskID := uuid.Generate()
+	d.tasks.Set(taskID, &taskHandle{
+		taskConfig: &drivers.TaskConfig{ID: taskID, Name: "test"},
+	})
+
+	res, err := d.ExecTask(taskID, []string{diagnosticsCommand}, time.Second)
+	require.NoError(err)
+	require.True(res.ExitResult.Successful())
+
+	var diag Diagnostics
+	require.NoError(json.Unmarshal(res.Stdout, &diag))
+	require.Equal(pluginVersion, diag.PluginVersion)
+	require.True(diag.Features["enabled"])
+	require.True(diag.Features["capability_presets"])
+	require.True(diag.Features["cni"])
+	require.Equal([]string{"debug", "network"}, diag.CapabilityPresets)
+	require.Equal("try-guest", diag.DefaultLinkJournal)
+	require.Equal("/opt/cni/bin", diag.CNIPath)
+
+	_, err = d.ExecTask(uuid.Generate(), []string{diagnosticsCommand}, time.Second)
+	require.Equal(drivers.ErrTaskNotFound, err)
+}
@@ -3,21 +3,31 @@ package nix
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/drivers/shared/executor"
 	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	nstructs "github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
+	dproto "github.com/hashicorp/nomad/plugins/drivers/proto"
 	driversUtil "github.com/hashicorp/nomad/plugins/drivers/utils"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
 	"github.com/hashicorp/nomad/plugins/shared/structs"
@@ -37,6 +47,26 @@ const (
 	// startup timeouts
 	machinePropertiesTimeout = 30 * time.Second
 	machineAddressTimeout    = 30 * time.Second
+
+	// imageTransferTimeout limits how long importing an image may take, and
+	// downloading one unless image_download sets a timeout
+	imageTransferTimeout = 30 * time.Minute
+
+	// defaultMachineStartTimeout is how long StartTask waits for a new
+	// machine to register with machined
+	defaultMachineStartTimeout = 30 * time.Second
+
+	// defaultReadyTimeout is how long StartTask waits for the ready_unit of
+	// a booted container to become active
+	defaultReadyTimeout = 5 * time.Minute
+
+	// maxBuildEventLength truncates the lines of nix output emitted as task
+	// events
+	maxBuildEventLength = 256
+
+	// backoff between the restarts of restart_on_oom
+	oomRestartBaseDelay = 5 * time.Second
+	maxOOMRestartDelay  = time.Minute
 )
 
 var (
@@ -61,6 +91,48 @@ var (
 			hclspec.NewAttr("volumes", "bool", false),
 			hclspec.NewLiteral("true"),
 		),
+		"capability_presets":       hclspec.NewAttr("capability_presets", "map(list(string))", false),
+		"default_link_journal":     hclspec.NewAttr("default_link_journal", "string", false),
+		"allowed_image_registries": hclspec.NewAttr("allowed_image_registries", "list(string)", false),
+		"env_deny":                 hclspec.NewAttr("env_deny", "list(string)", false),
+		"log_level":                hclspec.NewAttr("log_level", "string", false),
+		"drain":                    hclspec.NewAttr("drain", "bool", false),
+		"allow_nested":             hclspec.NewAttr("allow_nested", "bool", false),
+		"nix_ssl_cert_file":        hclspec.NewAttr("nix_ssl_cert_file", "string", false),
+		"nix_http_proxy":           hclspec.NewAttr("nix_http_proxy", "string", false),
+		"nix_https_proxy":          hclspec.NewAttr("nix_https_proxy", "string", false),
+		"nix_no_proxy":             hclspec.NewAttr("nix_no_proxy", "string", false),
+		"nix_substituters":         hclspec.NewAttr("nix_substituters", "list(string)", false),
+		"nix_trusted_public_keys":  hclspec.NewAttr("nix_trusted_public_keys", "list(string)", false),
+		"ipv6":                     hclspec.NewAttr("ipv6", "bool", false),
+		"cni_path": hclspec.NewDefault(
+			hclspec.NewAttr("cni_path", "string", false),
+			hclspec.NewLiteral(`"/opt/cni/bin"`),
+		),
+		"cni_config_dir": hclspec.NewDefault(
+			hclspec.NewAttr("cni_config_dir", "string", false),
+			hclspec.NewLiteral(`"/opt/cni/config"`),
+		),
+		"nixpkgs_flake": hclspec.NewDefault(
+			hclspec.NewAttr("nixpkgs_flake", "string", false),
+			hclspec.NewLiteral(`"`+DefaultNixpkgsFlake+`"`),
+		),
+		"state_dir": hclspec.NewDefault(
+			hclspec.NewAttr("state_dir", "string", false),
+			hclspec.NewLiteral(`"`+DefaultStateDir+`"`),
+		),
+		"machine_start_timeout": hclspec.NewDefault(
+			hclspec.NewAttr("machine_start_timeout", "string", false),
+			hclspec.NewLiteral(`"`+defaultMachineStartTimeout.String()+`"`),
+		),
+		"nix_build_cache_ttl": hclspec.NewDefault(
+			hclspec.NewAttr("nix_build_cache_ttl", "string", false),
+			hclspec.NewLiteral(`"`+defaultNixBuildCacheTTL.String()+`"`),
+		),
+		"nix_build_error_lines": hclspec.NewDefault(
+			hclspec.NewAttr("nix_build_error_lines", "number", false),
+			hclspec.NewLiteral(strconv.Itoa(defaultNixBuildErrorLines)),
+		),
 	})
 
 	// taskConfigSpec is the hcl specification for the driver config section of
@@ -75,16 +147,21 @@ var (
 			hclspec.NewAttr("network_veth", "bool", false),
 			hclspec.NewLiteral("false"),
 		),
+		"network_veth_extra": hclspec.NewAttr("network_veth_extra", "list(string)", false),
 		"process_two": hclspec.NewDefault(
 			hclspec.NewAttr("process_two", "bool", false),
 			hclspec.NewLiteral("false"),
 		),
-		"read_only": hclspec.NewAttr("read_only", "bool", false),
+		"read_only":       hclspec.NewAttr("read_only", "bool", false),
+		"writable_paths":  hclspec.NewAttr("writable_paths", "list(string)", false),
+		"delegate_cgroup": hclspec.NewAttr("delegate_cgroup", "bool", false), // defaults to the value of boot
 		"user_namespacing": hclspec.NewDefault(
 			hclspec.NewAttr("user_namespacing", "bool", false),
 			hclspec.NewLiteral("false"),
 		),
-		"command": hclspec.NewAttr("command", "list(string)", false),
+		"command":     hclspec.NewAttr("command", "list(string)", false),
+		"entrypoint":  hclspec.NewAttr("entrypoint", "list(string)", false),
+		"login_shell": hclspec.NewAttr("login_shell", "bool", false),
 		"console": hclspec.NewDefault(
 			hclspec.NewAttr("console", "string", false),
 			hclspec.NewLiteral(`"read-only"`),
@@ -105,27 +182,91 @@ var (
 					hclspec.NewAttr("verify", "string", false),
 					hclspec.NewLiteral(`"no"`),
 				),
+				"timeout":   hclspec.NewAttr("timeout", "string", false),
+				"checksums": hclspec.NewAttr("checksums", "string", false),
+				"signature": hclspec.NewAttr("signature", "string", false),
+				"mirrors":   hclspec.NewAttr("mirrors", "list(string)", false),
+				"checksum":  hclspec.NewAttr("checksum", "string", false),
 			})),
 		// "machine":           hclspec.NewAttr("machine", "string", false),
-		"pivot_root": hclspec.NewAttr("pivot_root", "string", false),
-		"resolv_conf": hclspec.NewDefault(
-			hclspec.NewAttr("resolv_conf", "string", false),
-			hclspec.NewLiteral(`"copy-host"`),
+		"pivot_root":              hclspec.NewAttr("pivot_root", "string", false),
+		"resolv_conf":             hclspec.NewAttr("resolv_conf", "string", false), // defaults to "copy-host", "bind-uplink" for private networks on systemd-resolved hosts
+		"user":                    hclspec.NewAttr("user", "string", false),
+		"user_id":                 hclspec.NewAttr("user_id", "number", false),
+		"volatile":                hclspec.NewAttr("volatile", "string", false),
+		"working_directory":       hclspec.NewAttr("working_directory", "string", false),
+		"bind":                    hclspec.NewAttr("bind", "list(map(string))", false),
+		"bind_read_only":          hclspec.NewAttr("bind_read_only", "list(map(string))", false),
+		"environment":             hclspec.NewAttr("environment", "list(map(string))", false),
+		"clean_environment":       hclspec.NewAttr("clean_environment", "bool", false),
+		"inherit_env":             hclspec.NewAttr("inherit_env", "list(string)", false),
+		"env_allow":               hclspec.NewAttr("env_allow", "list(string)", false),
+		"env_deny":                hclspec.NewAttr("env_deny", "list(string)", false),
+		"port_map":                hclspec.NewAttr("port_map", "list(map(number))", false),
+		"ports":                   hclspec.NewAttr("ports", "list(string)", false),
+		"capability":              hclspec.NewAttr("capability", "list(string)", false),
+		"capability_preset":       hclspec.NewAttr("capability_preset", "string", false),
+		"network_zone":            hclspec.NewAttr("network_zone", "string", false),
+		"link_journal":            hclspec.NewAttr("link_journal", "string", false),
+		"nixos":                   hclspec.NewAttr("nixos", "string", false),
+		"nixos_toplevel":          hclspec.NewAttr("nixos_toplevel", "string", false),
+		"packages":                hclspec.NewAttr("packages", "list(string)", false),
+		"sanitize_names":          hclspec.NewAttr("sanitize_names", "bool", false),
+		"stdin":                   hclspec.NewAttr("stdin", "string", false),
+		"exec_service_type":       hclspec.NewAttr("exec_service_type", "string", false), // defaults to "exec"
+		"stop_signal":             hclspec.NewAttr("stop_signal", "string", false),       // used if the task sets no kill_signal
+		"stop_grace_period":       hclspec.NewAttr("stop_grace_period", "string", false), // overrides kill_timeout
+		"ready_unit":              hclspec.NewAttr("ready_unit", "string", false),
+		"ready_timeout":           hclspec.NewAttr("ready_timeout", "string", false), // defaults to 5m
+		"restart_on_oom":          hclspec.NewAttr("restart_on_oom", "number", false),
+		"host_machine_id":         hclspec.NewAttr("host_machine_id", "bool", false),
+		"private_users":           hclspec.NewAttr("private_users", "string", false),
+		"nix_build_log":           hclspec.NewAttr("nix_build_log", "string", false),     // relative to the task dir
+		"nix_ssl_cert_file":       hclspec.NewAttr("nix_ssl_cert_file", "string", false), // relative to the task dir
+		"nix_http_proxy":          hclspec.NewAttr("nix_http_proxy", "string", false),
+		"nix_https_proxy":         hclspec.NewAttr("nix_https_proxy", "string", false),
+		"nix_no_proxy":            hclspec.NewAttr("nix_no_proxy", "string", false),
+		"disk_quota":              hclspec.NewAttr("disk_quota", "number", false),
+		"memory_min":              hclspec.NewAttr("memory_min", "number", false),
+		"memory_low":              hclspec.NewAttr("memory_low", "number", false), // defaults to the reserved memory with memory_max
+		"extra_store_paths":       hclspec.NewAttr("extra_store_paths", "list(string)", false),
+		"cni_network":             hclspec.NewAttr("cni_network", "string", false),
+		"nix_ssh_key":             hclspec.NewAttr("nix_ssh_key", "string", false),
+		"nix_netrc":               hclspec.NewAttr("nix_netrc", "string", false),
+		"private_users_ownership": hclspec.NewAttr("private_users_ownership", "string", false),
+		"oom_policy":              hclspec.NewAttr("oom_policy", "string", false), // continue, stop or kill
+		"dns_over_tls":            hclspec.NewAttr("dns_over_tls", "list(string)", false),
+		"nix_system":              hclspec.NewAttr("nix_system", "string", false), // defaults to the system of the host
+		"nested":                  hclspec.NewAttr("nested", "bool", false),       // requires allow_nested
+		"numa_node":               hclspec.NewAttr("numa_node", "number", false),
+		"log_rate_limit_interval": hclspec.NewAttr("log_rate_limit_interval", "string", false), // "0" disables rate limiting
+		"log_rate_limit_burst":    hclspec.NewAttr("log_rate_limit_burst", "number", false),
+		"overlay":                 hclspec.NewAttr("overlay", "list(map(string))", false), // lower, upper and target
+		"overlay_read_only":       hclspec.NewAttr("overlay_read_only", "list(map(string))", false),
+		"task_dir_mount_options":  hclspec.NewAttr("task_dir_mount_options", "list(string)", false), // nosuid, nodev and noexec
+		"tmpfs":                   hclspec.NewAttr("tmpfs", "list(string)", false),                  // PATH[:OPTIONS]
+		"kill_signal":             hclspec.NewAttr("kill_signal", "string", false),                  // sent to PID 1 by nspawn on stop
+		"hostname":                hclspec.NewAttr("hostname", "string", false),                     // defaults to the machine name
+		"drop_capability":         hclspec.NewAttr("drop_capability", "list(string)", false),
+		"bind_user":               hclspec.NewAttr("bind_user", "list(string)", false),            // requires a user namespace
+		"load_credential":         hclspec.NewAttr("load_credential", "list(map(string))", false), // id and path in the secrets directory
+		"set_credential":          hclspec.NewAttr("set_credential", "list(map(string))", false),  // id and value
+		"register": hclspec.NewDefault(
+			hclspec.NewAttr("register", "bool", false),
+			hclspec.NewLiteral("true"),
 		),
-		"user":              hclspec.NewAttr("user", "string", false),
-		"volatile":          hclspec.NewAttr("volatile", "string", false),
-		"working_directory": hclspec.NewAttr("working_directory", "string", false),
-		"bind":              hclspec.NewAttr("bind", "list(map(string))", false),
-		"bind_read_only":    hclspec.NewAttr("bind_read_only", "list(map(string))", false),
-		"environment":       hclspec.NewAttr("environment", "list(map(string))", false),
-		"port_map":          hclspec.NewAttr("port_map", "list(map(number))", false),
-		"ports":             hclspec.NewAttr("ports", "list(string)", false),
-		"capability":        hclspec.NewAttr("capability", "list(string)", false),
-		"network_zone":      hclspec.NewAttr("network_zone", "string", false),
-		"link_journal":      hclspec.NewAttr("link_journal", "string", false),
-		"nixos":             hclspec.NewAttr("nixos", "string", false),
-		"packages":          hclspec.NewAttr("packages", "list(string)", false),
-		"sanitize_names":    hclspec.NewAttr("sanitize_names", "bool", false),
+		"keep_unit":              hclspec.NewAttr("keep_unit", "bool", false),               // requires register = false
+		"slice":                  hclspec.NewAttr("slice", "string", false),                 // defaults to machine.slice
+		"network_macvlan":        hclspec.NewAttr("network_macvlan", "list(string)", false), // host interfaces
+		"network_ipvlan":         hclspec.NewAttr("network_ipvlan", "list(string)", false),
+		"network_bridge":         hclspec.NewAttr("network_bridge", "string", false), // implies a veth link
+		"cleanup_image":          hclspec.NewAttr("cleanup_image", "bool", false),    // removes a downloaded image in DestroyTask
+		"exec_user":              hclspec.NewAttr("exec_user", "string", false),      // defaults for exec sessions
+		"exec_working_directory": hclspec.NewAttr("exec_working_directory", "string", false),
+		"timezone":               hclspec.NewAttr("timezone", "string", false),    // defaults to "auto"
+		"suppress_sync":          hclspec.NewAttr("suppress_sync", "bool", false), // requires systemd 250
+		"no_new_privileges":      hclspec.NewAttr("no_new_privileges", "bool", false),
+		"system_call_filter":     hclspec.NewAttr("system_call_filter", "list(string)", false), // ~ denies
 	})
 
 	// capabilities is returned by the Capabilities RPC and indicates what
@@ -142,6 +283,16 @@ var (
 	}
 )
 
+// supportsNetIsolationMode checks the mode against the driver capabilities.
+func supportsNetIsolationMode(mode drivers.NetIsolationMode) bool {
+	for _, m := range capabilities.NetIsolationModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 // Driver is a driver for running nspawn containers
 type Driver struct {
 	// eventer is used to handle multiplexing of TaskEvents calls such that an
@@ -171,6 +322,18 @@ type Driver struct {
 	// Receives OOM events
 	oomChan     chan *OOM
 	oomListener *OOMListener
+
+	// draining is non-zero while StartTask rejects new tasks, see drain
+	draining int32
+
+	// images records the images downloaded by the driver
+	images *imageIndex
+
+	// buildCache remembers nix builds for tasks with the same flakes
+	buildCache *nixBuildCache
+
+	// restarted keeps the state of tasks restarted after an OOM kill
+	restarted *restartedTasks
 }
 
 // Config is the driver configuration set by the SetConfig RPC call
@@ -178,6 +341,83 @@ type Config struct {
 	// Enabled is set to true to enable the nspawn driver
 	Enabled bool `codec:"enabled"`
 	Volumes bool `codec:"volumes"`
+
+	// CapabilityPresets maps a preset name to the list of capabilities
+	// granted to tasks referencing it via capability_preset
+	CapabilityPresets map[string][]string `codec:"capability_presets"`
+
+	// DefaultLinkJournal is used for tasks that don't set link_journal
+	DefaultLinkJournal string `codec:"default_link_journal"`
+
+	// CNIPath and CNIConfigDir locate the plugins and network configurations
+	// used for tasks with cni_network
+	CNIPath      string `codec:"cni_path"`
+	CNIConfigDir string `codec:"cni_config_dir"`
+
+	// MachineStartTimeout is how long to wait for a started container to
+	// register with machined, as long as systemd-nspawn keeps running
+	MachineStartTimeout string `codec:"machine_start_timeout"`
+	machineStartTimeout time.Duration
+
+	// AllowedImageRegistries restricts image_download to URLs below one of
+	// the listed prefixes. An empty list allows all URLs.
+	AllowedImageRegistries []string `codec:"allowed_image_registries"`
+
+	// EnvDeny lists prefixes of variables set by Nomad which are never
+	// passed into containers, in addition to the env_deny of the task
+	EnvDeny []string `codec:"env_deny"`
+
+	// LogLevel sets the verbosity of the driver's own logs. Messages are
+	// still filtered by the log level of the Nomad agent.
+	LogLevel string `codec:"log_level"`
+
+	// Drain makes StartTask reject new tasks while running ones are left
+	// alone. Draining can also be toggled at runtime by sending SIGUSR1
+	// (start) or SIGUSR2 (stop) to the plugin process.
+	Drain bool `codec:"drain"`
+
+	// NixSSLCertFile is the CA bundle nix verifies HTTPS connections with,
+	// and the proxies are used to reach flake inputs and substituters. Tasks
+	// may override them.
+	NixSSLCertFile string `codec:"nix_ssl_cert_file"`
+	NixHTTPProxy   string `codec:"nix_http_proxy"`
+	NixHTTPSProxy  string `codec:"nix_https_proxy"`
+	NixNoProxy     string `codec:"nix_no_proxy"`
+
+	// NixSubstituters replace the binary caches of nix.conf for builds of
+	// tasks, e.g. with a private Hydra, and NixTrustedPublicKeys are the
+	// keys their paths are signed with
+	NixSubstituters      []string `codec:"nix_substituters"`
+	NixTrustedPublicKeys []string `codec:"nix_trusted_public_keys"`
+
+	// StateDir is where the driver keeps state that outlives tasks, like
+	// the index of the images it downloaded
+	StateDir string `codec:"state_dir"`
+
+	// AllowNested permits tasks to set nested, which delegates a cgroup
+	// subtree and grants the capabilities needed to run containers inside
+	// the container. Nested containers are as privileged as their parent.
+	AllowNested bool `codec:"allow_nested"`
+
+	// NixpkgsFlake is the nixpkgs the closure info of packages is built
+	// with. It only needs to provide closureInfo, but should be recent
+	// enough for the packages of the tasks.
+	NixpkgsFlake string `codec:"nixpkgs_flake"`
+
+	// NixBuildCacheTTL is how long builds of packages and NixOS flakes that
+	// aren't locked to a revision are reused by other tasks. Builds of
+	// locked flakes are reused as long as their store paths exist. "0"
+	// only caches locked flakes.
+	NixBuildCacheTTL string `codec:"nix_build_cache_ttl"`
+	nixBuildCacheTTL time.Duration
+
+	// IPv6 adds the forwarding rules of containers with ip6tables too
+	IPv6 bool `codec:"ipv6"`
+
+	// NixBuildErrorLines is how many lines of the output of a failed nix
+	// build are shown in the task events and the error of the task. The
+	// complete output is logged by the driver.
+	NixBuildErrorLines int `codec:"nix_build_error_lines"`
 }
 
 // TaskState is the state which is encoded in the handle returned in
@@ -187,6 +427,13 @@ type TaskState struct {
 	ReattachConfig *structs.ReattachConfig
 	MachineName    string
 	StartedAt      time.Time
+	ImagePath      string
+	ImageType      string
+	CNI            *CNIAttachment
+	TaskImage      string
+	CleanupImage   string
+	ExecService    string
+	Cmdline        string
 }
 
 // NewPlugin returns a new nspawn driver object
@@ -194,18 +441,62 @@ func NewPlugin(logger hclog.Logger, oomListener *OOMListener) drivers.DriverPlug
 	ctx, cancel := context.WithCancel(context.Background())
 	logger = logger.Named(pluginName)
 
-	return &Driver{
+	d := &Driver{
 		eventer: eventer.NewEventer(ctx, logger),
 		config: &Config{
-			Enabled: true,
-			Volumes: true,
+			Enabled:             true,
+			Volumes:             true,
+			CNIPath:             "/opt/cni/bin",
+			CNIConfigDir:        "/opt/cni/config",
+			MachineStartTimeout: defaultMachineStartTimeout.String(),
+			machineStartTimeout: defaultMachineStartTimeout,
+			StateDir:            DefaultStateDir,
+			NixBuildCacheTTL:    defaultNixBuildCacheTTL.String(),
+			nixBuildCacheTTL:    defaultNixBuildCacheTTL,
+			NixBuildErrorLines:  defaultNixBuildErrorLines,
 		},
+		images:         newImageIndex(DefaultStateDir),
+		buildCache:     newNixBuildCache(DefaultStateDir, defaultNixBuildCacheTTL),
+		restarted:      newRestartedTasks(DefaultStateDir),
 		tasks:          newTaskStore(),
 		ctx:            ctx,
 		signalShutdown: cancel,
 		logger:         logger,
 		oomListener:    oomListener,
 	}
+	go d.handleDrainSignals()
+	return d
+}
+
+// handleDrainSignals starts draining on SIGUSR1 and stops it on SIGUSR2.
+func (d *Driver) handleDrainSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case sig := <-sigs:
+			d.setDraining(sig == syscall.SIGUSR1)
+		}
+	}
+}
+
+// setDraining starts or stops rejecting new tasks.
+func (d *Driver) setDraining(drain bool) {
+	var v int32
+	if drain {
+		v = 1
+	}
+	if atomic.SwapInt32(&d.draining, v) != v {
+		d.logger.Info("changed drain mode", "draining", drain)
+	}
+}
+
+func (d *Driver) isDraining() bool {
+	return atomic.LoadInt32(&d.draining) != 0
 }
 
 func (d *Driver) TaskConfigSchema() (*hclspec.Spec, error) {
@@ -259,13 +550,52 @@ func (d *Driver) buildFingerprint() *drivers.Fingerprint {
 		fp.Attributes["driver.nix"] = structs.NewBoolAttribute(true)
 		fp.Attributes["driver.nix.nspawn.version"] = structs.NewStringAttribute(version)
 		fp.Attributes["driver.nix.volumes"] = structs.NewBoolAttribute(d.config.Volumes)
+		fp.Attributes["driver.nix.plugin_version"] = structs.NewStringAttribute(pluginVersion)
+		fp.Attributes["driver.nix.system"] = structs.NewStringAttribute(hostNixSystem())
+		for name, attr := range kernelAttributes("/proc", "/boot") {
+			fp.Attributes[name] = attr
+		}
+		if free, err := storeFreeMB(nixStoreDir); err == nil {
+			fp.Attributes["driver.nix.store_free_mb"] = structs.NewIntAttribute(free, "")
+		} else {
+			d.logger.Debug("failed to get free space of the nix store", "error", err)
+		}
+	}
+
+	// containers from images run without nix, jobs building nixos or
+	// packages can constrain on the version, tasks failing without it
+	if fp.Health == drivers.HealthStateHealthy {
+		if version, err := nixVersion(); err == nil {
+			fp.Attributes["driver.nix.nix_version"] = structs.NewStringAttribute(version)
+		} else {
+			d.logger.Debug("nix is not available, only tasks running images can be started", "error", err)
+		}
+	}
+
+	if fp.Health == drivers.HealthStateHealthy && d.isDraining() {
+		// keeps the scheduler from placing new tasks on this node
+		fp.Health = drivers.HealthStateUnhealthy
+		fp.HealthDescription = "draining"
 	}
 
 	return fp
 }
 
+// nixStoreDir is where nix keeps the store paths tasks are built into.
+const nixStoreDir = "/nix/store"
+
+// storeFreeMB returns the space available on the file system of dir, in
+// MiB, so jobs can avoid nodes with too little room for their builds.
+func storeFreeMB(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize) / 1024 / 1024, nil
+}
+
 func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
-	d.logger.Debug("RecoverTask called")
+	d.logger.Trace("RecoverTask called")
 	if handle == nil {
 		return fmt.Errorf("error: handle cannot be nil")
 	}
@@ -278,6 +608,12 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 	if err := handle.GetDriverState(&taskState); err != nil {
 		return fmt.Errorf("failed to decode task state from handle: %v", err)
 	}
+	// the container may have been restarted after an OOM kill
+	if restarted, err := d.restarted.Get(handle.Config.ID); err != nil {
+		d.logger.Warn("failed to get state of restarted task", "task_id", handle.Config.ID, "error", err)
+	} else if restarted != nil {
+		taskState = *restarted
+	}
 
 	plugRC, err := structs.ReattachConfigToGoPlugin(taskState.ReattachConfig)
 	if err != nil {
@@ -289,15 +625,26 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		return fmt.Errorf("failed to reattach to executor: %v", err)
 	}
 
-	p, e := DescribeMachine(taskState.MachineName, machinePropertiesTimeout)
-	if e != nil {
-		d.logger.Error("failed to get machine information", "error", e)
-		return e
+	var driverConfig MachineConfig
+	decodeErr := handle.Config.DecodeDriverConfig(&driverConfig)
+
+	p := &MachineProps{Name: taskState.MachineName}
+	if decodeErr != nil || driverConfig.register() {
+		var e error
+		p, e = DescribeMachine(taskState.MachineName, machinePropertiesTimeout)
+		if e != nil {
+			d.logger.Error("failed to get machine information", "error", e)
+			return e
+		}
 	}
+	netIF := d.machineInterfaces(p, &driverConfig)
 
-	netIF, e := p.GetNetworkInterfaces()
-	if e != nil {
-		d.logger.Error("failed to get machine network interfacves", "error", err)
+	// the rules are gone if iptables was flushed while the client was down,
+	// adding them is a no-op otherwise
+	if handle.Config.NetworkIsolation == nil && len(netIF) > 0 {
+		if err := ConfigureIPTablesRules(false, p.Name, netIF, d.config.IPv6); err != nil {
+			d.logger.Error("failed to restore IPTables rules", "error", err)
+		}
 	}
 
 	h := &taskHandle{
@@ -310,6 +657,14 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		taskConfig:   handle.Config,
 		procState:    drivers.TaskStateRunning,
 		startedAt:    taskState.StartedAt,
+		imagePath:    taskState.ImagePath,
+		imageType:    taskState.ImageType,
+		cni:          taskState.CNI,
+
+		taskImage:       taskState.TaskImage,
+		cleanupImage:    taskState.CleanupImage,
+		execServiceType: taskState.ExecService,
+		cmdline:         taskState.Cmdline,
 	}
 
 	d.tasks.Set(handle.Config.ID, h)
@@ -319,14 +674,59 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 	return nil
 }
 
+// applyPluginConfig fills in the parts of the task config that are defined by
+// the plugin config.
+func (d *Driver) applyPluginConfig(c *MachineConfig) error {
+	if c.CapabilityPreset != "" {
+		preset, ok := d.config.CapabilityPresets[c.CapabilityPreset]
+		if !ok {
+			return fmt.Errorf("capability_preset %q is not defined in the plugin config", c.CapabilityPreset)
+		}
+		c.Capability = mergeCapabilities(c.Capability, preset)
+	}
+
+	if c.Nested {
+		if !d.config.AllowNested {
+			return fmt.Errorf("nested requires allow_nested in the plugin config")
+		}
+		c.Capability = mergeCapabilities(c.Capability, nestedCapabilities)
+	}
+
+	c.hostSSLCertFile = d.config.NixSSLCertFile
+	c.nixpkgsFlake = d.config.NixpkgsFlake
+	c.substituters = d.config.NixSubstituters
+	c.trustedKeys = d.config.NixTrustedPublicKeys
+	if c.NixHTTPProxy == "" {
+		c.NixHTTPProxy = d.config.NixHTTPProxy
+	}
+	if c.NixHTTPSProxy == "" {
+		c.NixHTTPSProxy = d.config.NixHTTPSProxy
+	}
+	if c.NixNoProxy == "" {
+		c.NixNoProxy = d.config.NixNoProxy
+	}
+
+	// nspawn refuses to link the journal of a container sharing the
+	// machine-id of the host
+	if c.LinkJournal == "" && !c.HostMachineID {
+		c.LinkJournal = d.config.DefaultLinkJournal
+	}
+
+	return nil
+}
+
 var sanitizeName = regexp.MustCompile("[^a-zA-Z0-9-]+")
 
 func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
-	d.logger.Debug("StartTask called")
+	d.logger.Trace("StartTask called")
 	if _, ok := d.tasks.Get(cfg.ID); ok {
 		return nil, nil, fmt.Errorf("task with ID %q already started", cfg.ID)
 	}
 
+	if d.isDraining() {
+		return nil, nil, fmt.Errorf("the nix driver is draining and doesn't accept new tasks")
+	}
+
 	var driverConfig MachineConfig
 	if err := cfg.DecodeDriverConfig(&driverConfig); err != nil {
 		return nil, nil, fmt.Errorf("failed to decode driver config: %v", err)
@@ -350,23 +750,47 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		driverConfig.Machine = cfg.Name + "-" + cfg.AllocID
 	}
 
+	if err := d.applyPluginConfig(&driverConfig); err != nil {
+		return nil, nil, err
+	}
+
+	// Side effects are reverted in reverse order if the task fails to start.
+	started := false
+	var cleanup cleanupStack
+	defer func() {
+		if !started {
+			cleanup.run()
+		}
+	}()
+
 	d.oomChan = d.oomListener.Register(driverConfig.Machine)
+	cleanup.add(func() { d.oomListener.Deregister(driverConfig.Machine) })
 
 	driverConfig.Port = make(map[string]string)
 
+	if cfg.NetworkIsolation != nil && !supportsNetIsolationMode(cfg.NetworkIsolation.Mode) {
+		return nil, nil, fmt.Errorf("network isolation mode %q is not supported", cfg.NetworkIsolation.Mode)
+	}
+
 	//If network isolation is enabled, disable user namespacing and network-veth
 	if cfg.NetworkIsolation != nil {
 		driverConfig.NetworkNamespace = cfg.NetworkIsolation.Path
 		driverConfig.UserNamespacing = false
+		driverConfig.PrivateUsers = ""
 		driverConfig.NetworkVeth = false
 	}
 	// pass predefined environment vars
 	if driverConfig.Environment == nil {
 		driverConfig.Environment = make(hclutils.MapStrStr)
 	}
+	envDeny := append(append([]string{}, d.config.EnvDeny...), driverConfig.EnvDeny...)
 	for k, v := range cfg.Env {
+		if !envForwarded(k, driverConfig.EnvAllow, envDeny) {
+			continue
+		}
 		driverConfig.Environment[k] = v
 	}
+	driverConfig.inheritEnvironment(os.Environ())
 
 	for k, v := range driverConfig.Environment {
 		if strings.Contains(k, "-") {
@@ -384,6 +808,41 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	driverConfig.Bind[taskDirs.LocalDir] = cfg.Env["NOMAD_TASK_DIR"]
 	driverConfig.Bind[taskDirs.SecretsDir] = cfg.Env["NOMAD_SECRETS_DIR"]
 
+	if len(driverConfig.TaskDirMountOptions) > 0 {
+		cleanup.add(func() {
+			if err := unmountTaskDirs(taskDirs.Dir); err != nil {
+				d.logger.Error("failed to unmount task directories", "error", err)
+			}
+		})
+		if err := driverConfig.restrictTaskDirs(taskDirs.Dir, map[string]string{
+			"alloc":   taskDirs.SharedAllocDir,
+			"local":   taskDirs.LocalDir,
+			"secrets": taskDirs.SecretsDir,
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := driverConfig.prepareWritablePaths(taskDirs.Dir); err != nil {
+		return nil, nil, err
+	}
+
+	if driverConfig.HostMachineID {
+		if err := driverConfig.prepareHostMachineID(hostMachineIDPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(driverConfig.DNSOverTLS) > 0 {
+		if err := driverConfig.prepareDNSOverTLS(taskDirs.Dir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := driverConfig.prepareCredentials(taskDirs.Dir); err != nil {
+		return nil, nil, err
+	}
+
 	//bind volumes into container
 	if cfg.Mounts != nil && len(cfg.Mounts) > 0 {
 		if !d.config.Volumes {
@@ -402,6 +861,46 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		}
 	}
 
+	if err := driverConfig.resolveBindSources(); err != nil {
+		return nil, nil, err
+	}
+
+	cleanup.add(func() { removeNixGCRoots(taskDirs.Dir, d.logger) })
+
+	var nixOpts *nixOptions
+	if driverConfig.isNixOS() || driverConfig.isNixPackages() {
+		var err error
+		if nixOpts, err = driverConfig.nixOptions(taskDirs.Dir); err != nil {
+			return nil, nil, err
+		}
+		defer nixOpts.Close()
+
+		// builds using credentials aren't shared with tasks lacking them
+		if driverConfig.NixSSHKey == "" && driverConfig.NixNetrc == "" {
+			nixOpts.Cache = d.buildCache
+		}
+		nixOpts.ErrorLines = d.config.NixBuildErrorLines
+
+		// gives live progress of long builds in nomad alloc status, one
+		// event for each derivation built
+		nixOpts.Progress = func(line string) {
+			drv, ok := buildingDerivation(line)
+			if !ok {
+				return
+			}
+			if len(drv) > maxBuildEventLength {
+				drv = drv[:maxBuildEventLength] + "..."
+			}
+			d.eventer.EmitEvent(&drivers.TaskEvent{
+				TaskID:    cfg.ID,
+				AllocID:   cfg.AllocID,
+				TaskName:  cfg.Name,
+				Timestamp: time.Now(),
+				Message:   "Building: " + drv,
+			})
+		}
+	}
+
 	if driverConfig.NixOS != "" {
 		d.eventer.EmitEvent(&drivers.TaskEvent{
 			TaskID:    cfg.ID,
@@ -413,9 +912,22 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 				"nixos": driverConfig.NixOS,
 			},
 		})
+	} else if driverConfig.NixOSToplevel != "" {
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			AllocID:   cfg.AllocID,
+			TaskName:  cfg.Name,
+			Timestamp: time.Now(),
+			Message:   "Fetching prebuilt NixOS",
+			Annotations: map[string]string{
+				"nixos_toplevel": driverConfig.NixOSToplevel,
+			},
+		})
+	}
 
-		if err := driverConfig.prepareNixOS(taskDirs.Dir); err != nil {
-			return nil, nil, err
+	if driverConfig.isNixOS() {
+		if err := driverConfig.prepareNixOS(taskDirs.Dir, nixOpts); err != nil {
+			return nil, nil, d.nixBuildFailed(cfg, err)
 		}
 	}
 
@@ -431,8 +943,8 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 			},
 		})
 
-		if err := driverConfig.prepareNixPackages(taskDirs.Dir); err != nil {
-			return nil, nil, err
+		if err := driverConfig.prepareNixPackages(taskDirs.Dir, nixOpts); err != nil {
+			return nil, nil, d.nixBuildFailed(cfg, err)
 		}
 	}
 
@@ -441,89 +953,75 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	}
 
 	if cfg.Resources.NomadResources != nil {
-		if cfg.Resources.NomadResources.Memory.MemoryMaxMB != 0 {
-			driverConfig.Properties["MemoryHigh"] = strconv.Itoa(int(cfg.Resources.NomadResources.Memory.MemoryMB * 1024 * 1024))
-			driverConfig.Properties["MemoryMax"] = strconv.Itoa(int(cfg.Resources.NomadResources.Memory.MemoryMaxMB * 1024 * 1024))
-		} else {
-			driverConfig.Properties["MemoryMax"] = strconv.Itoa(int(cfg.Resources.NomadResources.Memory.MemoryMB * 1024 * 1024))
+		memory := cfg.Resources.NomadResources.Memory
+		if err := driverConfig.setMemoryProperties(memory.MemoryMB, memory.MemoryMaxMB); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	// Setup port mapping and exposed ports
-	if cfg.Resources != nil {
-		if len(driverConfig.PortMap) > 0 && len(driverConfig.Ports) > 0 {
-			d.logger.Error("Invalid port declaration; use of port_map and ports")
-			return nil, nil, fmt.Errorf("Invalid port declaration; use of port_map and ports")
-		}
+	if linux := cfg.Resources.LinuxResources; linux != nil {
+		driverConfig.setCPUProperties(linux.CPUShares, linux.PercentTicks, runtime.NumCPU())
+	}
 
-		if len(driverConfig.PortMap) > 0 && len(cfg.Resources.NomadResources.Networks) == 0 {
-			d.logger.Error("Trying to map ports but no network interface is available")
-			return nil, nil, fmt.Errorf("Trying to map ports but no network interface is available")
+	if driverConfig.OOMPolicy != "" {
+		version, err := hostSystemdVersion()
+		if err != nil {
+			return nil, nil, err
 		}
-
-		if len(driverConfig.Ports) > 0 && cfg.Resources.Ports == nil {
-			d.logger.Error("No ports defined in network stanza")
-			return nil, nil, fmt.Errorf("No ports defined in network stanza")
+		if err := driverConfig.oomPolicyProps(version); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		if len(driverConfig.Ports) > 0 {
-			for _, port := range driverConfig.Ports {
-				p, ok := cfg.Resources.Ports.Get(port)
-				if !ok {
-					d.logger.Error("Port " + port + " not found, check network stanza")
-					return nil, nil, fmt.Errorf("Port %q not found, check network stanza", port)
-				}
-				to := p.To
-				if to == 0 {
-					to = p.Value
-				}
-				driverConfig.Port[port] = fmt.Sprintf("%d:%d", p.Value, to)
-				d.logger.Debug("exposed port", "port", p.Value, "to", to)
-			}
-		} else if len(driverConfig.PortMap) > 0 {
-			network := cfg.Resources.NomadResources.Networks[0]
-			for _, port := range network.ReservedPorts {
-				// By default we will map the allocated port 1:1 to the container
-				machinePort := port.Value
-
-				// If the user has mapped a port using port_map we'll change it here
-				if mapped, ok := driverConfig.PortMap[port.Label]; ok {
-					machinePort = mapped
-				}
-
-				hostPort := port.Value
-				driverConfig.Port[port.Label] = fmt.Sprintf("%d:%d", hostPort, machinePort)
-
-				d.logger.Debug("allocated static port", "ip", network.IP, "port", hostPort)
-				d.logger.Debug("exposed port", "port", machinePort)
-			}
-
-			for _, port := range network.DynamicPorts {
-				// By default we will map the allocated port 1:1 to the container
-				machinePort := port.Value
-
-				// If the user has mapped a port using port_map we'll change it here
-				if mapped, ok := driverConfig.PortMap[port.Label]; ok {
-					machinePort = mapped
-				}
-
-				hostPort := port.Value
-				driverConfig.Port[port.Label] = fmt.Sprintf("%d:%d", hostPort, machinePort)
-
-				d.logger.Debug("allocated mapped port", "ip", network.IP, "port", hostPort)
-				d.logger.Debug("exposed port", "port", machinePort)
-			}
+	if driverConfig.NUMANode != nil {
+		if version, err := cgroupVersion(cgroupRoot); err != nil || version != 2 {
+			return nil, nil, fmt.Errorf("numa_node requires the unified cgroup hierarchy")
+		}
+		if err := driverConfig.setNUMAProperties(numaNodeRoot); err != nil {
+			return nil, nil, err
+		}
+	}
 
+	if driverConfig.delegateCgroup() {
+		if err := setupCgroupDelegation(&driverConfig); err != nil {
+			return nil, nil, err
 		}
 	}
 
+	if err := d.setupPorts(cfg, &driverConfig); err != nil {
+		return nil, nil, err
+	}
+
 	// Validate config
 	if err := driverConfig.Validate(); err != nil {
 		return nil, nil, fmt.Errorf("failed to validate task config: %v", err)
 	}
+	for _, warning := range driverConfig.warnings() {
+		d.logger.Warn(warning, "task_id", cfg.ID)
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			AllocID:   cfg.AllocID,
+			TaskName:  cfg.Name,
+			Timestamp: time.Now(),
+			Message:   warning,
+		})
+	}
+
+	if len(driverConfig.ExtraStorePaths) > 0 {
+		if err := driverConfig.prepareExtraStorePaths(taskDirs.Dir); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// Download image
+	var cleanupImage string
 	if driverConfig.ImageDownload != nil {
+		for _, u := range driverConfig.ImageDownload.urls() {
+			if !imageURLAllowed(d.config.AllowedImageRegistries, u) {
+				return nil, nil, fmt.Errorf("image_download.url %q is not in allowed_image_registries", redactURL(u))
+			}
+		}
+
 		d.eventer.EmitEvent(&drivers.TaskEvent{
 			TaskID:    cfg.ID,
 			AllocID:   cfg.AllocID,
@@ -532,68 +1030,286 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 			Message:   "Downloading image",
 			Annotations: map[string]string{
 				"image": driverConfig.Image,
-				"url":   driverConfig.ImageDownload.URL,
+				"url":   redactURL(driverConfig.ImageDownload.URL),
 			},
 		})
-		err := DownloadImage(driverConfig.ImageDownload.URL,
-			driverConfig.Image, driverConfig.ImageDownload.Verify,
-			driverConfig.ImageDownload.Type,
-			driverConfig.ImageDownload.Force, d.logger)
+		var download *imageDownload
+		var source string
+		var err error
+		for i, u := range driverConfig.ImageDownload.urls() {
+			if i > 0 {
+				d.logger.Warn("failed to download image, trying the next mirror", "image", driverConfig.Image, "url", redactURL(source), "mirror", redactURL(u), "error", err)
+				d.eventer.EmitEvent(&drivers.TaskEvent{
+					TaskID:    cfg.ID,
+					AllocID:   cfg.AllocID,
+					TaskName:  cfg.Name,
+					Timestamp: time.Now(),
+					Message:   "Downloading image from mirror",
+					Annotations: map[string]string{
+						"image": driverConfig.Image,
+						"url":   redactURL(u),
+						"error": err.Error(),
+					},
+				})
+			}
+			source = u
+			download, err = d.downloadImage(cfg, taskDirs.Dir, &driverConfig, u)
+			if err == nil {
+				break
+			}
+		}
+		if err == nil && download.path != "" {
+			// the verified image is imported like one fetched by an
+			// artifact stanza below
+			driverConfig.Image = download.path
+			driverConfig.ImageDownload = nil
+		}
+		if errors.Is(err, errTransferTimeout) {
+			// the mirror may be back by the time the task is restarted
+			return nil, nil, nstructs.NewRecoverableError(fmt.Errorf("failed to download image: %v", err), true)
+		}
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to download image: %v", err)
 		}
+		if driverConfig.ImageDownload != nil {
+			if err := d.images.Record(driverConfig.Image, redactURL(source), download.checksum, download.downloaded, cfg); err != nil {
+				d.logger.Warn("failed to record image in the index", "image", driverConfig.Image, "error", err)
+			}
+		}
+		if download.downloaded {
+			image := driverConfig.Image
+			cleanup.add(func() { d.removeUnusedImage(image) })
+			if driverConfig.CleanupImage {
+				cleanupImage = image
+			}
+		}
 	}
 
 	// Gather image path
-	imagePath, err := driverConfig.GetImagePath()
+	imagePath, err := driverConfig.GetImagePath(taskDirs.Dir)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to gather image path: %v", err)
 	}
 
-	driverConfig.imagePath = imagePath
+	// Images imported or cloned for this task are removed again by
+	// DestroyTask, or right away if the task fails to start.
+	taskImage := ""
 
-	// Get nspawn arguments
-	args, err := driverConfig.ConfigArray()
-	if err != nil {
-		d.logger.Error("Error generating machine config", "error", err)
-		return nil, nil, err
+	// Import tar archives placed in the task directory, e.g. by an artifact
+	// stanza. Raw images are used as they are.
+	if driverConfig.Image != "" && driverConfig.ImageDownload == nil {
+		if stat, err := os.Stat(imagePath); err == nil && stat.Mode().IsRegular() {
+			isTar, err := isTarImage(imagePath)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to inspect image: %v", err)
+			}
+			if isTar {
+				d.eventer.EmitEvent(&drivers.TaskEvent{
+					TaskID:    cfg.ID,
+					AllocID:   cfg.AllocID,
+					TaskName:  cfg.Name,
+					Timestamp: time.Now(),
+					Message:   "Importing image",
+					Annotations: map[string]string{
+						"image": driverConfig.Image,
+					},
+				})
+				ctx, cancel := context.WithTimeout(d.ctx, imageTransferTimeout)
+				err := ImportImage(ctx, imagePath, driverConfig.Machine, TarImage, d.logger)
+				cancel()
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to import image: %v", err)
+				}
+				taskImage = driverConfig.Machine
+				cleanup.add(func() { d.removeTaskImage(taskImage) })
+				driverConfig.Image = taskImage
+				if imagePath, err = driverConfig.GetImagePath(taskDirs.Dir); err != nil {
+					return nil, nil, fmt.Errorf("failed to gather image path: %v", err)
+				}
+			}
+		}
 	}
 
-	d.logger.Debug("starting nspawn task", "driver_cfg", hclog.Fmt("%+v", driverConfig))
-	d.logger.Debug("resources", "nomad", fmt.Sprintf("%+v", cfg.Resources.NomadResources), "linux", fmt.Sprintf("%+v", cfg.Resources.LinuxResources), "ports", fmt.Sprintf("%+v", cfg.Resources.Ports))
-	d.logger.Debug("commad arguments", "args", args)
+	// The quota is set on a clone of the image, so tasks sharing the image
+	// don't affect each other. Nomad doesn't pass the ephemeral_disk size of
+	// the group to drivers, so it can't be used as default for the quota.
+	if driverConfig.DiskQuota > 0 {
+		if taskImage == "" {
+			image, err := DescribeImage(driverConfig.Image)
+			if err != nil || image.Path != imagePath {
+				return nil, nil, fmt.Errorf("disk_quota requires an image managed by machinectl")
+			}
+			if image.Type != "subvolume" {
+				return nil, nil, fmt.Errorf("disk_quota requires an image stored as btrfs subvolume, %q is of type %q", image.Name, image.Type)
+			}
+			if err := CloneImage(driverConfig.Image, driverConfig.Machine); err != nil {
+				return nil, nil, fmt.Errorf("failed to clone image: %v", err)
+			}
+			taskImage = driverConfig.Machine
+			cleanup.add(func() { d.removeTaskImage(taskImage) })
+			driverConfig.Image = taskImage
+			if imagePath, err = driverConfig.GetImagePath(taskDirs.Dir); err != nil {
+				return nil, nil, fmt.Errorf("failed to gather image path: %v", err)
+			}
+		}
 
-	executorConfig := &executor.ExecutorConfig{
-		LogFile:  filepath.Join(cfg.TaskDir().Dir, "executor.out"),
-		LogLevel: "debug",
+		if err := SetImageLimit(taskImage, diskQuotaBytes(driverConfig.DiskQuota)); err != nil {
+			return nil, nil, fmt.Errorf("failed to set disk quota: %v", err)
+		}
 	}
 
-	exec, pluginClient, err := executor.CreateExecutor(d.logger, d.nomadConfig, executorConfig)
+	driverConfig.imagePath = imagePath
 
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create executor: %v", err)
+	var imageType string
+	if driverConfig.Image != "" {
+		if imageType, err = driverConfig.imageKind(); err != nil {
+			return nil, nil, fmt.Errorf("failed to determine image type: %v", err)
+		}
+		if imageType == RawImage {
+			if err := checkRawImage(imagePath, runtime.GOARCH); err != nil {
+				return nil, nil, fmt.Errorf("unsupported raw image %s: %v", imagePath, err)
+			}
+		}
 	}
+	driverConfig.imageType = imageType
 
-	execCmd := &executor.ExecCommand{
-		Cmd:        "systemd-nspawn",
-		Args:       args,
-		StdoutPath: cfg.StdoutPath,
-		StderrPath: cfg.StderrPath,
-		Resources:  cfg.Resources,
-	}
+	var cniAttachment *CNIAttachment
+	var cniIP net.IP
+	if driverConfig.CNINetwork != "" {
+		groupNetns := ""
+		if cfg.NetworkIsolation != nil {
+			groupNetns = cfg.NetworkIsolation.Path
+		}
 
-	ps, err := exec.Launch(execCmd)
-	if err != nil {
-		pluginClient.Kill()
-		return nil, nil, fmt.Errorf("failed to launch command with executor: %v", err)
-	}
+		// ports of a task in its own namespace are mapped by the CNI network
+		ports, err := cniPortMappings(driverConfig.Port)
+		if err != nil {
+			return nil, nil, err
+		}
+		driverConfig.Port = make(hclutils.MapStrStr)
 
-	printErr := func() {
-		logDir := cfg.TaskDir().LogDir
-		logs, err := filepath.Glob(filepath.Join(logDir, cfg.Name+"*"))
+		cniAttachment, cniIP, err = d.attachCNI(driverConfig.CNINetwork, driverConfig.Machine, groupNetns, ports)
 		if err != nil {
-			d.logger.Error("error finding log files", err)
-			return
+			return nil, nil, fmt.Errorf("failed to attach to CNI network: %v", err)
+		}
+		cleanup.add(func() { d.detachCNI(cniAttachment) })
+
+		driverConfig.NetworkNamespace = cniAttachment.Netns
+		driverConfig.UserNamespacing = false
+		driverConfig.PrivateUsers = ""
+		driverConfig.NetworkVeth = false
+	}
+
+	if driverConfig.setDefaultResolvConf(isResolvedActive(hostResolvConf)) {
+		d.logger.Warn("resolv.conf of the host uses the systemd-resolved stub, DNS may not work in the container",
+			"resolv_conf", driverConfig.ResolvConf)
+	}
+
+	machineIP := ""
+	if cniIP != nil {
+		machineIP = cniIP.String()
+	} else if !driverConfig.privateNetwork() && cfg.Resources.NomadResources != nil &&
+		len(cfg.Resources.NomadResources.Networks) > 0 {
+		machineIP = cfg.Resources.NomadResources.Networks[0].IP
+	}
+	if err := driverConfig.templateEnvironment(map[string]string{
+		"MACHINE_NAME": driverConfig.Machine,
+		"MACHINE_ID":   driverConfig.machineID,
+		"MACHINE_IP":   machineIP,
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	if driverConfig.LogRateLimitInterval != "" || driverConfig.LogRateLimitBurst != nil {
+		if err := driverConfig.exportLogRateLimit(systemdUnitsDir); err != nil {
+			return nil, nil, err
+		}
+		cleanup.add(func() { unexportLogRateLimit(systemdUnitsDir, driverConfig.Machine) })
+	}
+
+	// Get nspawn arguments
+	args, err := driverConfig.ConfigArray()
+	if err != nil {
+		d.logger.Error("Error generating machine config", "error", err)
+		return nil, nil, err
+	}
+
+	d.logger.Trace("starting nspawn task", "driver_cfg", hclog.Fmt("%s", &driverConfig))
+	d.logger.Trace("resources", "nomad", fmt.Sprintf("%+v", cfg.Resources.NomadResources), "linux", fmt.Sprintf("%+v", cfg.Resources.LinuxResources), "ports", fmt.Sprintf("%+v", cfg.Resources.Ports))
+	d.logger.Debug("starting nspawn task", "name", driverConfig.Machine, "args", redactArgs(args))
+
+	executorConfig := &executor.ExecutorConfig{
+		LogFile:  filepath.Join(cfg.TaskDir().Dir, "executor.out"),
+		LogLevel: executorLogLevel(d.config.LogLevel),
+	}
+
+	execCmd := &executor.ExecCommand{
+		Cmd:        "systemd-nspawn",
+		Args:       args,
+		StdoutPath: cfg.StdoutPath,
+		StderrPath: cfg.StderrPath,
+		Resources:  cfg.Resources,
+		Env:        driverConfig.processEnv(os.Environ()),
+	}
+
+	// The executor always connects stdin to /dev/null, so with console=pipe
+	// the container reads EOF right away. If a stdin file was requested,
+	// redirect it through a shell that execs into systemd-nspawn.
+	if driverConfig.Stdin != "" {
+		stdin, err := resolveTaskDirPath(taskDirs.Dir, driverConfig.Stdin)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid stdin: %v", err)
+		}
+		execCmd.Cmd = "sh"
+		execCmd.Args = append([]string{"-c", `exec "$@" < "$0"`, stdin, "systemd-nspawn"}, args...)
+	}
+
+	launch := func() (executor.Executor, *plugin.Client, error) {
+		exec, pluginClient, err := executor.CreateExecutor(d.logger, d.nomadConfig, executorConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create executor: %v", err)
+		}
+
+		if _, err = exec.Launch(execCmd); err != nil {
+			pluginClient.Kill()
+			return nil, nil, fmt.Errorf("failed to launch command with executor: %v", err)
+		}
+		return exec, pluginClient, nil
+	}
+
+	exec, pluginClient, err := launch()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Launch returns as soon as systemd-nspawn was started, the machine gets
+	// registered a bit later. Watch the process so a failed start can be told
+	// apart from a slow one.
+	exited := make(chan struct{})
+	var exitState *executor.ProcessState
+	waitCtx, cancelWait := context.WithCancel(context.Background())
+	defer cancelWait()
+	go func() {
+		if ps, err := exec.Wait(waitCtx); err == nil {
+			exitState = ps
+			close(exited)
+		}
+	}()
+	hasExited := func() bool {
+		select {
+		case <-exited:
+			return true
+		default:
+			return false
+		}
+	}
+
+	printErr := func() {
+		logDir := cfg.TaskDir().LogDir
+		logs, err := filepath.Glob(filepath.Join(logDir, cfg.Name+"*"))
+		if err != nil {
+			d.logger.Error("error finding log files", err)
+			return
 		}
 
 		for _, l := range logs {
@@ -618,33 +1334,47 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		}
 	}
 
-	p, err := DescribeMachine(driverConfig.Machine, machinePropertiesTimeout)
-	if err != nil {
-		d.logger.Error("failed to get machine information", "error", err)
-		if ps.ExitCode != 0 {
-			printErr()
-			err = fmt.Errorf("systemd-nspawn failed to start task")
-		}
-		if !pluginClient.Exited() {
-			if err := exec.Shutdown("", 0); err != nil {
-				d.logger.Error("destroying executor failed", "err", err)
+	// without registering, machined knows nothing about the container and
+	// the address falls back to the one of the Nomad network
+	p := &MachineProps{Name: driverConfig.Machine}
+	if driverConfig.register() {
+		p, err = WaitForMachine(driverConfig.Machine, d.config.machineStartTimeout, exited)
+		if err != nil {
+			d.logger.Error("failed to get machine information", "error", err)
+			if hasExited() {
+				printErr()
+				err = fmt.Errorf("systemd-nspawn failed to start task, exit code %d", exitState.ExitCode)
 			}
+			if !pluginClient.Exited() {
+				if err := exec.Shutdown("", 0); err != nil {
+					d.logger.Error("destroying executor failed", "err", err)
+				}
 
-			pluginClient.Kill()
+				pluginClient.Kill()
+			}
+			return nil, nil, err
 		}
-		return nil, nil, err
+		d.logger.Debug("gathered information about new machine", "name", p.Name, "leader", p.Leader)
 	}
-	d.logger.Debug("gathered information about new machine", "name", p.Name, "leader", p.Leader)
 
 	var ip string
 	netIF := []string{}
-	if len(p.NetworkInterfaces) > 0 {
+	if cniIP != nil {
+		ip = cniIP.String()
+	} else if len(p.NetworkInterfaces) > 0 || (driverConfig.register() && driverConfig.lanNetwork()) {
 		addr, err := MachineAddresses(driverConfig.Machine, machineAddressTimeout)
+		if err == errNoMachineAddress {
+			if fallback, ferr := namespaceAddresses("/proc", p.Leader); ferr == nil {
+				d.logger.Warn("machined reported no address, using the address of the container's network namespace",
+					"name", p.Name, "ip", fallback.IPv4.String())
+				addr, err = fallback, nil
+			}
+		}
 		if err != nil {
 			d.logger.Error("failed to get machine addresses", "error", err, "addresses", addr)
-			if ps.ExitCode != 0 {
+			if hasExited() {
 				printErr()
-				err = fmt.Errorf("systemd-nspawn failed to start task")
+				err = fmt.Errorf("systemd-nspawn failed to start task, exit code %d", exitState.ExitCode)
 			}
 			if !pluginClient.Exited() {
 				if err := exec.Shutdown("", 0); err != nil {
@@ -659,22 +1389,66 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		d.logger.Debug("gathered address of new machine", "name", p.Name, "ip", addr.IPv4.String())
 		ip = addr.IPv4.String()
 
-		netIF, err = p.GetNetworkInterfaces()
-		if err != nil {
-			d.logger.Error("failed to get machine network interfacves", "error", err)
+		// machined only lists the host side of veth links, macvlan and
+		// ipvlan links need no forwarding rules. Neither does a link to
+		// the bridge of network_bridge, which the operator manages.
+		if len(p.NetworkInterfaces) > 0 && driverConfig.NetworkBridge == "" {
+			netIF, err = p.GetNetworkInterfaces()
+			if err != nil {
+				d.logger.Error("failed to get machine network interfacves", "error", err)
+			}
 		}
 	} else if len(cfg.Resources.NomadResources.Networks) > 0 {
 		ip = cfg.Resources.NomadResources.Networks[0].IP
 	}
+	// machined only knows about the main veth link
+	netIF = append(netIF, driverConfig.vethExtraHostInterfaces()...)
 
-	network := &drivers.DriverNetwork{
-		PortMap:       driverConfig.PortMap,
-		IP:            ip,
-		AutoAdvertise: false,
+	if driverConfig.ReadyUnit != "" {
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			AllocID:   cfg.AllocID,
+			TaskName:  cfg.Name,
+			Timestamp: time.Now(),
+			Message:   "Waiting for unit to become active",
+			Annotations: map[string]string{
+				"unit": driverConfig.ReadyUnit,
+			},
+		})
+
+		ctx, cancel := context.WithTimeout(d.ctx, driverConfig.readyTimeout())
+		err := waitForUnit(ctx, driverConfig.ReadyUnit, func() (string, error) {
+			return unitState(driverConfig.Machine, driverConfig.ReadyUnit)
+		}, exited, time.Second)
+		cancel()
+		if err != nil {
+			d.logger.Error("ready unit did not become active", "unit", driverConfig.ReadyUnit, "error", err)
+			if !pluginClient.Exited() {
+				if err := exec.Shutdown("", 0); err != nil {
+					d.logger.Error("destroying executor failed", "err", err)
+				}
+
+				pluginClient.Kill()
+			}
+			return nil, nil, err
+		}
+
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			AllocID:   cfg.AllocID,
+			TaskName:  cfg.Name,
+			Timestamp: time.Now(),
+			Message:   "Unit is active",
+			Annotations: map[string]string{
+				"unit": driverConfig.ReadyUnit,
+			},
+		})
 	}
 
-	if cfg.NetworkIsolation == nil && len(p.NetworkInterfaces) > 0 {
-		err = ConfigureIPTablesRules(false, netIF)
+	network := taskNetwork(cfg, &driverConfig, ip, cniIP)
+
+	if cfg.NetworkIsolation == nil && len(netIF) > 0 {
+		err = ConfigureIPTablesRules(false, driverConfig.Machine, netIF, d.config.IPv6)
 		if err != nil {
 			d.logger.Error("Failed to set up IPTables rules", "error", err)
 		}
@@ -690,28 +1464,160 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		taskConfig:   cfg,
 		procState:    drivers.TaskStateRunning,
 		startedAt:    time.Now().Round(time.Millisecond),
+		imagePath:    imagePath,
+		imageType:    imageType,
+		cni:          cniAttachment,
+
+		taskImage:       taskImage,
+		cleanupImage:    cleanupImage,
+		execServiceType: driverConfig.ExecServiceType,
+		cmdline:         joinArgs(append([]string{"systemd-nspawn"}, redactArgs(args)...)),
 	}
 
-	driverState := TaskState{
-		ReattachConfig: structs.ReattachConfigFromGoPlugin(pluginClient.ReattachConfig()),
-		MachineName:    driverConfig.Machine,
-		StartedAt:      h.startedAt,
+	if driverConfig.RestartOnOOM > 0 {
+		h.maxOOMRestarts = driverConfig.RestartOnOOM
+		h.relaunch = func() (executor.Executor, *plugin.Client, *MachineProps, error) {
+			exec, pluginClient, err := launch()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			exited := make(chan struct{})
+			go func() {
+				if _, err := exec.Wait(d.ctx); err == nil {
+					close(exited)
+				}
+			}()
+
+			p, err := WaitForMachine(driverConfig.Machine, d.config.machineStartTimeout, exited)
+			if err != nil {
+				if !pluginClient.Exited() {
+					if err := exec.Shutdown("", 0); err != nil {
+						d.logger.Error("destroying executor failed", "err", err)
+					}
+
+					pluginClient.Kill()
+				}
+				return nil, nil, nil, err
+			}
+			return exec, pluginClient, p, nil
+		}
 	}
 
-	if err := handle.SetDriverState(&driverState); err != nil {
+	driverState := h.driverState()
+	driverState.MachineName = driverConfig.Machine
+
+	if err := handle.SetDriverState(driverState); err != nil {
 		d.logger.Error("failed to start task, error setting driver state", "error", err)
 		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
 	}
 
 	d.tasks.Set(cfg.ID, h)
+	started = true
 
 	go h.run()
 
 	return handle, network, nil
 }
 
+// taskNetwork returns the network to advertise for the task. The address of a
+// group network is owned by the allocation, not the task.
+func taskNetwork(cfg *drivers.TaskConfig, c *MachineConfig, ip string, cniIP net.IP) *drivers.DriverNetwork {
+	if cfg.NetworkIsolation != nil && cniIP == nil {
+		return nil
+	}
+
+	return &drivers.DriverNetwork{
+		PortMap:       c.PortMap,
+		IP:            ip,
+		AutoAdvertise: false,
+	}
+}
+
+// setupPorts translates ports and port_map into nspawn port mappings.
+func (d *Driver) setupPorts(cfg *drivers.TaskConfig, c *MachineConfig) error {
+	// Setup port mapping and exposed ports
+	if cfg.Resources != nil {
+		if len(c.PortMap) > 0 && len(c.Ports) > 0 {
+			d.logger.Error("Invalid port declaration; use of port_map and ports")
+			return fmt.Errorf("Invalid port declaration; use of port_map and ports")
+		}
+
+		if len(c.PortMap) > 0 && len(cfg.Resources.NomadResources.Networks) == 0 {
+			d.logger.Error("Trying to map ports but no network interface is available")
+			return fmt.Errorf("Trying to map ports but no network interface is available")
+		}
+
+		if len(c.Ports) > 0 && cfg.Resources.Ports == nil {
+			d.logger.Error("No ports defined in network stanza")
+			return fmt.Errorf("No ports defined in network stanza")
+		}
+
+		if len(c.Ports) > 0 {
+			for _, port := range c.Ports {
+				p, ok := cfg.Resources.Ports.Get(port)
+				if !ok {
+					d.logger.Error("Port " + port + " not found, check network stanza")
+					return fmt.Errorf("Port %q not found, check network stanza", port)
+				}
+				to := p.To
+				if to == 0 {
+					to = p.Value
+				}
+				c.Port[port] = fmt.Sprintf("%d:%d", p.Value, to)
+				d.logger.Debug("exposed port", "port", p.Value, "to", to)
+			}
+		} else if len(c.PortMap) > 0 {
+			network := cfg.Resources.NomadResources.Networks[0]
+			for _, port := range network.ReservedPorts {
+				// By default we will map the allocated port 1:1 to the container
+				machinePort := port.Value
+
+				// If the user has mapped a port using port_map we'll change it here
+				if mapped, ok := c.PortMap[port.Label]; ok {
+					machinePort = mapped
+				}
+
+				hostPort := port.Value
+				c.Port[port.Label] = fmt.Sprintf("%d:%d", hostPort, machinePort)
+
+				d.logger.Debug("allocated static port", "ip", network.IP, "port", hostPort)
+				d.logger.Debug("exposed port", "port", machinePort)
+			}
+
+			for _, port := range network.DynamicPorts {
+				// By default we will map the allocated port 1:1 to the container
+				machinePort := port.Value
+
+				// If the user has mapped a port using port_map we'll change it here
+				if mapped, ok := c.PortMap[port.Label]; ok {
+					machinePort = mapped
+				}
+
+				hostPort := port.Value
+				c.Port[port.Label] = fmt.Sprintf("%d:%d", hostPort, machinePort)
+
+				d.logger.Debug("allocated mapped port", "ip", network.IP, "port", hostPort)
+				d.logger.Debug("exposed port", "port", machinePort)
+			}
+
+		}
+	}
+
+	// In bridge mode the ports are forwarded into the shared network namespace
+	// by Nomad's CNI portmap plugin, while nspawn's -p only works with a
+	// private veth network.
+	if cfg.NetworkIsolation != nil && len(c.Port) > 0 {
+		d.logger.Warn("ignoring port mapping of the task, ports are mapped by the network of the task group",
+			"task", cfg.Name, "ports", c.Port)
+		c.Port = make(hclutils.MapStrStr)
+	}
+
+	return nil
+}
+
 func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.ExitResult, error) {
-	d.logger.Debug("WaitTask called")
+	d.logger.Trace("WaitTask called")
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return nil, drivers.ErrTaskNotFound
@@ -727,24 +1633,64 @@ func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *dr
 	defer close(ch)
 	var result *drivers.ExitResult
 
-	ps, err := handle.exec.Wait(ctx)
-	if err != nil {
-		result = &drivers.ExitResult{
-			Err: fmt.Errorf("executor: error waiting on process: %v", err),
+	for {
+		exec := handle.executor()
+		ps, err := exec.Wait(ctx)
+		if err != nil {
+			result = &drivers.ExitResult{
+				Err: fmt.Errorf("executor: error waiting on process: %v", err),
+			}
+		} else {
+			result = &drivers.ExitResult{
+				ExitCode: ps.ExitCode,
+				Signal:   ps.Signal,
+			}
 		}
-	} else {
-		result = &drivers.ExitResult{
-			ExitCode: ps.ExitCode,
-			Signal:   ps.Signal,
+
+		// logs about OOM may take a bit to show up.
+		select {
+		case <-time.After(5 * time.Second):
+		case oom := <-d.oomChan:
+			result.OOMKilled = true
+			result.Err = errors.New(oom.message())
+		}
+
+		if !result.OOMKilled {
+			break
+		}
+		if handle.executor() != exec {
+			// restarted by another waiter
+			continue
+		}
+		delay, ok := handle.nextOOMRestart(exec)
+		if !ok {
+			break
 		}
-	}
 
-	// logs about OOM may take a bit to show up.
-	select {
-	case <-time.After(5 * time.Second):
-	case <-d.oomChan:
-		result.OOMKilled = true
-		result.Err = fmt.Errorf("Out of memory")
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    handle.taskConfig.ID,
+			AllocID:   handle.taskConfig.AllocID,
+			TaskName:  handle.taskConfig.Name,
+			Timestamp: time.Now(),
+			Message:   "Restarting container killed by the OOM killer",
+			Annotations: map[string]string{
+				"delay": delay.String(),
+			},
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		case <-d.ctx.Done():
+			return
+		}
+
+		if err := handle.restartAfterOOM(exec); err != nil {
+			d.logger.Error("failed to restart container after OOM", "error", err)
+			break
+		}
+		d.restartedAfterOOM(handle)
 	}
 
 	d.oomListener.Deregister(handle.machine.Name)
@@ -760,32 +1706,128 @@ func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *dr
 	}
 }
 
+// machineInterfaces returns the host side network interfaces of the machine
+// that need forwarding rules. machined only lists the main veth link, and
+// links to the bridge of network_bridge are managed by the operator.
+func (d *Driver) machineInterfaces(p *MachineProps, c *MachineConfig) []string {
+	netIF := []string{}
+	if len(p.NetworkInterfaces) > 0 && c.NetworkBridge == "" {
+		var err error
+		netIF, err = p.GetNetworkInterfaces()
+		if err != nil {
+			d.logger.Error("failed to get machine network interfacves", "error", err)
+		}
+	}
+	return append(netIF, c.vethExtraHostInterfaces()...)
+}
+
+// restartedAfterOOM sets up the forwarding rules for the links of the new
+// container and keeps the state of the task, so RecoverTask reattaches to
+// the new executor.
+func (d *Driver) restartedAfterOOM(h *taskHandle) {
+	var driverConfig MachineConfig
+	if err := h.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		d.logger.Warn("failed to decode driver config", "error", err)
+	}
+
+	h.stateLock.Lock()
+	oldIF := h.networkInterfaces
+	h.networkInterfaces = d.machineInterfaces(h.machine, &driverConfig)
+	netIF := h.networkInterfaces
+	name := h.machine.Name
+	h.stateLock.Unlock()
+
+	if h.taskConfig.NetworkIsolation == nil {
+		if len(oldIF) > 0 {
+			if err := ConfigureIPTablesRules(true, name, oldIF, d.config.IPv6); err != nil {
+				d.logger.Error("failed to remove IPTables rules", "error", err)
+			}
+		}
+		if len(netIF) > 0 {
+			if err := ConfigureIPTablesRules(false, name, netIF, d.config.IPv6); err != nil {
+				d.logger.Error("failed to set up IPTables rules", "error", err)
+			}
+		}
+	}
+
+	if err := d.restarted.Put(h.taskConfig.ID, h.driverState()); err != nil {
+		d.logger.Error("failed to keep state of restarted task, it can't be recovered after a restart of the client", "task_id", h.taskConfig.ID, "error", err)
+	}
+}
+
 func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) error {
-	d.logger.Debug("StopTask called")
+	d.logger.Trace("StopTask called")
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return drivers.ErrTaskNotFound
 	}
 
-	if handle.taskConfig.NetworkIsolation == nil && len(handle.networkInterfaces) > 0 &&
-		!strings.HasPrefix(handle.networkInterfaces[0], "vz-") {
-		if err := ConfigureIPTablesRules(true, handle.networkInterfaces); err != nil {
+	// only the rules of this machine are removed, the bridge of a zone is
+	// shared with other containers
+	if handle.taskConfig.NetworkIsolation == nil && len(handle.networkInterfaces) > 0 {
+		if err := ConfigureIPTablesRules(true, handle.machine.Name, handle.networkInterfaces, d.config.IPv6); err != nil {
 			d.logger.Error("StopTask: Failed to remove IPTables rules", "error", err)
 		}
 	}
 
+	var driverConfig MachineConfig
+	if err := handle.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		d.logger.Warn("StopTask: failed to decode driver config", "error", err)
+	}
+	signal, timeout = driverConfig.stopParams(signal, timeout)
+
+	// Signals sent to systemd-nspawn by the executor only reach the machine
+	// as it sees fit, a booted container ignoring them hangs until the
+	// executor gives up. Registered machines are stopped through machined
+	// first and killed once the grace period is over.
+	if driverConfig.register() {
+		d.stopMachine(handle.machine.Name, driverConfig.machineStopSignal(signal), timeout)
+	}
+
 	if err := handle.exec.Shutdown(signal, timeout); err != nil {
 		if handle.pluginClient.Exited() {
+			d.killMachine(handle.machine.Name)
 			return nil
 		}
 		return fmt.Errorf("StopTask: executor Shutdown failed: %v", err)
 	}
 
+	// The executor kills systemd-nspawn once the grace period is over, but
+	// processes ignoring the signal keep running in the machine's scope.
+	d.killMachine(handle.machine.Name)
+
 	return nil
 }
 
+// stopMachine sends signal to the leader of a registered machine and waits up
+// to timeout for it to stop, killing all of its processes if it doesn't.
+func (d *Driver) stopMachine(name string, signal syscall.Signal, timeout time.Duration) {
+	if _, err := DescribeMachine(name, 0); err != nil {
+		return
+	}
+	d.logger.Debug("stopping machine", "machine", name, "signal", signal, "timeout", timeout)
+	if err := SignalMachineLeader(name, signal); err != nil {
+		d.logger.Warn("failed to signal machine", "machine", name, "signal", signal, "error", err)
+	} else if WaitForMachineGone(name, timeout) {
+		return
+	}
+	d.killMachine(name)
+}
+
+// killMachine kills all processes of a machine that is still registered
+// after its systemd-nspawn process was stopped.
+func (d *Driver) killMachine(name string) {
+	if _, err := DescribeMachine(name, 0); err != nil {
+		return
+	}
+	d.logger.Warn("machine still running after the grace period, killing it", "machine", name)
+	if err := KillMachine(name, syscall.SIGKILL); err != nil {
+		d.logger.Error("failed to kill machine", "machine", name, "error", err)
+	}
+}
+
 func (d *Driver) DestroyTask(taskID string, force bool) error {
-	d.logger.Debug("DestroyTask called")
+	d.logger.Trace("DestroyTask called")
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return drivers.ErrTaskNotFound
@@ -799,18 +1841,241 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 		handle.pluginClient.Kill()
 	}
 
+	if handle.cni != nil {
+		d.detachCNI(handle.cni)
+	}
+
+	if handle.taskImage != "" {
+		d.removeTaskImage(handle.taskImage)
+	}
+
+	if err := unmountTaskDirs(handle.taskConfig.TaskDir().Dir); err != nil {
+		d.logger.Error("failed to unmount task directories", "error", err)
+	}
+
+	if err := unexportLogRateLimit(systemdUnitsDir, handle.machine.Name); err != nil {
+		d.logger.Error("failed to remove log rate limit", "machine", handle.machine.Name, "error", err)
+	}
+
+	// the store paths of the task can be collected once it is gone, a
+	// restart builds or takes them from the build cache again
+	removeNixGCRoots(handle.taskConfig.TaskDir().Dir, d.logger)
+
 	d.tasks.Delete(taskID)
+	if err := d.restarted.Delete(taskID); err != nil {
+		d.logger.Warn("failed to remove state of restarted task", "task_id", taskID, "error", err)
+	}
+
+	// removed after the task is gone, so it doesn't count as a user
+	if handle.cleanupImage != "" {
+		d.removeUnusedImage(handle.cleanupImage)
+	}
 	return nil
 }
 
+// nixBuildFailed reports a failed nix build as a task event, with the last
+// lines of the output of nix and the derivation that failed. The complete
+// output goes to the log of the driver. Other errors are returned as they
+// are.
+func (d *Driver) nixBuildFailed(cfg *drivers.TaskConfig, err error) error {
+	var buildErr *nixBuildError
+	if !errors.As(err, &buildErr) {
+		return err
+	}
+	d.logger.Error("nix build failed", "task_id", cfg.ID, "command", buildErr.Args,
+		"output", buildErr.Output, "error", buildErr.Err)
+
+	annotations := map[string]string{"output": buildErr.tail()}
+	if drv := buildErr.derivation(); drv != "" {
+		annotations["derivation"] = drv
+	}
+	d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     "Nix build failed",
+		Annotations: annotations,
+		Err:         buildErr.Err,
+	})
+	return err
+}
+
+// imageDownload is the outcome of downloading the image of a task.
+type imageDownload struct {
+	// path of an image in the task directory, verified against separate
+	// checksums, that is imported like an artifact
+	path string
+	// checksum is the SHA256 computed while downloading the image
+	checksum   string
+	downloaded bool
+}
+
+// downloadImage downloads the image of the task from url, the URL of
+// image_download or one of its mirrors, within the download timeout.
+func (d *Driver) downloadImage(cfg *drivers.TaskConfig, taskDir string, driverConfig *MachineConfig, url string) (*imageDownload, error) {
+	opts := *driverConfig.ImageDownload
+	opts.URL = url
+
+	ctx, cancel := context.WithTimeout(d.ctx, opts.timeout())
+	defer cancel()
+
+	if opts.Checksums != "" {
+		path, err := downloadVerifiedImage(ctx, taskDir, &opts)
+		return &imageDownload{path: path}, err
+	}
+	if opts.Checksum != "" {
+		return d.downloadChecksummedImage(ctx, taskDir, driverConfig.Image, &opts)
+	}
+	// large images take a while, report their progress without flooding
+	// the events of the task
+	throttle := &progressThrottle{step: 0.05, interval: 10 * time.Second}
+	progress := func(p float64) {
+		if !throttle.due(p, time.Now()) {
+			return
+		}
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			AllocID:   cfg.AllocID,
+			TaskName:  cfg.Name,
+			Timestamp: time.Now(),
+			Message:   fmt.Sprintf("Downloading image: %.0f%%", p*100),
+			Annotations: map[string]string{
+				"image":    driverConfig.Image,
+				"url":      redactURL(url),
+				"progress": fmt.Sprintf("%.0f", p*100),
+			},
+		})
+	}
+	downloaded, err := DownloadImage(ctx, url, driverConfig.Image, opts.Verify, opts.Type, opts.Force, progress, d.logger)
+	return &imageDownload{downloaded: downloaded}, err
+}
+
+// downloadChecksummedImage downloads an image and checks it against
+// image_download.checksum before importing it. importd unpacks and converts
+// images, so their checksum can't be computed again later; the one computed
+// while downloading is recorded in the image index instead. An image that is
+// present is reused unless the checksum recorded for it differs, images
+// without a record are trusted.
+func (d *Driver) downloadChecksummedImage(ctx context.Context, taskDir, name string, opts *ImageDownloadOpts) (*imageDownload, error) {
+	if image, err := DescribeImage(name); err == nil && !opts.Force {
+		recorded, err := d.images.Checksum(name)
+		if err != nil {
+			return nil, err
+		}
+		if recorded == "" || recorded == opts.Checksum {
+			d.logger.Info("image already exists, skipping download", "image", name)
+			return &imageDownload{}, nil
+		}
+		// an interrupted or corrupted pull, or an older build of the image
+		if d.imageInUse(image.Path) {
+			return nil, fmt.Errorf("image %s does not match image_download.checksum and is used by a running task", name)
+		}
+		d.logger.Warn("image does not match image_download.checksum, downloading it again", "image", name)
+	}
+
+	file, err := downloadFileName(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := fetchVerifiedFile(ctx, taskDir, opts.URL, file, opts.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(taskDir, rel)
+	defer os.Remove(path)
+
+	if err := ImportImage(ctx, path, name, opts.Type, d.logger); err != nil {
+		return nil, err
+	}
+	return &imageDownload{checksum: opts.Checksum, downloaded: true}, nil
+}
+
+// removeTaskImage removes an image imported or cloned for a single task.
+func (d *Driver) removeTaskImage(name string) {
+	if err := RemoveImage(name); err != nil {
+		d.logger.Error("failed to remove task image", "image", name, "error", err)
+	}
+}
+
+// removeUnusedImage removes a downloaded image unless a running task uses it.
+func (d *Driver) removeUnusedImage(name string) {
+	image, err := DescribeImage(name)
+	if err != nil {
+		d.logger.Error("failed to describe image", "image", name, "error", err)
+		return
+	}
+	if d.imageInUse(image.Path) {
+		d.logger.Debug("image is still in use, keeping it", "image", name)
+		return
+	}
+	if managed, err := d.images.Contains(name); err != nil || !managed {
+		d.logger.Debug("image wasn't downloaded by the driver, keeping it", "image", name, "error", err)
+		return
+	}
+	if err := RemoveImage(name); err != nil {
+		d.logger.Error("failed to remove image", "image", name, "error", err)
+		return
+	}
+	if err := d.images.Remove(name); err != nil {
+		d.logger.Warn("failed to remove image from the index", "image", name, "error", err)
+	}
+}
+
+// imageInUse reports whether any task runs from the image at path.
+func (d *Driver) imageInUse(path string) bool {
+	for _, h := range d.tasks.List() {
+		if h.imagePath == path {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupStack collects functions reverting the side effects of StartTask.
+type cleanupStack struct {
+	fns []func()
+}
+
+func (c *cleanupStack) add(fn func()) {
+	c.fns = append(c.fns, fn)
+}
+
+// run calls the collected functions in reverse order.
+func (c *cleanupStack) run() {
+	for i := len(c.fns) - 1; i >= 0; i-- {
+		c.fns[i]()
+	}
+	c.fns = nil
+}
+
 func (d *Driver) InspectTask(taskID string) (*drivers.TaskStatus, error) {
-	d.logger.Debug("InspectTask called")
+	d.logger.Trace("InspectTask called")
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return nil, drivers.ErrTaskNotFound
 	}
 
-	return handle.TaskStatus(), nil
+	status := handle.TaskStatus()
+	if status.State != drivers.TaskStateRunning {
+		return status, nil
+	}
+
+	// the executor only knows about systemd-nspawn, machined has the state
+	// of the container itself
+	var driverConfig MachineConfig
+	if err := handle.taskConfig.DecodeDriverConfig(&driverConfig); err != nil || !driverConfig.register() {
+		return status, nil
+	}
+	p, err := DescribeMachine(handle.machine.Name, 0)
+	if err != nil {
+		status.DriverAttributes["machine_state"] = "gone"
+		return status, nil
+	}
+	for k, v := range p.attributes() {
+		status.DriverAttributes[k] = v
+	}
+	return status, nil
 }
 
 func (d *Driver) TaskStats(ctx context.Context, taskID string, interval time.Duration) (<-chan *drivers.TaskResourceUsage, error) {
@@ -819,7 +2084,22 @@ func (d *Driver) TaskStats(ctx context.Context, taskID string, interval time.Dur
 		return nil, drivers.ErrTaskNotFound
 	}
 
-	return handle.exec.Stats(ctx, interval)
+	ch, err := handle.exec.Stats(ctx, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	// the executor only sees nspawn and its children, the cgroup of the
+	// machine has the usage of all processes of the container
+	if version, err := cgroupVersion(cgroupRoot); err != nil || version != 2 {
+		return ch, nil
+	}
+	dir, err := machineCgroup(cgroupRoot, "/proc", handle.machineProps())
+	if err != nil {
+		d.logger.Debug("failed to find cgroup of machine, using executor stats", "task_id", taskID, "error", err)
+		return ch, nil
+	}
+	return mergeCgroupStats(ctx, ch, newCgroupStats(dir), d.logger), nil
 }
 
 func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, error) {
@@ -827,7 +2107,7 @@ func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, err
 }
 
 func (d *Driver) SignalTask(taskID string, signal string) error {
-	d.logger.Debug("SignalTask called")
+	d.logger.Trace("SignalTask called")
 	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return drivers.ErrTaskNotFound
@@ -837,7 +2117,14 @@ func (d *Driver) SignalTask(taskID string, signal string) error {
 		sig = s
 	} else {
 		d.logger.Warn("unknown signal to send to task, using SIGINT instead", "signal", signal, "task_id", handle.taskConfig.ID)
+	}
 
+	var driverConfig MachineConfig
+	if err := handle.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		d.logger.Warn("SignalTask: failed to decode driver config", "error", err)
+	}
+	if driverConfig.signalsLeader(sig.(syscall.Signal)) {
+		return SignalMachineLeader(handle.machine.Name, sig.(syscall.Signal))
 	}
 	return handle.exec.Signal(sig)
 }
@@ -859,7 +2146,46 @@ func (d *Driver) ExecTaskStreamingRaw(ctx context.Context,
 		return drivers.ErrTaskNotFound
 	}
 
-	leader := handle.machine.Leader
+	if len(command) == 1 && command[0] == diagnosticsCommand {
+		out, err := d.diagnosticsJSON()
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&drivers.ExecTaskStreamingResponseMsg{
+			Stdout: &dproto.ExecTaskStreamingIOOperation{Data: out, Close: true},
+		}); err != nil {
+			return err
+		}
+		return stream.Send(&drivers.ExecTaskStreamingResponseMsg{
+			Exited: true,
+			Result: &dproto.ExitResult{},
+		})
+	}
+
+	if err := execSupported(handle); err != nil {
+		return err
+	}
+	driverConfig, err := execDriverConfig(handle)
+	if err != nil {
+		return err
+	}
+	opts, command, err := parseExecEnvelope(command, driverConfig.execOptions())
+	if err != nil {
+		return err
+	}
+
+	machine, err := handle.execMachine()
+	if err != nil {
+		return err
+	}
+
+	// booted containers run the session as a unit of their own service
+	// manager, with its environment and PAM session
+	if driverConfig.Boot {
+		cmd := execCommand(machine.Name, handle.execServiceType, opts, tty, command)
+		return handle.exec.ExecStreaming(ctx, cmd, tty, stream)
+	}
+	leader := machine.Leader
 
 	environ, err := os.Open(fmt.Sprintf("/proc/%d/environ", leader))
 	if err != nil {
@@ -873,17 +2199,25 @@ func (d *Driver) ExecTaskStreamingRaw(ctx context.Context,
 	cmd := []string{
 		"nsenter",
 		"--target", strconv.FormatInt(int64(leader), 10),
-		"--all", "/bin/env", "-i", "-",
+		"--all",
+	}
+	if opts.WorkingDirectory != "" {
+		cmd = append(cmd, "--wd="+opts.WorkingDirectory)
+	}
+	// nsenter only takes numeric IDs, which are looked up in the container
+	if opts.User != "" {
+		uid, gid, err := passwdLookup(fmt.Sprintf("/proc/%d/root/etc/passwd", leader), opts.User)
+		if err != nil {
+			return err
+		}
+		cmd = append(cmd, "--setuid="+uid, "--setgid="+gid)
 	}
+	cmd = append(cmd, "/bin/env", "-i", "-")
 
 	for name, value := range readEnviron(leader) {
 		cmd = append(cmd, name+"="+value)
 	}
 
-	if err := execSupported(handle); err != nil {
-		return err
-	}
-
 	cmd = append(cmd, command...)
 
 	return handle.exec.ExecStreaming(ctx, cmd, tty, stream)
@@ -898,13 +2232,34 @@ func (d *Driver) ExecTask(taskID string, cmd []string, timeout time.Duration) (*
 		return nil, drivers.ErrTaskNotFound
 	}
 
+	if len(cmd) == 1 && cmd[0] == diagnosticsCommand {
+		out, err := d.diagnosticsJSON()
+		if err != nil {
+			return nil, err
+		}
+		return &drivers.ExecTaskResult{
+			Stdout:     out,
+			ExitResult: &drivers.ExitResult{},
+		}, nil
+	}
+
 	if err := execSupported(handle); err != nil {
 		return nil, err
 	}
+	driverConfig, err := execDriverConfig(handle)
+	if err != nil {
+		return nil, err
+	}
+	opts, cmd, err := parseExecEnvelope(cmd, driverConfig.execOptions())
+	if err != nil {
+		return nil, err
+	}
 
-	command := []string{"systemd-run", "--wait", "--service-type=exec",
-		"--collect", "--quiet", "--machine", handle.machine.Name, "--pipe"}
-	command = append(command, cmd...)
+	machine, err := handle.execMachine()
+	if err != nil {
+		return nil, err
+	}
+	command := execCommand(machine.Name, handle.execServiceType, opts, false, cmd)
 
 	out, exitCode, err := handle.exec.Exec(time.Now().Add(timeout), command[0], command[1:])
 	if err != nil {
@@ -919,6 +2274,94 @@ func (d *Driver) ExecTask(taskID string, cmd []string, timeout time.Duration) (*
 	}, nil
 }
 
+// execCommand returns the systemd-run invocation running cmd in the machine,
+// connected to a new pseudo terminal if tty is set. Tasks without
+// exec_service_type use the exec service type.
+func execCommand(machine, serviceType string, opts execOptions, tty bool, cmd []string) []string {
+	if serviceType == "" {
+		serviceType = "exec"
+	}
+	stdio := "--pipe"
+	if tty {
+		stdio = "--pty"
+	}
+	command := []string{"systemd-run", "--wait", "--service-type=" + serviceType,
+		"--collect", "--quiet", "--machine", machine, stdio}
+	if opts.User != "" {
+		command = append(command, "--uid="+opts.User)
+	}
+	if opts.WorkingDirectory != "" {
+		command = append(command, "--working-directory="+opts.WorkingDirectory)
+	}
+	return append(command, cmd...)
+}
+
+// execEnvelopeCommand can wrap the command passed to `nomad alloc exec` to
+// pick the user and working directory of the session, e.g.
+// `nix-driver-exec --user=app --working-directory=/srv/app -- bash`.
+const execEnvelopeCommand = "nix-driver-exec"
+
+// execOptions are the user and working directory of an exec session.
+type execOptions struct {
+	User             string
+	WorkingDirectory string
+}
+
+// execDriverConfig decodes the driver config of the task an exec session is
+// started in.
+func execDriverConfig(handle *taskHandle) (*MachineConfig, error) {
+	var driverConfig MachineConfig
+	if err := handle.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		return nil, fmt.Errorf("failed to decode driver config: %v", err)
+	}
+	return &driverConfig, nil
+}
+
+// execOptions returns the exec options set by the task.
+func (c *MachineConfig) execOptions() execOptions {
+	return execOptions{User: c.ExecUser, WorkingDirectory: c.ExecWorkingDirectory}
+}
+
+// parseExecEnvelope applies the options of an exec envelope on top of opts
+// and returns the command it wraps. Other commands are returned unchanged.
+func parseExecEnvelope(cmd []string, opts execOptions) (execOptions, []string, error) {
+	if len(cmd) == 0 || cmd[0] != execEnvelopeCommand {
+		return opts, cmd, nil
+	}
+
+	for i, arg := range cmd[1:] {
+		switch {
+		case arg == "--":
+			command := cmd[i+2:]
+			if len(command) == 0 {
+				return opts, nil, fmt.Errorf("%s: missing command", execEnvelopeCommand)
+			}
+			return opts, command, nil
+		case strings.HasPrefix(arg, "--user="):
+			opts.User = strings.TrimPrefix(arg, "--user=")
+			if !validExecUser(opts.User) {
+				return opts, nil, fmt.Errorf("%s: invalid user %q", execEnvelopeCommand, opts.User)
+			}
+		case strings.HasPrefix(arg, "--working-directory="):
+			opts.WorkingDirectory = strings.TrimPrefix(arg, "--working-directory=")
+			if !filepath.IsAbs(opts.WorkingDirectory) {
+				return opts, nil, fmt.Errorf("%s: working directory must be an absolute path", execEnvelopeCommand)
+			}
+		default:
+			return opts, nil, fmt.Errorf("%s: unknown option %q", execEnvelopeCommand, arg)
+		}
+	}
+	return opts, nil, fmt.Errorf("%s: missing command", execEnvelopeCommand)
+}
+
+// validExecUser checks that user is a user name or numeric uid.
+func validExecUser(user string) bool {
+	if _, err := strconv.ParseUint(user, 10, 32); err == nil {
+		return true
+	}
+	return userNameRegexp.MatchString(user)
+}
+
 // execSupported checks if container was stared with boot parameter, otherwise
 // systemd-run does not work
 func execSupported(handle *taskHandle) error {
@@ -948,6 +2391,113 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	if !validLinkJournal(config.DefaultLinkJournal) {
+		return fmt.Errorf("invalid parameter for default_link_journal")
+	}
+
+	for name, preset := range config.CapabilityPresets {
+		if len(preset) == 0 {
+			return fmt.Errorf("capability_presets: preset %q is empty", name)
+		}
+		for _, c := range preset {
+			if !validCapability(c) {
+				return fmt.Errorf("capability_presets: preset %q contains invalid capability %q", name, c)
+			}
+		}
+	}
+
+	if config.MachineStartTimeout == "" {
+		config.MachineStartTimeout = defaultMachineStartTimeout.String()
+	}
+	timeout, err := time.ParseDuration(config.MachineStartTimeout)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("invalid parameter for machine_start_timeout: %q", config.MachineStartTimeout)
+	}
+	config.machineStartTimeout = timeout
+
+	if config.NixBuildCacheTTL == "" {
+		config.NixBuildCacheTTL = defaultNixBuildCacheTTL.String()
+	}
+	ttl, err := time.ParseDuration(config.NixBuildCacheTTL)
+	if err != nil || ttl < 0 {
+		return fmt.Errorf("invalid parameter for nix_build_cache_ttl: %q", config.NixBuildCacheTTL)
+	}
+	config.nixBuildCacheTTL = ttl
+
+	if config.NixBuildErrorLines == 0 {
+		config.NixBuildErrorLines = defaultNixBuildErrorLines
+	}
+	if config.NixBuildErrorLines < 0 {
+		return fmt.Errorf("invalid parameter for nix_build_error_lines")
+	}
+
+	for _, prefix := range config.EnvDeny {
+		if prefix == "" {
+			return fmt.Errorf("env_deny may not contain empty prefixes")
+		}
+	}
+
+	for _, prefix := range config.AllowedImageRegistries {
+		if u, err := url.Parse(prefix); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("allowed_image_registries: %q is not an absolute URL", prefix)
+		}
+	}
+
+	if config.NixSSLCertFile != "" {
+		if !filepath.IsAbs(config.NixSSLCertFile) {
+			return fmt.Errorf("nix_ssl_cert_file must be an absolute path")
+		}
+		if err := regularFile(config.NixSSLCertFile); err != nil {
+			return fmt.Errorf("invalid parameter for nix_ssl_cert_file: %v", err)
+		}
+	}
+	for name, proxy := range map[string]string{
+		"nix_http_proxy":  config.NixHTTPProxy,
+		"nix_https_proxy": config.NixHTTPSProxy,
+	} {
+		if proxy != "" && !validProxyURL(proxy) {
+			return fmt.Errorf("invalid parameter for %s", name)
+		}
+	}
+
+	for _, substituter := range config.NixSubstituters {
+		if u, err := url.Parse(substituter); err != nil || u.Scheme == "" {
+			return fmt.Errorf("nix_substituters: %q is not a URL", substituter)
+		}
+	}
+	for _, key := range config.NixTrustedPublicKeys {
+		if !nixPublicKeyRegexp.MatchString(key) {
+			return fmt.Errorf("nix_trusted_public_keys: %q is not a NAME:KEY public key", key)
+		}
+	}
+
+	if config.StateDir == "" {
+		config.StateDir = DefaultStateDir
+	}
+	if !filepath.IsAbs(config.StateDir) {
+		return fmt.Errorf("state_dir must be an absolute path")
+	}
+
+	if config.NixpkgsFlake == "" {
+		config.NixpkgsFlake = DefaultNixpkgsFlake
+	}
+	if strings.ContainsAny(config.NixpkgsFlake, " \t\n") {
+		return fmt.Errorf("invalid parameter for nixpkgs_flake: %q", config.NixpkgsFlake)
+	}
+
+	if config.LogLevel != "" {
+		level := hclog.LevelFromString(config.LogLevel)
+		if level == hclog.NoLevel {
+			return fmt.Errorf("invalid parameter for log_level: %q", config.LogLevel)
+		}
+		d.logger.SetLevel(level)
+	}
+
+	d.setDraining(config.Drain)
+	d.images = newImageIndex(config.StateDir)
+	d.buildCache = newNixBuildCache(config.StateDir, config.nixBuildCacheTTL)
+	d.restarted = newRestartedTasks(config.StateDir)
+
 	d.config = &config
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
@@ -956,6 +2506,15 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 	return nil
 }
 
+// executorLogLevel returns the log level of task executors, which follow the
+// log_level of the driver and log at debug level otherwise.
+func executorLogLevel(level string) string {
+	if level == "" {
+		return "debug"
+	}
+	return strings.ToLower(level)
+}
+
 func (d *Driver) Shutdown(ctx context.Context) error {
 	d.signalShutdown()
 	return nil
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
@@ -15,6 +16,7 @@ import (
 	"github.com/hashicorp/nomad/helper/testlog"
 	"github.com/hashicorp/nomad/helper/uuid"
 	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	dtestutil "github.com/hashicorp/nomad/plugins/drivers/testutils"
 	"github.com/hashicorp/nomad/testutil"
@@ -92,6 +94,444 @@ func TestNspawnDriver_Fingerprint(t *testing.T) {
 	}
 }
 
+// setConfig passes the plugin configuration to the driver the way Nomad does.
+func setConfig(d *Driver, config *Config) error {
+	var data []byte
+	if err := base.MsgPackEncode(&data, config); err != nil {
+		return err
+	}
+	return d.SetConfig(&base.Config{PluginConfig: data})
+}
+
+func TestNspawnDriver_SetConfig_CapabilityPresets(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	require.NoError(setConfig(d, &Config{
+		CapabilityPresets: map[string][]string{
+			"network": {"CAP_NET_ADMIN", "CAP_NET_RAW"},
+		},
+	}))
+	require.Equal([]string{"CAP_NET_ADMIN", "CAP_NET_RAW"}, d.config.CapabilityPresets["network"])
+
+	err := setConfig(d, &Config{
+		CapabilityPresets: map[string][]string{
+			"network": {"NET_ADMIN"},
+		},
+	})
+	require.Error(err)
+	require.Contains(err.Error(), "invalid capability")
+
+	err = setConfig(d, &Config{
+		CapabilityPresets: map[string][]string{
+			"empty": {},
+		},
+	})
+	require.Error(err)
+	require.Contains(err.Error(), "is empty")
+}
+
+func TestNspawnDriver_SetConfig_DefaultLinkJournal(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	err := setConfig(d, &Config{DefaultLinkJournal: "sometimes"})
+	require.Error(err)
+	require.Contains(err.Error(), "default_link_journal")
+
+	require.NoError(setConfig(d, &Config{DefaultLinkJournal: "try-guest"}))
+
+	// the default applies to tasks that don't set link_journal
+	c := &MachineConfig{}
+	require.NoError(d.applyPluginConfig(c))
+	require.Equal("try-guest", c.LinkJournal)
+
+	// and doesn't override the task's own choice
+	c = &MachineConfig{LinkJournal: "no"}
+	require.NoError(d.applyPluginConfig(c))
+	require.Equal("no", c.LinkJournal)
+}
+
+func TestNspawnDriver_SetConfig_AllowedImageRegistries(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	require.NoError(setConfig(d, &Config{
+		AllowedImageRegistries: []string{"https://images.example.com/nomad"},
+	}))
+	require.Equal([]string{"https://images.example.com/nomad"}, d.config.AllowedImageRegistries)
+
+	err := setConfig(d, &Config{
+		AllowedImageRegistries: []string{"images.example.com"},
+	})
+	require.Error(err)
+	require.Contains(err.Error(), "not an absolute URL")
+}
+
+func TestNspawnDriver_SetConfig_EnvDeny(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	require.NoError(setConfig(d, &Config{EnvDeny: []string{"VAULT_"}}))
+	require.Equal([]string{"VAULT_"}, d.config.EnvDeny)
+
+	err := setConfig(d, &Config{EnvDeny: []string{"VAULT_", ""}})
+	require.Error(err)
+	require.Contains(err.Error(), "env_deny")
+}
+
+func TestNspawnDriver_SetConfig_LogLevel(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	require.NoError(setConfig(d, &Config{LogLevel: "WARN"}))
+	require.False(d.logger.IsInfo())
+	require.True(d.logger.IsWarn())
+	require.Equal("warn", executorLogLevel(d.config.LogLevel))
+
+	err := setConfig(d, &Config{LogLevel: "loud"})
+	require.Error(err)
+	require.Contains(err.Error(), "log_level")
+
+	require.Equal("debug", executorLogLevel(""))
+}
+
+func TestNspawnDriver_SetConfig_Drain(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	require.NoError(setConfig(d, &Config{Drain: true}))
+	require.True(d.isDraining())
+
+	_, _, err := d.StartTask(&drivers.TaskConfig{ID: uuid.Generate(), Name: "test"})
+	require.Error(err)
+	require.Contains(err.Error(), "draining")
+
+	d.setDraining(false)
+	require.False(d.isDraining())
+}
+
+func TestNspawnDriver_SetConfig_NixTLSAndProxy(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	cert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(ioutil.WriteFile(cert, []byte("ca"), 0644))
+	require.NoError(setConfig(d, &Config{
+		NixSSLCertFile: cert,
+		NixHTTPProxy:   "http://proxy.example.com:3128",
+		NixHTTPSProxy:  "http://proxy.example.com:3128",
+	}))
+
+	// tasks inherit the settings unless they set their own
+	c := &MachineConfig{NixHTTPSProxy: "http://other.example.com:8080"}
+	require.NoError(d.applyPluginConfig(c))
+	require.Equal(cert, c.hostSSLCertFile)
+	require.Equal("http://proxy.example.com:3128", c.NixHTTPProxy)
+	require.Equal("http://other.example.com:8080", c.NixHTTPSProxy)
+
+	err := setConfig(d, &Config{NixSSLCertFile: cert + ".missing"})
+	require.Error(err)
+	require.Contains(err.Error(), "nix_ssl_cert_file")
+
+	err = setConfig(d, &Config{NixHTTPProxy: "proxy:3128"})
+	require.Error(err)
+	require.Contains(err.Error(), "nix_http_proxy")
+}
+
+func TestNspawnDriver_SetConfig_NixpkgsFlake(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	require.NoError(setConfig(d, &Config{}))
+	require.Equal(DefaultNixpkgsFlake, d.config.NixpkgsFlake)
+
+	require.NoError(setConfig(d, &Config{NixpkgsFlake: "github:nixos/nixpkgs/nixos-22.11"}))
+	c := &MachineConfig{}
+	require.NoError(d.applyPluginConfig(c))
+	opts, err := c.nixOptions(t.TempDir())
+	require.NoError(err)
+	require.Equal("github:nixos/nixpkgs/nixos-22.11", opts.NixpkgsFlake)
+
+	err = setConfig(d, &Config{NixpkgsFlake: "github:nixos/nixpkgs nixos-22.11"})
+	require.Error(err)
+	require.Contains(err.Error(), "nixpkgs_flake")
+}
+
+func TestNspawnDriver_SetConfig_NixSubstituters(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+
+	require.NoError(setConfig(d, &Config{
+		NixSubstituters:      []string{"https://hydra.example.com", "file:///srv/nix-cache"},
+		NixTrustedPublicKeys: []string{"hydra.example.com-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="},
+	}))
+
+	c := &MachineConfig{}
+	require.NoError(d.applyPluginConfig(c))
+	opts, err := c.nixOptions(t.TempDir())
+	require.NoError(err)
+	require.Equal("https://hydra.example.com file:///srv/nix-cache", opts.Settings["substituters"])
+	require.Equal("hydra.example.com-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=", opts.Settings["trusted-public-keys"])
+
+	err = setConfig(d, &Config{NixSubstituters: []string{"hydra.example.com"}})
+	require.Error(err)
+	require.Contains(err.Error(), "nix_substituters")
+
+	err = setConfig(d, &Config{NixTrustedPublicKeys: []string{"6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="}})
+	require.Error(err)
+	require.Contains(err.Error(), "nix_trusted_public_keys")
+}
+
+func TestNspawnDriver_ApplyCapabilityPreset(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+	require.NoError(setConfig(d, &Config{
+		CapabilityPresets: map[string][]string{
+			"network": {"CAP_NET_ADMIN", "CAP_NET_RAW"},
+		},
+	}))
+
+	c := &MachineConfig{
+		Capability:       []string{"CAP_NET_RAW", "CAP_SYS_PTRACE"},
+		CapabilityPreset: "network",
+	}
+	require.NoError(d.applyPluginConfig(c))
+	require.Equal([]string{"CAP_NET_RAW", "CAP_SYS_PTRACE", "CAP_NET_ADMIN"}, c.Capability)
+
+	err := d.applyPluginConfig(&MachineConfig{CapabilityPreset: "missing"})
+	require.Error(err)
+	require.Contains(err.Error(), "not defined")
+}
+
+func TestNspawnDriver_ApplyNested(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+	require.NoError(setConfig(d, &Config{}))
+
+	err := d.applyPluginConfig(&MachineConfig{Nested: true})
+	require.Error(err)
+	require.Contains(err.Error(), "allow_nested")
+
+	require.NoError(setConfig(d, &Config{AllowNested: true}))
+	c := &MachineConfig{Nested: true, Capability: []string{"CAP_SYS_PTRACE"}}
+	require.NoError(d.applyPluginConfig(c))
+	require.Equal([]string{"CAP_SYS_PTRACE", "CAP_NET_ADMIN"}, c.Capability)
+	require.True(c.delegateCgroup())
+}
+
+func TestNspawnDriver_SetupPorts(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+	task := &drivers.TaskConfig{
+		Name: "test",
+		Resources: &drivers.Resources{
+			NomadResources: testResources.NomadResources,
+			Ports: &structs.AllocatedPorts{
+				{Label: "http", Value: 8080, To: 80},
+			},
+		},
+	}
+
+	// host networking maps the ports with nspawn
+	c := &MachineConfig{Ports: []string{"http"}, Port: map[string]string{}}
+	require.NoError(d.setupPorts(task, c))
+	require.Equal(hclutils.MapStrStr{"http": "8080:80"}, c.Port)
+	require.NotNil(taskNetwork(task, c, "10.0.0.2", nil))
+
+	// in bridge mode Nomad maps the ports into the group network namespace
+	task.NetworkIsolation = &drivers.NetworkIsolationSpec{
+		Mode: drivers.NetIsolationModeGroup,
+		Path: "/var/run/netns/test",
+	}
+	c = &MachineConfig{Ports: []string{"http"}, Port: map[string]string{}}
+	require.NoError(d.setupPorts(task, c))
+	require.Empty(c.Port)
+	require.Nil(taskNetwork(task, c, "10.0.0.2", nil))
+
+	args, err := c.ConfigArray()
+	require.NoError(err)
+	require.NotContains(args, "-p")
+}
+
+func TestStoreFreeMB(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	free, err := storeFreeMB(t.TempDir())
+	require.NoError(err)
+	require.True(free >= 0)
+
+	_, err = storeFreeMB(filepath.Join(t.TempDir(), "missing"))
+	require.Error(err)
+}
+
+func TestExecCommand(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	require.Equal([]string{"systemd-run", "--wait", "--service-type=exec", "--collect", "--quiet",
+		"--machine", "test", "--pipe", "/bin/true"}, execCommand("test", "", execOptions{}, false, []string{"/bin/true"}))
+	require.Contains(execCommand("test", "forking", execOptions{}, false, []string{"/usr/bin/daemon"}), "--service-type=forking")
+
+	command := execCommand("test", "", execOptions{User: "app", WorkingDirectory: "/srv/app"}, true, []string{"/bin/sh"})
+	require.Equal([]string{"--pty", "--uid=app", "--working-directory=/srv/app", "/bin/sh"}, command[len(command)-4:])
+}
+
+func TestParseExecEnvelope(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	defaults := execOptions{User: "app", WorkingDirectory: "/srv/app"}
+	opts, cmd, err := parseExecEnvelope([]string{"/bin/sh"}, defaults)
+	require.NoError(err)
+	require.Equal(defaults, opts)
+	require.Equal([]string{"/bin/sh"}, cmd)
+
+	opts, cmd, err = parseExecEnvelope([]string{execEnvelopeCommand, "--user=root", "--", "/bin/sh", "-c", "id"}, defaults)
+	require.NoError(err)
+	require.Equal(execOptions{User: "root", WorkingDirectory: "/srv/app"}, opts)
+	require.Equal([]string{"/bin/sh", "-c", "id"}, cmd)
+
+	for msg, args := range map[string][]string{
+		"missing command":          {execEnvelopeCommand, "--user=root", "--"},
+		"unknown option":           {execEnvelopeCommand, "--group=wheel", "--", "/bin/sh"},
+		"invalid user":             {execEnvelopeCommand, "--user=-x", "--", "/bin/sh"},
+		"must be an absolute path": {execEnvelopeCommand, "--working-directory=srv", "--", "/bin/sh"},
+	} {
+		_, _, err := parseExecEnvelope(args, defaults)
+		require.Error(err)
+		require.Contains(err.Error(), msg)
+	}
+}
+
+func TestCleanupStack(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	var order []int
+	var c cleanupStack
+	for i := 0; i < 3; i++ {
+		i := i
+		c.add(func() { order = append(order, i) })
+	}
+	c.run()
+	require.Equal([]int{2, 1, 0}, order)
+
+	// functions only run once
+	c.run()
+	require.Len(order, 3)
+}
+
+func TestNspawnDriver_ImageInUse(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil).(*Driver)
+	d.tasks.Set(uuid.Generate(), &taskHandle{imagePath: "/var/lib/machines/alpine"})
+
+	require.True(d.imageInUse("/var/lib/machines/alpine"))
+	require.False(d.imageInUse("/var/lib/machines/debian"))
+}
+
+func TestNspawnDriver_StartTask_Cleanup(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		config     *MachineConfig
+		err        string
+		registered bool
+	}{
+		{
+			name:   "plugin config",
+			config: &MachineConfig{Image: "alpine", CapabilityPreset: "missing"},
+			err:    "capability_preset",
+		},
+		{
+			name:       "validation",
+			config:     &MachineConfig{Image: "alpine", Volatile: "bogus"},
+			err:        "failed to validate task config",
+			registered: true,
+		},
+		{
+			name:       "image",
+			config:     &MachineConfig{Image: "nomad-driver-nix-missing-image"},
+			err:        "failed to gather image path",
+			registered: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			listener := &OOMListener{
+				register:   make(chan *registration, 1),
+				deregister: make(chan string, 1),
+			}
+			d := NewPlugin(testlog.HCLogger(t), listener).(*Driver)
+			harness := dtestutil.NewDriverHarness(t, d)
+			task := &drivers.TaskConfig{
+				ID:        uuid.Generate(),
+				AllocID:   uuid.Generate(),
+				Name:      "test",
+				Resources: testResources,
+			}
+			require.NoError(task.EncodeConcreteDriverConfig(tc.config))
+
+			cleanup := harness.MkAllocDir(task, false)
+			defer cleanup()
+
+			// left behind by an earlier attempt to build the task
+			closure := filepath.Join(task.TaskDir().Dir, "current-closure")
+			require.NoError(os.Symlink("/nix/store/00000000000000000000000000000000-test", closure))
+
+			_, _, err := d.StartTask(task)
+			require.Error(err)
+			require.Contains(err.Error(), tc.err)
+
+			require.Len(listener.register, len(listener.deregister))
+			if !tc.registered {
+				require.Empty(listener.register)
+				return
+			}
+
+			reg := <-listener.register
+			require.Equal(reg.id, <-listener.deregister)
+
+			_, err = os.Lstat(closure)
+			require.True(os.IsNotExist(err))
+		})
+	}
+}
+
 func TestNspawnDriver_StartWait(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -123,6 +563,40 @@ func TestNspawnDriver_StartWait(t *testing.T) {
 	require.NoError(harness.DestroyTask(task.ID, true))
 }
 
+func TestNspawnDriver_ProcessTwo(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	ctestutils.ExecCompatible(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil)
+	harness := dtestutil.NewDriverHarness(t, d)
+	task := &drivers.TaskConfig{
+		ID:        uuid.Generate(),
+		AllocID:   uuid.Generate(),
+		Name:      "test",
+		Resources: testResources,
+	}
+
+	// the command runs as PID 2 with its environment below the stub init,
+	// which reaps the orphaned sleep and passes the exit code through
+	config := alpineConfig(`test $$ -eq 2 || exit 1; test "$GREETING" = hello || exit 2; (sleep 1 &); exit 3`)
+	config.Environment = hclutils.MapStrStr{"GREETING": "hello"}
+	require.NoError(task.EncodeConcreteDriverConfig(config))
+
+	cleanup := harness.MkAllocDir(task, true)
+	defer cleanup()
+
+	handle, _, err := harness.StartTask(task)
+	require.NoError(err)
+
+	ch, err := harness.WaitTask(context.Background(), handle.Config.ID)
+	require.NoError(err)
+	result := <-ch
+	require.Equal(3, result.ExitCode)
+
+	require.NoError(harness.DestroyTask(task.ID, true))
+}
+
 func TestNspawnDriver_StartWaitStopKill(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -181,6 +655,61 @@ func TestNspawnDriver_StartWaitStopKill(t *testing.T) {
 	require.NoError(harness.DestroyTask(task.ID, true))
 }
 
+func TestNspawnDriver_StopTask_IgnoredSignal(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	ctestutils.ExecCompatible(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil)
+	harness := dtestutil.NewDriverHarness(t, d)
+	task := &drivers.TaskConfig{
+		ID:        uuid.Generate(),
+		AllocID:   uuid.Generate(),
+		Name:      "test",
+		Resources: testResources,
+	}
+
+	config := alpineConfig("trap '' TERM INT; while true; do sleep 1; done")
+	config.StopGracePeriod = "2s"
+	require.NoError(task.EncodeConcreteDriverConfig(config))
+
+	cleanup := harness.MkAllocDir(task, true)
+	defer cleanup()
+
+	handle, _, err := harness.StartTask(task)
+	require.NoError(err)
+	defer harness.DestroyTask(task.ID, true)
+
+	ch, err := harness.WaitTask(context.Background(), handle.Config.ID)
+	require.NoError(err)
+
+	require.NoError(harness.WaitUntilStarted(task.ID, 1*time.Second))
+
+	// the grace period of the task replaces the much longer timeout
+	start := time.Now()
+	go func() {
+		harness.StopTask(task.ID, time.Minute, "SIGTERM")
+	}()
+
+	select {
+	case result := <-ch:
+		require.False(result.Successful())
+		require.True(time.Since(start) < 30*time.Second)
+	case <-time.After(30 * time.Second):
+		require.Fail("timeout waiting for task to be killed")
+	}
+
+	// nothing of the container is left behind
+	testutil.WaitForResult(func() (bool, error) {
+		if _, err := DescribeMachine("test-"+task.AllocID, 0); err == nil {
+			return false, fmt.Errorf("machine is still registered")
+		}
+		return true, nil
+	}, func(err error) {
+		require.NoError(err)
+	})
+}
+
 func TestNspawnDriver_StartWaitRecover(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
@@ -332,6 +861,58 @@ func TestNspawnDriver_Start_Wait_AllocDir(t *testing.T) {
 	require.NoError(harness.DestroyTask(task.ID, true))
 }
 
+// TestNspawnDriver_PipeConsoleStdin ensures a container started with
+// console=pipe reads EOF from stdin instead of blocking, and that a stdin
+// file is passed through when configured.
+func TestNspawnDriver_PipeConsoleStdin(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	ctestutils.ExecCompatible(t)
+
+	d := NewPlugin(testlog.HCLogger(t), nil)
+	harness := dtestutil.NewDriverHarness(t, d)
+
+	for _, input := range []string{"", "hello"} {
+		task := &drivers.TaskConfig{
+			ID:        uuid.Generate(),
+			AllocID:   uuid.Generate(),
+			Name:      "stdin",
+			Resources: testResources,
+		}
+		cleanup := harness.MkAllocDir(task, true)
+		defer cleanup()
+
+		file := "stdin.txt"
+		taskCfg := alpineConfig(fmt.Sprintf(`cat > /alloc/%s`, file))
+		taskCfg.Console = "pipe"
+		if input != "" {
+			taskCfg.Stdin = "local/input"
+			require.NoError(ioutil.WriteFile(filepath.Join(task.TaskDir().LocalDir, "input"), []byte(input), 0644))
+		}
+		require.NoError(task.EncodeConcreteDriverConfig(taskCfg))
+
+		handle, _, err := harness.StartTask(task)
+		require.NoError(err)
+		require.NotNil(handle)
+
+		// cat must see EOF and exit instead of waiting for input
+		waitCh, err := harness.WaitTask(context.Background(), task.ID)
+		require.NoError(err)
+		select {
+		case res := <-waitCh:
+			require.True(res.Successful(), "task should have exited successfully: %v", res)
+		case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+			require.Fail("timeout waiting for task")
+		}
+
+		act, err := ioutil.ReadFile(filepath.Join(task.TaskDir().SharedAllocDir, file))
+		require.NoError(err)
+		require.Equal(input, string(act))
+
+		require.NoError(harness.DestroyTask(task.ID, true))
+	}
+}
+
 // TestNspawnDriver_HandlerExec ensures the exec driver's handle properly
 // executes commands inside the container.
 func TestNspawnDriver_HandlerExec(t *testing.T) {
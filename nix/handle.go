@@ -2,6 +2,7 @@ package nix
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"sync"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/nomad/drivers/shared/executor"
 	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
 )
 
 var (
@@ -21,6 +23,27 @@ type taskHandle struct {
 	machine           *MachineProps
 	logger            hclog.Logger
 	networkInterfaces []string
+	imagePath         string
+	imageType         string
+	cni               *CNIAttachment
+
+	// taskImage is the machinectl image imported or cloned for this task only
+	taskImage string
+
+	// cleanupImage is the image downloaded for this task with cleanup_image,
+	// removed in DestroyTask unless other tasks use it
+	cleanupImage string
+
+	// execServiceType is the systemd-run service type used by ExecTask
+	execServiceType string
+
+	// cmdline is the redacted systemd-nspawn command line of the task
+	cmdline string
+
+	// relaunch starts the container again after it was killed by the OOM
+	// killer, up to maxOOMRestarts times. It is nil for recovered tasks.
+	relaunch       func() (executor.Executor, *plugin.Client, *MachineProps, error)
+	maxOOMRestarts int
 
 	// stateLock syncs access to all fields below
 	stateLock sync.RWMutex
@@ -32,22 +55,51 @@ type taskHandle struct {
 	startedAt    time.Time
 	completedAt  time.Time
 	exitResult   *drivers.ExitResult
+	oomRestarts  int
 }
 
 func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
 
+	attrs := map[string]string{
+		"pid": strconv.FormatUint(uint64(h.machine.Leader), 10),
+	}
+	if h.imageType != "" {
+		attrs["image_path"] = h.imagePath
+		attrs["image_type"] = h.imageType
+	}
+	if h.cmdline != "" {
+		attrs["nspawn_cmdline"] = h.cmdline
+	}
+
 	return &drivers.TaskStatus{
-		ID:          h.taskConfig.ID,
-		Name:        h.taskConfig.Name,
-		State:       h.procState,
-		StartedAt:   h.startedAt,
-		CompletedAt: h.completedAt,
-		ExitResult:  h.exitResult,
-		DriverAttributes: map[string]string{
-			"pid": strconv.FormatUint(uint64(h.machine.Leader), 10),
-		},
+		ID:               h.taskConfig.ID,
+		Name:             h.taskConfig.Name,
+		State:            h.procState,
+		StartedAt:        h.startedAt,
+		CompletedAt:      h.completedAt,
+		ExitResult:       h.exitResult,
+		DriverAttributes: attrs,
+	}
+}
+
+// driverState returns the state RecoverTask needs to reattach to the task.
+func (h *taskHandle) driverState() *TaskState {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+
+	return &TaskState{
+		ReattachConfig: structs.ReattachConfigFromGoPlugin(h.pluginClient.ReattachConfig()),
+		MachineName:    h.machine.Name,
+		StartedAt:      h.startedAt,
+		ImagePath:      h.imagePath,
+		ImageType:      h.imageType,
+		CNI:            h.cni,
+		TaskImage:      h.taskImage,
+		CleanupImage:   h.cleanupImage,
+		ExecService:    h.execServiceType,
+		Cmdline:        h.cmdline,
 	}
 }
 
@@ -64,10 +116,16 @@ func (h *taskHandle) run() {
 	}
 	h.stateLock.Unlock()
 
-	ps, err := h.exec.Wait(context.Background())
+	exec := h.executor()
+	ps, err := exec.Wait(context.Background())
 	h.stateLock.Lock()
 	defer h.stateLock.Unlock()
 
+	// the container was restarted meanwhile
+	if exec != h.exec {
+		return
+	}
+
 	if err != nil {
 		h.exitResult.Err = err
 		h.procState = drivers.TaskStateUnknown
@@ -80,3 +138,87 @@ func (h *taskHandle) run() {
 	h.completedAt = ps.Time
 	h.logger.Debug("run() exited successful")
 }
+
+// execMachine returns the machine commands are executed in. The container of
+// an exited task is gone along with its namespaces, so there is nothing left
+// to exec into.
+func (h *taskHandle) execMachine() (*MachineProps, error) {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	if h.procState != drivers.TaskStateRunning {
+		return nil, fmt.Errorf("cannot exec into task %q: its container is no longer running", h.taskConfig.Name)
+	}
+	// the leader is only known for containers registered with machined
+	if h.machine.Leader == 0 {
+		return nil, fmt.Errorf("cannot exec into task %q: its container isn't registered with machined", h.taskConfig.Name)
+	}
+	return h.machine, nil
+}
+
+// machineProps returns the machine currently running the task.
+func (h *taskHandle) machineProps() *MachineProps {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.machine
+}
+
+// executor returns the executor running the current container of the task.
+func (h *taskHandle) executor() executor.Executor {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.exec
+}
+
+// nextOOMRestart reports whether the container run by exec may be restarted
+// after being killed by the OOM killer, and how long to wait before.
+func (h *taskHandle) nextOOMRestart(exec executor.Executor) (time.Duration, bool) {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	if h.relaunch == nil || exec != h.exec || h.oomRestarts >= h.maxOOMRestarts {
+		return 0, false
+	}
+	return oomRestartDelay(h.oomRestarts + 1), true
+}
+
+// restartAfterOOM starts the container of the task again, replacing the
+// executor that ran it. Recovering the task after an agent restart still
+// reattaches to the first executor, so a restarted task fails to recover
+// and is restarted by Nomad instead.
+func (h *taskHandle) restartAfterOOM(old executor.Executor) error {
+	exec, pluginClient, p, err := h.relaunch()
+	if err != nil {
+		return err
+	}
+
+	h.stateLock.Lock()
+	oldClient := h.pluginClient
+	h.exec = exec
+	h.pluginClient = pluginClient
+	h.machine = p
+	h.oomRestarts++
+	h.procState = drivers.TaskStateRunning
+	h.exitResult = nil
+	h.completedAt = time.Time{}
+	h.stateLock.Unlock()
+
+	if err := old.Shutdown("", 0); err != nil {
+		h.logger.Debug("failed to shut down executor of OOM killed container", "error", err)
+	}
+	oldClient.Kill()
+
+	go h.run()
+	return nil
+}
+
+// oomRestartDelay returns the backoff before the given restart after an OOM
+// kill, doubling with each attempt.
+func oomRestartDelay(attempt int) time.Duration {
+	delay := oomRestartBaseDelay
+	for i := 1; i < attempt && delay < maxOOMRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxOOMRestartDelay {
+		delay = maxOOMRestartDelay
+	}
+	return delay
+}
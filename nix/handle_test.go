@@ -0,0 +1,96 @@
+package nix
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-plugin"
+	"github.com/hashicorp/nomad/drivers/shared/executor"
+	"github.com/hashicorp/nomad/helper/uuid"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskHandle_TaskStatus(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	h := &taskHandle{
+		machine:    &MachineProps{Leader: 1234},
+		taskConfig: &drivers.TaskConfig{ID: uuid.Generate(), Name: "test"},
+		procState:  drivers.TaskStateRunning,
+	}
+
+	// tasks without an image, e.g. nix packages, report no image attributes
+	status := h.TaskStatus()
+	require.Equal(map[string]string{"pid": "1234"}, status.DriverAttributes)
+
+	h.imagePath = "/var/lib/machines/alpine"
+	h.imageType = DirectoryImage
+	status = h.TaskStatus()
+	require.Equal("1234", status.DriverAttributes["pid"])
+	require.Equal("/var/lib/machines/alpine", status.DriverAttributes["image_path"])
+	require.Equal(DirectoryImage, status.DriverAttributes["image_type"])
+
+	h.cmdline = "systemd-nspawn -E VAULT_TOKEN=<redacted> /bin/app"
+	status = h.TaskStatus()
+	require.Equal(h.cmdline, status.DriverAttributes["nspawn_cmdline"])
+}
+
+func TestTaskHandle_ExecMachine(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	h := &taskHandle{
+		machine:    &MachineProps{Name: "test-1234", Leader: 1234},
+		taskConfig: &drivers.TaskConfig{ID: uuid.Generate(), Name: "test"},
+		procState:  drivers.TaskStateRunning,
+	}
+
+	machine, err := h.execMachine()
+	require.NoError(err)
+	require.Equal("test-1234", machine.Name)
+
+	h.procState = drivers.TaskStateExited
+	_, err = h.execMachine()
+	require.Error(err)
+	require.Contains(err.Error(), "no longer running")
+}
+
+func TestTaskHandle_NextOOMRestart(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	h := &taskHandle{maxOOMRestarts: 2}
+
+	// recovered tasks can't be restarted
+	_, ok := h.nextOOMRestart(nil)
+	require.False(ok)
+
+	h.relaunch = func() (executor.Executor, *plugin.Client, *MachineProps, error) {
+		return nil, nil, nil, nil
+	}
+	delay, ok := h.nextOOMRestart(nil)
+	require.True(ok)
+	require.Equal(oomRestartBaseDelay, delay)
+
+	h.oomRestarts = 1
+	delay, ok = h.nextOOMRestart(nil)
+	require.True(ok)
+	require.Equal(2*oomRestartBaseDelay, delay)
+
+	h.oomRestarts = 2
+	_, ok = h.nextOOMRestart(nil)
+	require.False(ok)
+}
+
+func TestOOMRestartDelay(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	require.Equal(5*time.Second, oomRestartDelay(1))
+	require.Equal(10*time.Second, oomRestartDelay(2))
+	require.Equal(40*time.Second, oomRestartDelay(4))
+	require.Equal(maxOOMRestartDelay, oomRestartDelay(5))
+	require.Equal(maxOOMRestartDelay, oomRestartDelay(100))
+}
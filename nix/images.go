@@ -0,0 +1,205 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// DefaultStateDir is where the driver keeps its own state, like the index of
+// the images it downloaded.
+const DefaultStateDir = "/var/lib/nomad-driver-nix"
+
+// ImageRecord describes an image downloaded by the driver and the tasks that
+// requested it.
+type ImageRecord struct {
+	Name         string          `json:"name"`
+	URL          string          `json:"url"`
+	Checksum     string          `json:"checksum,omitempty"`
+	DownloadedAt time.Time       `json:"downloaded_at"`
+	Requests     []*ImageRequest `json:"requests"`
+}
+
+// ImageRequest is the latest request of an image by a task of a job.
+type ImageRequest struct {
+	JobID       string    `json:"job_id"`
+	TaskName    string    `json:"task_name"`
+	AllocID     string    `json:"alloc_id"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// imageIndex keeps track of the images downloaded by the driver in a JSON
+// file, so they can be told apart from images managed by operators.
+type imageIndex struct {
+	path string
+	lock sync.Mutex
+}
+
+func newImageIndex(stateDir string) *imageIndex {
+	return &imageIndex{path: filepath.Join(stateDir, "images.json")}
+}
+
+// Record notes that the task requested the image. Images that weren't
+// downloaded by the driver are only recorded if they are in the index
+// already. The checksum the download was expected to have is kept with it.
+func (i *imageIndex) Record(name, url, checksum string, downloaded bool, cfg *drivers.TaskConfig) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	records, err := i.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	record, ok := records[name]
+	if downloaded {
+		record = &ImageRecord{Name: name, URL: url, Checksum: checksum, DownloadedAt: now}
+		records[name] = record
+	} else if !ok {
+		return nil
+	}
+
+	request := &ImageRequest{
+		JobID:       cfg.JobID,
+		TaskName:    cfg.Name,
+		AllocID:     cfg.AllocID,
+		RequestedAt: now,
+	}
+	replaced := false
+	for j, r := range record.Requests {
+		if r.JobID == request.JobID && r.TaskName == request.TaskName {
+			record.Requests[j] = request
+			replaced = true
+		}
+	}
+	if !replaced {
+		record.Requests = append(record.Requests, request)
+	}
+
+	return i.save(records)
+}
+
+// Contains reports whether the image was downloaded by the driver.
+func (i *imageIndex) Contains(name string) (bool, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	records, err := i.load()
+	if err != nil {
+		return false, err
+	}
+	_, ok := records[name]
+	return ok, nil
+}
+
+// Checksum returns the checksum recorded for a downloaded image, if any.
+func (i *imageIndex) Checksum(name string) (string, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	records, err := i.load()
+	if err != nil {
+		return "", err
+	}
+	if record, ok := records[name]; ok {
+		return record.Checksum, nil
+	}
+	return "", nil
+}
+
+// Remove drops the image from the index.
+func (i *imageIndex) Remove(name string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	records, err := i.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := records[name]; !ok {
+		return nil
+	}
+	delete(records, name)
+	return i.save(records)
+}
+
+// List returns the indexed images sorted by name.
+func (i *imageIndex) List() ([]*ImageRecord, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	records, err := i.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*ImageRecord, 0, len(records))
+	for _, r := range records {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list, nil
+}
+
+func (i *imageIndex) load() (map[string]*ImageRecord, error) {
+	records := map[string]*ImageRecord{}
+	data, err := ioutil.ReadFile(i.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read image index: %v", err)
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse image index %s: %v", i.path, err)
+	}
+	return records, nil
+}
+
+// save replaces the index file atomically, so a crash doesn't leave it
+// truncated.
+func (i *imageIndex) save(records map[string]*ImageRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(i.path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	tmp := i.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write image index: %v", err)
+	}
+	return os.Rename(tmp, i.path)
+}
+
+// ListImages prints the images downloaded by the driver whose state is kept
+// in stateDir, along with the tasks that requested them.
+func ListImages(w io.Writer, stateDir string) error {
+	records, err := newImageIndex(stateDir).List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tDOWNLOADED\tJOB\tTASK\tALLOC\tREQUESTED")
+	for _, r := range records {
+		for _, req := range r.Requests {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Name, r.DownloadedAt.Format(time.RFC3339),
+				req.JobID, req.TaskName, req.AllocID, req.RequestedAt.Format(time.RFC3339))
+		}
+		if len(r.Requests) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\n", r.Name, r.DownloadedAt.Format(time.RFC3339))
+		}
+	}
+	return tw.Flush()
+}
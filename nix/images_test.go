@@ -0,0 +1,58 @@
+package nix
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageIndex(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	stateDir := t.TempDir()
+	index := newImageIndex(stateDir)
+	web := &drivers.TaskConfig{JobID: "web", Name: "server", AllocID: "6f2b4c1e"}
+	worker := &drivers.TaskConfig{JobID: "worker", Name: "main", AllocID: "2f0c4d8a"}
+
+	// images present already aren't claimed by the driver
+	require.NoError(index.Record("debian", "https://example.com/debian.tar", "", false, web))
+	managed, err := index.Contains("debian")
+	require.NoError(err)
+	require.False(managed)
+
+	require.NoError(index.Record("alpine", "https://example.com/alpine.tar", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", true, web))
+	require.NoError(index.Record("alpine", "https://example.com/alpine.tar", "", false, worker))
+	web.AllocID = "9a1e2b1b"
+	require.NoError(index.Record("alpine", "https://example.com/alpine.tar", "", false, web))
+
+	// the index is read back from disk
+	records, err := newImageIndex(stateDir).List()
+	require.NoError(err)
+	require.Len(records, 1)
+	require.Equal("alpine", records[0].Name)
+	require.Equal("https://example.com/alpine.tar", records[0].URL)
+	require.Len(records[0].Requests, 2)
+	require.Equal("9a1e2b1b", records[0].Requests[0].AllocID)
+	require.Equal("worker", records[0].Requests[1].JobID)
+
+	// the checksum of the download is kept when the image is reused
+	checksum, err := index.Checksum("alpine")
+	require.NoError(err)
+	require.Equal("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", checksum)
+	checksum, err = index.Checksum("debian")
+	require.NoError(err)
+	require.Empty(checksum)
+
+	var out bytes.Buffer
+	require.NoError(ListImages(&out, stateDir))
+	require.Contains(out.String(), "alpine")
+	require.Contains(out.String(), "9a1e2b1b")
+
+	require.NoError(index.Remove("alpine"))
+	managed, err = index.Contains("alpine")
+	require.NoError(err)
+	require.False(managed)
+}
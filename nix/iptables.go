@@ -0,0 +1,98 @@
+package nix
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// iptablesChain holds the forwarding rules of all containers. It is jumped
+// to from FORWARD, which keeps the rules of the driver apart from those of
+// the host.
+const iptablesChain = "NOMAD-NIX-FWD"
+
+// iptablesTable is the part of go-iptables used to manage the rules.
+type iptablesTable interface {
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+}
+
+// forwardRules returns the rules that let traffic of the host interfaces
+// of a container be forwarded. Every rule carries the machine name as
+// comment, so the rules of containers sharing an interface, like the
+// bridge of a zone, are told apart.
+func forwardRules(machine string, interfaces []string) [][]string {
+	comment := []string{"-m", "comment", "--comment", machine}
+
+	var rules [][]string
+	for _, i := range interfaces {
+		for _, r := range [][]string{
+			{"-o", i, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED"},
+			{"-i", i, "!", "-o", i},
+			{"-i", i, "-o", i},
+		} {
+			r = append(r, comment...)
+			rules = append(rules, append(r, "-j", "ACCEPT"))
+		}
+	}
+	return rules
+}
+
+// ConfigureIPTablesRules adds the forwarding rules of machine, or deletes
+// them, with ip6tables as well if ipv6 is set. Both can be repeated, rules
+// that already exist or are already gone are left alone.
+func ConfigureIPTablesRules(delete bool, machine string, interfaces []string, ipv6 bool) error {
+	if len(interfaces) == 0 {
+		return fmt.Errorf("no network interfaces configured")
+	}
+
+	protocols := []iptables.Protocol{iptables.ProtocolIPv4}
+	if ipv6 {
+		protocols = append(protocols, iptables.ProtocolIPv6)
+	}
+	for _, proto := range protocols {
+		table, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return err
+		}
+		if err := configureIPTablesRules(table, delete, machine, interfaces); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func configureIPTablesRules(table iptablesTable, delete bool, machine string, interfaces []string) error {
+	rules := forwardRules(machine, interfaces)
+
+	if delete {
+		for _, r := range rules {
+			if err := table.DeleteIfExists("filter", iptablesChain, r...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ok, err := table.ChainExists("filter", iptablesChain)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := table.NewChain("filter", iptablesChain); err != nil {
+			return err
+		}
+	}
+	if err := table.AppendUnique("filter", "FORWARD", "-j", iptablesChain); err != nil {
+		return err
+	}
+
+	for _, r := range rules {
+		if err := table.AppendUnique("filter", iptablesChain, r...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package nix
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTable keeps the rules of the filter table by chain.
+type fakeTable struct {
+	chains map[string][]string
+}
+
+func (t *fakeTable) ChainExists(table, chain string) (bool, error) {
+	_, ok := t.chains[chain]
+	return ok, nil
+}
+
+func (t *fakeTable) NewChain(table, chain string) error {
+	t.chains[chain] = []string{}
+	return nil
+}
+
+func (t *fakeTable) AppendUnique(table, chain string, rulespec ...string) error {
+	rule := strings.Join(rulespec, " ")
+	for _, r := range t.chains[chain] {
+		if r == rule {
+			return nil
+		}
+	}
+	t.chains[chain] = append(t.chains[chain], rule)
+	return nil
+}
+
+func (t *fakeTable) DeleteIfExists(table, chain string, rulespec ...string) error {
+	rule := strings.Join(rulespec, " ")
+	rules := t.chains[chain][:0]
+	for _, r := range t.chains[chain] {
+		if r != rule {
+			rules = append(rules, r)
+		}
+	}
+	t.chains[chain] = rules
+	return nil
+}
+
+func TestConfigureIPTablesRules(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	table := &fakeTable{chains: map[string][]string{"FORWARD": {}}}
+	require.NoError(configureIPTablesRules(table, false, "web", []string{"vz-lan"}))
+	require.NoError(configureIPTablesRules(table, false, "db", []string{"vz-lan"}))
+	require.Equal([]string{"-j " + iptablesChain}, table.chains["FORWARD"])
+	require.Len(table.chains[iptablesChain], 6)
+	require.Contains(table.chains[iptablesChain], "-i vz-lan ! -o vz-lan -m comment --comment web -j ACCEPT")
+
+	// adding the rules again changes nothing
+	require.NoError(configureIPTablesRules(table, false, "web", []string{"vz-lan"}))
+	require.Len(table.chains[iptablesChain], 6)
+
+	// deleting keeps the rules of other machines on the shared bridge
+	require.NoError(configureIPTablesRules(table, true, "web", []string{"vz-lan"}))
+	require.NoError(configureIPTablesRules(table, true, "web", []string{"vz-lan"}))
+	require.Len(table.chains[iptablesChain], 3)
+	for _, r := range table.chains[iptablesChain] {
+		require.Contains(r, "--comment db ")
+	}
+}
@@ -0,0 +1,120 @@
+package nix
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// kernelConfigOptions are the kernel options reported as fingerprint
+// attributes, so jobs can constrain placement on nodes supporting them.
+var kernelConfigOptions = []string{
+	"CONFIG_USER_NS",
+	"CONFIG_NET_NS",
+	"CONFIG_CGROUPS",
+	"CONFIG_VETH",
+	"CONFIG_MACVLAN",
+	"CONFIG_IPVLAN",
+	"CONFIG_BTRFS_FS",
+	"CONFIG_OVERLAY_FS",
+}
+
+// kernelSysctls are the sysctls reported as fingerprint attributes.
+var kernelSysctls = []string{
+	"user.max_user_namespaces",
+	"kernel.unprivileged_userns_clone",
+	"net.ipv4.ip_forward",
+}
+
+// kernelAttributes returns the fingerprint attributes describing the kernel
+// features relevant to containers. procDir and bootDir are the mount points
+// of /proc and /boot. Options and sysctls that can't be read are left out.
+func kernelAttributes(procDir, bootDir string) map[string]*structs.Attribute {
+	attrs := map[string]*structs.Attribute{}
+
+	release, err := ioutil.ReadFile(filepath.Join(procDir, "sys/kernel/osrelease"))
+	if err == nil {
+		config, err := readKernelConfig(
+			filepath.Join(procDir, "config.gz"),
+			filepath.Join(bootDir, "config-"+strings.TrimSpace(string(release))),
+		)
+		if err == nil {
+			for _, option := range kernelConfigOptions {
+				value, ok := config[option]
+				if !ok {
+					value = "n"
+				}
+				attrs["driver.nix.kernel.config."+option] = structs.NewStringAttribute(value)
+			}
+		}
+	}
+
+	for _, name := range kernelSysctls {
+		value, err := ioutil.ReadFile(filepath.Join(procDir, "sys", strings.ReplaceAll(name, ".", "/")))
+		if err != nil {
+			continue
+		}
+		v := strings.TrimSpace(string(value))
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			attrs["driver.nix.kernel.sysctl."+name] = structs.NewIntAttribute(i, "")
+		} else {
+			attrs["driver.nix.kernel.sysctl."+name] = structs.NewStringAttribute(v)
+		}
+	}
+
+	return attrs
+}
+
+// readKernelConfig parses the first readable kernel config of paths. Files
+// ending in .gz are decompressed.
+func readKernelConfig(paths ...string) (map[string]string, error) {
+	var lastErr error
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			defer gz.Close()
+			r = gz
+		}
+
+		return parseKernelConfig(r)
+	}
+	return nil, lastErr
+}
+
+// parseKernelConfig parses the KEY=value lines of a kernel config. Options
+// commented out as "is not set" are omitted.
+func parseKernelConfig(r io.Reader) (map[string]string, error) {
+	config := map[string]string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		config[line[:i]] = strings.Trim(line[i+1:], `"`)
+	}
+	return config, s.Err()
+}
@@ -0,0 +1,74 @@
+package nix
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testKernelConfig = `#
+# Automatically generated file; DO NOT EDIT.
+#
+CONFIG_CGROUPS=y
+CONFIG_USER_NS=y
+CONFIG_NET_NS=y
+CONFIG_VETH=m
+# CONFIG_IPVLAN is not set
+CONFIG_LOCALVERSION="-test"
+`
+
+func TestParseKernelConfig(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	config, err := parseKernelConfig(bytes.NewBufferString(testKernelConfig))
+	require.NoError(err)
+	require.Equal("y", config["CONFIG_USER_NS"])
+	require.Equal("m", config["CONFIG_VETH"])
+	require.Equal("-test", config["CONFIG_LOCALVERSION"])
+	require.NotContains(config, "CONFIG_IPVLAN")
+}
+
+func TestKernelAttributes(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	proc := t.TempDir()
+	boot := t.TempDir()
+	require.NoError(os.MkdirAll(filepath.Join(proc, "sys/kernel"), 0755))
+	require.NoError(os.MkdirAll(filepath.Join(proc, "sys/user"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(proc, "sys/kernel/osrelease"), []byte("5.10.0-test\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(proc, "sys/user/max_user_namespaces"), []byte("63482\n"), 0644))
+
+	// without a kernel config only the sysctls are reported
+	attrs := kernelAttributes(proc, boot)
+	require.NotContains(attrs, "driver.nix.kernel.config.CONFIG_USER_NS")
+	v, ok := attrs["driver.nix.kernel.sysctl.user.max_user_namespaces"].GetInt()
+	require.True(ok)
+	require.Equal(int64(63482), v)
+	require.NotContains(attrs, "driver.nix.kernel.sysctl.net.ipv4.ip_forward")
+
+	// /boot/config-$(uname -r) is used as fallback
+	require.NoError(ioutil.WriteFile(filepath.Join(boot, "config-5.10.0-test"), []byte(testKernelConfig), 0644))
+	attrs = kernelAttributes(proc, boot)
+	s, _ := attrs["driver.nix.kernel.config.CONFIG_USER_NS"].GetString()
+	require.Equal("y", s)
+	s, _ = attrs["driver.nix.kernel.config.CONFIG_IPVLAN"].GetString()
+	require.Equal("n", s)
+
+	// /proc/config.gz takes precedence
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte("CONFIG_USER_NS=n\n"))
+	require.NoError(err)
+	require.NoError(gz.Close())
+	require.NoError(ioutil.WriteFile(filepath.Join(proc, "config.gz"), buf.Bytes(), 0644))
+	attrs = kernelAttributes(proc, boot)
+	s, _ = attrs["driver.nix.kernel.config.CONFIG_USER_NS"].GetString()
+	require.Equal("n", s)
+}
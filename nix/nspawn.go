@@ -4,23 +4,33 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/coreos/go-iptables/iptables"
 	systemdDbus "github.com/coreos/go-systemd/dbus"
 	"github.com/coreos/go-systemd/import1"
 	"github.com/coreos/go-systemd/machine1"
+	"github.com/coreos/go-systemd/unit"
 	systemdUtil "github.com/coreos/go-systemd/util"
 	"github.com/godbus/dbus"
 	hclog "github.com/hashicorp/go-hclog"
@@ -32,14 +42,34 @@ const (
 	dbusInterface      = "org.freedesktop.machine1.Manager"
 	dbusPath           = "/org/freedesktop/machine1"
 
-	TarImage string = "tar"
-	RawImage string = "raw"
+	// btrfsSuperMagic is the f_type statfs reports for btrfs filesystems
+	btrfsSuperMagic = 0x9123683E
+
+	// cgroup2SuperMagic is the f_type statfs reports for the unified
+	// cgroup hierarchy
+	cgroup2SuperMagic = 0x63677270
+
+	// minDelegateSystemdVersion is the first systemd release supporting
+	// Delegate= for the scope units nspawn registers
+	minDelegateSystemdVersion = 236
+
+	// minOOMPolicySystemdVersion is the first systemd release supporting
+	// OOMPolicy= for scope units
+	minOOMPolicySystemdVersion = 253
+
+	TarImage       string = "tar"
+	RawImage       string = "raw"
+	DirectoryImage string = "directory"
+
+	// DefaultNixpkgsFlake is the nixpkgs closure info of packages is built
+	// with, unless the plugin config sets nixpkgs_flake
+	DefaultNixpkgsFlake = "github:nixos/nixpkgs/nixos-21.05"
 
 	closureNix = `
-{ path }:
+{ path, nixpkgsFlake, system }:
 let
-  nixpkgs = builtins.getFlake "github:nixos/nixpkgs/nixos-21.05";
-  inherit (nixpkgs.legacyPackages.x86_64-linux) buildPackages;
+  nixpkgs = builtins.getFlake nixpkgsFlake;
+  inherit (nixpkgs.legacyPackages.${system}) buildPackages;
 in buildPackages.closureInfo { rootPaths = builtins.storePath path; }
 `
 )
@@ -49,6 +79,120 @@ var (
 	mutMap      = make(map[string]*sync.Mutex)
 )
 
+// nixPublicKeyRegexp matches the NAME:BASE64 public keys of binary caches.
+var nixPublicKeyRegexp = regexp.MustCompile(`^[^\s:]+:[A-Za-z0-9+/]+={0,2}$`)
+
+// hostnameRegexp matches the hostnames nspawn accepts: dot separated labels of
+// letters, digits and hyphens.
+var hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*$`)
+
+// userNameRegexp matches the user names nspawn accepts for --bind-user.
+var userNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// sliceRegexp matches names of slice units. Dashes separate the parents of
+// the slice, so they may not lead, trail or repeat.
+var sliceRegexp = regexp.MustCompile(`^[A-Za-z0-9_:.]+(-[A-Za-z0-9_:.]+)*\.slice$`)
+
+// systemCallFilterRegexp matches an entry of system_call_filter: a system
+// call or a @group of them, denied instead of allowed with a leading ~.
+var systemCallFilterRegexp = regexp.MustCompile(`^~?(@[a-z][a-z0-9-]*|[a-z_][a-z0-9_]*)$`)
+
+// nixSystemRegexp matches Nix system doubles like aarch64-linux.
+var nixSystemRegexp = regexp.MustCompile(`^[a-z0-9_]+-[a-z]+$`)
+
+// nixSystems maps GOARCH to the Nix system of Linux on that architecture.
+var nixSystems = map[string]string{
+	"amd64":   "x86_64-linux",
+	"386":     "i686-linux",
+	"arm64":   "aarch64-linux",
+	"arm":     "armv7l-linux",
+	"riscv64": "riscv64-linux",
+	"ppc64le": "powerpc64le-linux",
+}
+
+// hostNixSystem returns the Nix system of the host, which nix builds for
+// unless a task sets nix_system.
+func hostNixSystem() string {
+	if system, ok := nixSystems[runtime.GOARCH]; ok {
+		return system
+	}
+	return runtime.GOARCH + "-linux"
+}
+
+// envNameRegexp matches valid environment variable names.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// storePathRegexp matches top-level paths in the Nix store, using Nix's base32
+// alphabet for the hash part.
+var storePathRegexp = regexp.MustCompile(`^/nix/store/[0-9a-df-np-sv-z]{32}-[^/]+$`)
+
+// flakeRefRegexp splits a flake reference into the flake and the attribute
+// path after the #.
+var flakeRefRegexp = regexp.MustCompile(`^([^#]+)(#(.*))?$`)
+
+// flakeSchemes are the URL schemes of the flake types nix knows.
+var flakeSchemes = map[string]bool{
+	"path": true, "flake": true, "github": true, "gitlab": true, "sourcehut": true,
+	"http": true, "https": true, "git": true, "git+http": true, "git+https": true,
+	"git+ssh": true, "git+file": true, "hg+http": true, "hg+https": true,
+	"hg+ssh": true, "hg+file": true, "tarball+http": true, "tarball+https": true,
+	"tarball+file": true, "file+http": true, "file+https": true, "file+file": true,
+}
+
+// indirectFlakeRegexp matches flakes looked up in the registry, like nixpkgs
+// or nixpkgs/nixos-21.05.
+var indirectFlakeRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*(/[^/?]+){0,2}(\?.*)?$`)
+
+// repoFlakeRegexp matches the OWNER/REPO[/REF] of github, gitlab and
+// sourcehut flakes.
+var repoFlakeRegexp = regexp.MustCompile(`^[^/?]+/[^/?]+(/[^?]+)?(\?.*)?$`)
+
+// validFlakeRef catches obviously malformed flake references before they're
+// passed to nix. NixOS configurations need an attribute path, as the system
+// is built from below it.
+func validFlakeRef(ref string, needsAttr bool) error {
+	if strings.ContainsAny(ref, " \t\n") {
+		return fmt.Errorf("flake references may not contain whitespace")
+	}
+	match := flakeRefRegexp.FindStringSubmatch(ref)
+	if match == nil {
+		return fmt.Errorf("missing flake before #")
+	}
+	flake, hasAttr, attr := match[1], match[2] != "", match[3]
+	if hasAttr && attr == "" {
+		return fmt.Errorf("empty attribute path after #")
+	}
+	if needsAttr && !hasAttr {
+		return fmt.Errorf("missing attribute path, e.g. #nixosConfigurations.NAME")
+	}
+
+	switch {
+	case strings.HasPrefix(flake, "/"):
+		return nil
+	case strings.HasPrefix(flake, "."):
+		return fmt.Errorf("relative paths aren't supported, as nix doesn't run in the task directory")
+	case strings.Contains(flake, ":"):
+		scheme := flake[:strings.Index(flake, ":")]
+		if !flakeSchemes[scheme] {
+			return fmt.Errorf("unknown flake type %q", scheme)
+		}
+		rest := strings.TrimPrefix(flake[len(scheme)+1:], "//")
+		if rest == "" {
+			return fmt.Errorf("missing location after %s:", scheme)
+		}
+		switch scheme {
+		case "github", "gitlab", "sourcehut":
+			if !repoFlakeRegexp.MatchString(rest) {
+				return fmt.Errorf("%s flakes need an OWNER/REPO", scheme)
+			}
+		}
+		return nil
+	case indirectFlakeRegexp.MatchString(flake):
+		return nil
+	}
+	return fmt.Errorf("not a flake URL, path or registry name")
+}
+
 var SignalLookup = map[string]os.Signal{
 	"SIGABRT":  syscall.SIGABRT,
 	"SIGALRM":  syscall.SIGALRM,
@@ -81,6 +225,30 @@ var SignalLookup = map[string]os.Signal{
 	"SIGXFSZ":  syscall.SIGXFSZ,
 }
 
+const (
+	// sigRTMin is the first realtime signal available to programs, glibc
+	// reserves the kernel's 32 and 33 for itself
+	sigRTMin = 34
+	sigRTMax = 64
+)
+
+// Add the realtime signals systemd uses, e.g. SIGRTMIN+3 to halt and
+// SIGRTMIN+4 to power off a booted container.
+func init() {
+	SignalLookup["SIGRTMIN"] = syscall.Signal(sigRTMin)
+	SignalLookup["SIGRTMAX"] = syscall.Signal(sigRTMax)
+	for n := 0; n <= 15; n++ {
+		SignalLookup[fmt.Sprintf("SIGRTMIN+%d", n)] = syscall.Signal(sigRTMin + n)
+		SignalLookup[fmt.Sprintf("SIGRTMAX-%d", n)] = syscall.Signal(sigRTMax - n)
+	}
+}
+
+// isRealtimeSignal reports whether name is one of the realtime signals, which
+// the Nomad executor doesn't know.
+func isRealtimeSignal(name string) bool {
+	return strings.HasPrefix(name, "SIGRTM")
+}
+
 type MachineProps struct {
 	Name               string
 	TimestampMonotonic uint64
@@ -106,39 +274,111 @@ type MachineConfig struct {
 	BindReadOnly     hclutils.MapStrStr `codec:"bind_read_only"`
 	Boot             bool               `codec:"boot"`
 	Capability       []string           `codec:"capability"`
+	CapabilityPreset string             `codec:"capability_preset"`
 	Command          []string           `codec:"command"`
+	Entrypoint       []string           `codec:"entrypoint"`
+	LoginShell       bool               `codec:"login_shell"`
 	Console          string             `codec:"console"`
 	Environment      hclutils.MapStrStr `codec:"environment"`
+	CleanEnvironment bool               `codec:"clean_environment"`
+	InheritEnv       []string           `codec:"inherit_env"`
+	EnvAllow         []string           `codec:"env_allow"`
+	EnvDeny          []string           `codec:"env_deny"`
 	Ephemeral        bool               `codec:"ephemeral"`
 	Image            string             `codec:"image"`
 	ImageDownload    *ImageDownloadOpts `codec:"image_download,omitempty"`
 	Machine          string             `codec:"machine"`
 	NetworkNamespace string             `codec:"network_namespace"`
 	NetworkVeth      bool               `codec:"network_veth"`
+	NetworkVethExtra []string           `codec:"network_veth_extra"`
 	NetworkZone      string             `codec:"network_zone"`
 	PivotRoot        string             `codec:"pivot_root"`
 	Port             hclutils.MapStrStr `codec:"port"`
 	Ports            []string           `codec:"ports"` // :-(
 	// Deprecated: Nomad dropped support for task network resources in 0.12
-	PortMap          hclutils.MapStrInt `codec:"port_map"`
-	ProcessTwo       bool               `codec:"process_two"`
-	Properties       hclutils.MapStrStr `codec:"properties"`
-	ReadOnly         bool               `codec:"read_only"`
-	ResolvConf       string             `codec:"resolv_conf"`
-	User             string             `codec:"user"`
-	UserNamespacing  bool               `codec:"user_namespacing"`
-	Volatile         string             `codec:"volatile"`
-	WorkingDirectory string             `codec:"working_directory"`
-	imagePath        string             `codec:"-"`
-	Directory        string             `codec:"directory"`
-	LinkJournal      string             `codec:"link_journal"`
-	NixOS            string             `codec:"nixos"`
-	NixPackages      []string           `codec:"packages"`
-	SanitizeNames    *bool              `codec:"sanitize_names"`
-}
-
-func (c *MachineConfig) isNixOS() bool       { return c.NixOS != "" }
+	PortMap               hclutils.MapStrInt  `codec:"port_map"`
+	ProcessTwo            bool                `codec:"process_two"`
+	Properties            hclutils.MapStrStr  `codec:"properties"`
+	ReadOnly              bool                `codec:"read_only"`
+	WritablePaths         []string            `codec:"writable_paths"`
+	DelegateCgroup        *bool               `codec:"delegate_cgroup"`
+	ResolvConf            string              `codec:"resolv_conf"`
+	User                  string              `codec:"user"`
+	UserID                int                 `codec:"user_id"`
+	UserNamespacing       bool                `codec:"user_namespacing"`
+	PrivateUsers          string              `codec:"private_users"`
+	Volatile              string              `codec:"volatile"`
+	WorkingDirectory      string              `codec:"working_directory"`
+	imagePath             string              `codec:"-"`
+	imageType             string              `codec:"-"`
+	nspawnEnv             map[string]string   `codec:"-"`
+	machineID             string              `codec:"-"`
+	hostSSLCertFile       string              `codec:"-"`
+	nixpkgsFlake          string              `codec:"-"`
+	substituters          []string            `codec:"-"`
+	trustedKeys           []string            `codec:"-"`
+	Directory             string              `codec:"directory"`
+	DiskQuota             int                 `codec:"disk_quota"` // MiB
+	MemoryMin             int64               `codec:"memory_min"` // MiB
+	MemoryLow             int64               `codec:"memory_low"` // MiB
+	ExtraStorePaths       []string            `codec:"extra_store_paths"`
+	CNINetwork            string              `codec:"cni_network"`
+	LinkJournal           string              `codec:"link_journal"`
+	NixOS                 string              `codec:"nixos"`
+	NixOSToplevel         string              `codec:"nixos_toplevel"`
+	NixPackages           []string            `codec:"packages"`
+	NixSSHKey             string              `codec:"nix_ssh_key"`
+	NixNetrc              string              `codec:"nix_netrc"`
+	SanitizeNames         *bool               `codec:"sanitize_names"`
+	Stdin                 string              `codec:"stdin"`
+	ExecServiceType       string              `codec:"exec_service_type"`
+	StopSignal            string              `codec:"stop_signal"`
+	StopGracePeriod       string              `codec:"stop_grace_period"`
+	ReadyUnit             string              `codec:"ready_unit"`
+	ReadyTimeout          string              `codec:"ready_timeout"`
+	RestartOnOOM          int                 `codec:"restart_on_oom"`
+	HostMachineID         bool                `codec:"host_machine_id"`
+	NixBuildLog           string              `codec:"nix_build_log"`
+	NixSSLCertFile        string              `codec:"nix_ssl_cert_file"`
+	NixHTTPProxy          string              `codec:"nix_http_proxy"`
+	NixHTTPSProxy         string              `codec:"nix_https_proxy"`
+	NixNoProxy            string              `codec:"nix_no_proxy"`
+	PrivateUsersOwnership string              `codec:"private_users_ownership"`
+	OOMPolicy             string              `codec:"oom_policy"`
+	DNSOverTLS            []string            `codec:"dns_over_tls"`
+	NixSystem             string              `codec:"nix_system"`
+	Nested                bool                `codec:"nested"`
+	NUMANode              *int                `codec:"numa_node"`
+	LogRateLimitInterval  string              `codec:"log_rate_limit_interval"`
+	LogRateLimitBurst     *int                `codec:"log_rate_limit_burst"`
+	Overlay               []map[string]string `codec:"overlay"`
+	OverlayReadOnly       []map[string]string `codec:"overlay_read_only"`
+	TaskDirMountOptions   []string            `codec:"task_dir_mount_options"`
+	Tmpfs                 []string            `codec:"tmpfs"`
+	KillSignal            string              `codec:"kill_signal"`
+	Hostname              string              `codec:"hostname"`
+	DropCapability        []string            `codec:"drop_capability"`
+	BindUser              []string            `codec:"bind_user"`
+	LoadCredential        []map[string]string `codec:"load_credential"`
+	SetCredential         []map[string]string `codec:"set_credential"`
+	Register              *bool               `codec:"register"`
+	KeepUnit              bool                `codec:"keep_unit"`
+	Slice                 string              `codec:"slice"`
+	NetworkMacvlan        []string            `codec:"network_macvlan"`
+	NetworkIpvlan         []string            `codec:"network_ipvlan"`
+	NetworkBridge         string              `codec:"network_bridge"`
+	CleanupImage          bool                `codec:"cleanup_image"`
+	ExecUser              string              `codec:"exec_user"`
+	ExecWorkingDirectory  string              `codec:"exec_working_directory"`
+	Timezone              string              `codec:"timezone"`
+	SuppressSync          bool                `codec:"suppress_sync"`
+	NoNewPrivileges       bool                `codec:"no_new_privileges"`
+	SystemCallFilter      []string            `codec:"system_call_filter"`
+}
+
+func (c *MachineConfig) isNixOS() bool       { return c.NixOS != "" || c.NixOSToplevel != "" }
 func (c *MachineConfig) isNixPackages() bool { return len(c.NixPackages) > 0 }
+func (c *MachineConfig) register() bool      { return c.Register == nil || *c.Register }
 
 type ImageType string
 
@@ -156,23 +396,81 @@ type ImageProps struct {
 }
 
 type ImageDownloadOpts struct {
-	URL    string `codec:"url"`
-	Type   string `codec:"type"`
-	Force  bool   `codec:"force"`
-	Verify string `codec:"verify"`
+	URL     string `codec:"url"`
+	Type    string `codec:"type"`
+	Force   bool   `codec:"force"`
+	Verify  string `codec:"verify"`
+	Timeout string `codec:"timeout"`
+	// Checksums and Signature are a SHA256SUMS file and its detached
+	// signature in the task directory, for mirrors serving them separately
+	Checksums string `codec:"checksums"`
+	Signature string `codec:"signature"`
+	// Mirrors are tried in order if the download from URL fails
+	Mirrors []string `codec:"mirrors"`
+	// Checksum is the SHA256 the downloaded image is checked against, an
+	// image present already is only reused if it was downloaded with it
+	Checksum string `codec:"checksum"`
+}
+
+// imageChecksumRegexp matches a hex encoded SHA256.
+var imageChecksumRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// urls returns the URLs the image is downloaded from, in the order they are
+// tried.
+func (o *ImageDownloadOpts) urls() []string {
+	return append([]string{o.URL}, o.Mirrors...)
+}
+
+// validateChecksums checks the combination of checksums, signature and
+// verify. The files themselves are checked once the task directory exists.
+func (o *ImageDownloadOpts) validateChecksums() error {
+	if o.Signature != "" && o.Checksums == "" {
+		return fmt.Errorf("image_download.signature requires image_download.checksums")
+	}
+	if o.Checksums == "" {
+		return nil
+	}
+	if !isTaskDirPath(o.Checksums) {
+		return fmt.Errorf("image_download.checksums must be a path inside the task directory")
+	}
+	if o.Signature != "" && !isTaskDirPath(o.Signature) {
+		return fmt.Errorf("image_download.signature must be a path inside the task directory")
+	}
+	switch o.Verify {
+	case "no":
+		return fmt.Errorf("image_download.checksums requires verify = \"checksum\" or \"signature\"")
+	case "signature":
+		if o.Signature == "" {
+			return fmt.Errorf("verify = \"signature\" with image_download.checksums requires image_download.signature")
+		}
+	}
+	return nil
+}
+
+// timeout returns how long the download may take. Validate ensures Timeout
+// parses.
+func (o *ImageDownloadOpts) timeout() time.Duration {
+	if o.Timeout == "" {
+		return imageTransferTimeout
+	}
+	d, _ := time.ParseDuration(o.Timeout)
+	return d
 }
 
 func (c *MachineConfig) ConfigArray() ([]string, error) {
 	args := []string{}
 
 	if c.Image != "" {
-		// check if image exists
-		imageStat, err := os.Stat(c.imagePath)
-		if err != nil {
-			return nil, err
+		// check if image exists, unless the caller already did
+		kind := c.imageType
+		if kind == "" {
+			var err error
+			if kind, err = c.imageKind(); err != nil {
+				return nil, err
+			}
 		}
 		imageType := "-i"
-		if imageStat.IsDir() {
+		if kind == DirectoryImage {
 			imageType = "-D"
 		}
 		args = append(args, imageType, c.imagePath)
@@ -181,6 +479,9 @@ func (c *MachineConfig) ConfigArray() ([]string, error) {
 	if c.LinkJournal != "" {
 		args = append(args, "--link-journal", c.LinkJournal)
 	}
+	if c.machineID != "" {
+		args = append(args, "--uuid", c.machineID)
+	}
 	if c.Directory != "" {
 		args = append(args, "--directory", c.Directory)
 	}
@@ -193,30 +494,85 @@ func (c *MachineConfig) ConfigArray() ([]string, error) {
 	if c.NetworkVeth {
 		args = append(args, "--network-veth")
 	}
+	for _, veth := range c.NetworkVethExtra {
+		args = append(args, "--network-veth-extra="+veth)
+	}
+	for _, iface := range c.NetworkMacvlan {
+		args = append(args, "--network-macvlan="+iface)
+	}
+	for _, iface := range c.NetworkIpvlan {
+		args = append(args, "--network-ipvlan="+iface)
+	}
+	if c.NetworkBridge != "" {
+		args = append(args, "--network-bridge="+c.NetworkBridge)
+	}
 	if c.NetworkNamespace != "" {
 		args = append(args, "--network-namespace-path", c.NetworkNamespace)
 	}
 	if c.ProcessTwo {
+		// nspawn runs a stub init as PID 1, which reaps zombies and exits
+		// with the status of the command. The environment is passed to the
+		// command as usual.
 		args = append(args, "--as-pid2")
 	}
+	// the signal nspawn sends to PID 1 when it's told to stop. nspawn
+	// defaults to SIGRTMIN+3 for booted containers and kills the processes
+	// of others with SIGKILL.
+	if c.KillSignal != "" {
+		args = append(args, "--kill-signal="+c.KillSignal)
+	}
 	if c.ReadOnly {
 		args = append(args, "--read-only")
 	}
-	if c.UserNamespacing {
+	if c.PrivateUsers != "" {
+		args = append(args, "--private-users="+c.PrivateUsers)
+	} else if c.UserNamespacing {
 		args = append(args, "-U")
 	}
+	// nspawn maps each user into the container along with its home
+	for _, user := range c.BindUser {
+		args = append(args, "--bind-user="+user)
+	}
+	if c.PrivateUsersOwnership != "" {
+		args = append(args, "--private-users-ownership="+c.PrivateUsersOwnership)
+	}
 	if c.Console != "" {
 		args = append(args, fmt.Sprintf("--console=%s", c.Console))
 	}
 	if c.Machine != "" {
 		args = append(args, "--machine", c.Machine)
 	}
+	// nspawn uses the machine name as hostname unless told otherwise
+	if c.Hostname != "" {
+		args = append(args, "--hostname="+c.Hostname)
+	}
+	if !c.register() {
+		args = append(args, "--register=no")
+	}
+	if c.KeepUnit {
+		args = append(args, "--keep-unit")
+	}
+	if c.Slice != "" {
+		args = append(args, "--slice="+c.Slice)
+	}
 	if c.PivotRoot != "" {
 		args = append(args, "--pivot-root", c.PivotRoot)
 	}
 	if c.ResolvConf != "" {
 		args = append(args, "--resolv-conf", c.ResolvConf)
 	}
+	if c.Timezone != "" {
+		args = append(args, "--timezone="+c.Timezone)
+	}
+	if c.SuppressSync {
+		args = append(args, "--suppress-sync=yes")
+	}
+	if c.NoNewPrivileges {
+		args = append(args, "--no-new-privileges=yes")
+	}
+	for _, filter := range c.SystemCallFilter {
+		args = append(args, "--system-call-filter="+filter)
+	}
 	if c.User != "" {
 		args = append(args, "--user", c.User)
 	}
@@ -232,6 +588,15 @@ func (c *MachineConfig) ConfigArray() ([]string, error) {
 	for k, v := range c.BindReadOnly {
 		args = append(args, "--bind-ro", k+":"+v)
 	}
+	for _, o := range c.Overlay {
+		args = append(args, "--overlay", overlayArg(o, false))
+	}
+	for _, o := range c.OverlayReadOnly {
+		args = append(args, "--overlay-ro", overlayArg(o, true))
+	}
+	for _, t := range c.Tmpfs {
+		args = append(args, "--tmpfs", t)
+	}
 	for k, v := range c.Environment {
 		args = append(args, "-E", strings.ReplaceAll(k, "-", "_")+"="+v)
 	}
@@ -244,284 +609,2485 @@ func (c *MachineConfig) ConfigArray() ([]string, error) {
 	if len(c.Capability) > 0 {
 		args = append(args, "--capability", strings.Join(c.Capability, ","))
 	}
+	if len(c.DropCapability) > 0 {
+		args = append(args, "--drop-capability="+strings.Join(c.DropCapability, ","))
+	}
 	if len(c.NetworkZone) > 0 {
 		args = append(args, fmt.Sprintf("--network-zone=%s", c.NetworkZone))
 	}
-	if len(c.Command) > 0 {
-		args = append(args, c.Command...)
+	for _, cred := range c.LoadCredential {
+		args = append(args, "--load-credential="+cred["id"]+":"+cred["path"])
+	}
+	for _, cred := range c.SetCredential {
+		args = append(args, "--set-credential="+cred["id"]+":"+cred["value"])
 	}
+	args = append(args, c.commandLine()...)
 	return args, nil
 }
 
-func (c *MachineConfig) Validate() error {
-	switch c.LinkJournal {
-	case "", "no", "host", "try-host", "guest", "try-guest", "auto":
-	default:
-		return fmt.Errorf("invalid parameter for link_journal")
-	}
+// secretNameRegexp matches names of variables and credentials that likely
+// hold secrets.
+var secretNameRegexp = regexp.MustCompile(`(?i)(token|secret|passw(or)?d|key|credential|auth)`)
+
+// redactArgs returns a copy of nspawn arguments with the values of
+// secret-looking environment variables and all credentials replaced.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+
+	for i := 0; i < len(redacted); i++ {
+		arg := redacted[i]
+		flag, value, inline := arg, "", false
+		if j := strings.Index(arg, "="); strings.HasPrefix(arg, "--") && j > 0 {
+			flag, value, inline = arg[:j], arg[j+1:], true
+		}
 
-	switch c.Volatile {
-	case "", "yes", "state", "overlay", "no":
-	default:
-		return fmt.Errorf("invalid parameter for volatile")
-	}
+		var redact func(string) string
+		switch flag {
+		case "-E", "--setenv":
+			redact = func(v string) string {
+				if j := strings.Index(v, "="); j > 0 && secretNameRegexp.MatchString(v[:j]) {
+					return v[:j+1] + "<redacted>"
+				}
+				return v
+			}
+		case "--set-credential", "--load-credential":
+			redact = func(v string) string {
+				if j := strings.Index(v, ":"); j > 0 {
+					return v[:j+1] + "<redacted>"
+				}
+				return "<redacted>"
+			}
+		default:
+			continue
+		}
 
-	switch c.Console {
-	case "", "interactive", "read-only", "passive", "pipe":
-	default:
-		return fmt.Errorf("invalid parameter for console")
+		if inline {
+			redacted[i] = flag + "=" + redact(value)
+		} else if i+1 < len(redacted) {
+			i++
+			redacted[i] = redact(redacted[i])
+		}
 	}
+	return redacted
+}
 
-	switch c.ResolvConf {
-	case "", "off", "copy-host", "copy-static", "copy-uplink", "copy-stub",
-		"replace-host", "replace-static", "replace-uplink", "replace-stub",
-		"bind-host", "bind-static", "bind-uplink", "bind-stub", "delete", "auto":
-	default:
-		return fmt.Errorf("invalid parameter for resolv_conf")
+// joinArgs renders arguments as a shell command line.
+func joinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]#~!{}") {
+			arg = shellQuote(arg)
+		}
+		quoted[i] = arg
 	}
+	return strings.Join(quoted, " ")
+}
 
-	if c.Boot && c.ProcessTwo {
-		return fmt.Errorf("boot and process_two may not be combined")
-	}
+// machinePropertyRegexp matches references to machine properties in
+// environment values, like ${MACHINE_IP}.
+var machinePropertyRegexp = regexp.MustCompile(`\$\{(MACHINE_[A-Z_]+)\}`)
 
-	if c.Volatile != "" && c.UserNamespacing {
-		return fmt.Errorf("volatile and user_namespacing may not be combined")
-	}
+// machineProperties are the properties environment values may reference.
+var machineProperties = map[string]bool{
+	"MACHINE_NAME": true,
+	"MACHINE_ID":   true,
+	"MACHINE_IP":   true,
+}
 
-	if c.ReadOnly && c.UserNamespacing {
-		return fmt.Errorf("read_only and user_namespacing may not be combined")
+// templateEnvironment replaces references to machine properties in the
+// environment values by their values in props. The environment is fixed once
+// the container runs, so properties only known afterwards, like the address
+// of a veth network assigned by DHCP, can't be used and fail the task.
+func (c *MachineConfig) templateEnvironment(props map[string]string) error {
+	for name, value := range c.Environment {
+		var err error
+		c.Environment[name] = machinePropertyRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+			property := ref[2 : len(ref)-1]
+			if v := props[property]; v != "" {
+				return v
+			}
+			if err == nil {
+				err = fmt.Errorf("%s referenced by environment variable %s is not known before the container starts", property, name)
+			}
+			return ref
+		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if c.WorkingDirectory != "" && !filepath.IsAbs(c.WorkingDirectory) {
-		return fmt.Errorf("working_directory is not an absolute path")
+// inheritEnvironment passes the variables listed in inherit_env from
+// the host environment into the container, unless the task sets them itself.
+func (c *MachineConfig) inheritEnvironment(environ []string) {
+	host := envMap(environ)
+	for _, name := range c.InheritEnv {
+		value, ok := host[name]
+		if !ok {
+			continue
+		}
+		if c.Environment == nil {
+			c.Environment = make(hclutils.MapStrStr)
+		}
+		if _, ok := c.Environment[name]; !ok {
+			c.Environment[name] = value
+		}
 	}
+}
 
-	if c.PivotRoot != "" {
-		for _, p := range strings.Split(c.PivotRoot, ":") {
-			if !filepath.IsAbs(p) {
-				return fmt.Errorf("pivot_root is not an absolute path")
+// processEnv returns the environment systemd-nspawn is started with. By
+// default it inherits the environment of the executor, which is signalled
+// by returning nil. With clean_environment only PATH and the variables listed
+// in inherit_env are kept. Variables configuring nspawn itself are added
+// to either.
+func (c *MachineConfig) processEnv(environ []string) []string {
+	if !c.CleanEnvironment && len(c.nspawnEnv) == 0 {
+		return nil
+	}
+
+	env := []string{}
+	if c.CleanEnvironment {
+		host := envMap(environ)
+		for _, name := range append([]string{"PATH"}, c.InheritEnv...) {
+			if value, ok := host[name]; ok {
+				env = append(env, name+"="+value)
 			}
 		}
+	} else {
+		env = append(env, environ...)
 	}
 
-	if c.Image == "/" && !(c.Ephemeral || c.Volatile == "yes" || c.Volatile == "state") {
-		return fmt.Errorf("starting a container from the root directory is not supported. Use ephemeral or volatile")
+	names := make([]string, 0, len(c.nspawnEnv))
+	for name := range c.nspawnEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+c.nspawnEnv[name])
 	}
+	return env
+}
 
-	if c.ImageDownload != nil {
-		switch c.ImageDownload.Type {
-		case "raw", "tar":
-		default:
-			return fmt.Errorf("invalid parameter for image_download.type")
-		}
+// setMemoryProperties limits the memory of the machine to the resources
+// Nomad allocated. memory_min and memory_low protect memory from reclaim
+// under pressure; with memory oversubscription the reserved memory is
+// protected by default.
+func (c *MachineConfig) setMemoryProperties(memoryMB, memoryMaxMB int64) error {
+	limit := memoryMB
+	if memoryMaxMB != 0 {
+		limit = memoryMaxMB
+	}
 
-		switch c.ImageDownload.Verify {
-		case "no", "checksum", "signature":
-		default:
-			return fmt.Errorf("invalid parameter for image_download.verify")
-		}
+	low := c.MemoryLow
+	if low == 0 && memoryMaxMB != 0 {
+		low = memoryMB
 	}
 
-	if c.isNixOS() && c.isNixPackages() {
-		return fmt.Errorf("nixos and packages may not be combined")
+	if c.MemoryMin < 0 || low < 0 {
+		return fmt.Errorf("memory_min and memory_low may not be negative")
+	}
+	if c.MemoryMin > limit || low > limit {
+		return fmt.Errorf("memory_min and memory_low may not exceed the memory limit of %d MiB", limit)
+	}
+	if low != 0 && c.MemoryMin > low {
+		return fmt.Errorf("memory_min may not exceed memory_low")
 	}
 
+	if c.Properties == nil {
+		c.Properties = make(hclutils.MapStrStr)
+	}
+	if memoryMaxMB != 0 {
+		c.Properties["MemoryHigh"] = strconv.FormatInt(memoryMB*1024*1024, 10)
+	}
+	c.Properties["MemoryMax"] = strconv.FormatInt(limit*1024*1024, 10)
+	if c.MemoryMin > 0 {
+		c.Properties["MemoryMin"] = strconv.FormatInt(c.MemoryMin*1024*1024, 10)
+	}
+	if low > 0 {
+		c.Properties["MemoryLow"] = strconv.FormatInt(low*1024*1024, 10)
+	}
 	return nil
 }
 
-func (c *MachineConfig) prepareNixOS(dir string) error {
-	closure, toplevel, err := nixBuildNixOS(c.NixOS)
-	if err != nil {
-		return fmt.Errorf("Build of the flake failed: %v", err)
+// setCPUProperties limits the CPU of the machine to the resources Nomad
+// allocated. shares are the MHz of the task, percentTicks their share of the
+// node's total compute. CPUQuota counts 100% per CPU, so the quota is that
+// share of all CPUs of the node, e.g. 1000 MHz on a node of 8 CPUs with
+// 20000 MHz give 40%. shares are converted to a CPUWeight the way runc
+// converts cpu.shares for the unified hierarchy. Properties set by the task
+// take precedence.
+func (c *MachineConfig) setCPUProperties(shares int64, percentTicks float64, numCPU int) {
+	if c.Properties == nil {
+		c.Properties = make(hclutils.MapStrStr)
 	}
 
-	if c.BindReadOnly == nil {
-		c.BindReadOnly = make(hclutils.MapStrStr)
+	if _, ok := c.Properties["CPUQuota"]; !ok && percentTicks > 0 {
+		quota := math.Round(percentTicks * float64(numCPU) * 100)
+		c.Properties["CPUQuota"] = strconv.FormatFloat(quota, 'f', 0, 64) + "%"
 	}
 
-	c.BindReadOnly[toplevel] = toplevel
-	c.BindReadOnly[filepath.Join(closure, "registration")] = "/registration"
-	c.BindReadOnly[filepath.Join(toplevel, "init")] = "/init"
-	c.BindReadOnly[filepath.Join(toplevel, "sw")] = "/sw"
-
-	requisites, err := nixRequisites(closure)
-	if err != nil {
-		return fmt.Errorf("Couldn't determine flake requisites: %v", err)
+	if _, ok := c.Properties["CPUWeight"]; !ok && shares > 0 {
+		if shares < 2 {
+			shares = 2
+		}
+		weight := 1 + ((shares-2)*9999)/262142
+		if weight > 10000 {
+			weight = 10000
+		}
+		c.Properties["CPUWeight"] = strconv.FormatInt(weight, 10)
 	}
+}
 
-	for _, requisite := range requisites {
-		c.BindReadOnly[requisite] = requisite
-	}
+// numaNodeRoot is where the kernel describes the NUMA nodes of the host.
+var numaNodeRoot = "/sys/devices/system/node"
 
-	c.Directory = dir
-	c.createUsr()
+// setNUMAProperties restricts the machine to the CPUs and memory of its
+// numa_node. The cpuset controller enforces this for every process of the
+// scope, which requires the unified cgroup hierarchy. Nodes without CPUs,
+// e.g. of memory expanders, only restrict memory.
+func (c *MachineConfig) setNUMAProperties(nodeRoot string) error {
+	node := strconv.Itoa(*c.NUMANode)
+	cpus, err := ioutil.ReadFile(filepath.Join(nodeRoot, "node"+node, "cpulist"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("numa_node %s does not exist on this host", node)
+	} else if err != nil {
+		return fmt.Errorf("failed to read the CPUs of numa_node %s: %v", node, err)
+	}
 
-	if len(c.Command) == 0 {
-		c.Command = []string{"/init"}
+	if c.Properties == nil {
+		c.Properties = make(hclutils.MapStrStr)
+	}
+	for _, property := range []string{"AllowedCPUs", "AllowedMemoryNodes"} {
+		if _, ok := c.Properties[property]; ok {
+			return fmt.Errorf("numa_node and the %s property may not be combined", property)
+		}
 	}
 
+	if cpuList := strings.TrimSpace(string(cpus)); cpuList != "" {
+		c.Properties["AllowedCPUs"] = cpuList
+	}
+	c.Properties["AllowedMemoryNodes"] = node
 	return nil
 }
 
-func (c *MachineConfig) prepareNixPackages(dir string) error {
-	profileLink := filepath.Join(dir, "current-profile")
-	profile, err := nixBuildProfile(c.NixPackages, profileLink)
-	if err != nil {
-		return fmt.Errorf("Build of the flakes failed: %v", err)
-	}
+// systemdUnitsDir is where systemd exports the settings of units read by
+// journald.
+var systemdUnitsDir = "/run/systemd/units"
 
-	closureLink := filepath.Join(dir, "current-closure")
-	closure, err := nixBuildClosure(profileLink, closureLink)
-	if err != nil {
-		return fmt.Errorf("Build of the flakes failed: %v", err)
-	}
+// machineScope returns the name of the scope machined registers for the
+// machine.
+func machineScope(name string) string {
+	return "machine-" + unit.UnitNameEscape(name) + ".scope"
+}
 
-	if c.BindReadOnly == nil {
-		c.BindReadOnly = make(hclutils.MapStrStr)
+// logRateLimitFiles returns the files journald reads the rate limit of the
+// scope from.
+func logRateLimitFiles(dir, scope string) (string, string) {
+	return filepath.Join(dir, "log-rate-limit-interval:"+scope), filepath.Join(dir, "log-rate-limit-burst:"+scope)
+}
+
+// exportLogRateLimit sets the journald rate limit of the machine's scope.
+// Scopes don't support LogRateLimitIntervalSec= and LogRateLimitBurst=, so
+// the driver exports them to journald the way systemd does for services.
+// Validate ensures the interval parses.
+func (c *MachineConfig) exportLogRateLimit(dir string) error {
+	intervalFile, burstFile := logRateLimitFiles(dir, machineScope(c.Machine))
+	exports := map[string]string{}
+	if c.LogRateLimitInterval != "" {
+		d, _ := time.ParseDuration(c.LogRateLimitInterval)
+		exports[intervalFile] = strconv.FormatInt(int64(d/time.Microsecond), 10)
+	}
+	if c.LogRateLimitBurst != nil {
+		exports[burstFile] = strconv.Itoa(*c.LogRateLimitBurst)
 	}
 
-	c.BindReadOnly[profile] = profile
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to export log rate limit: %v", err)
+	}
+	for file, value := range exports {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to export log rate limit: %v", err)
+		}
+		if err := os.Symlink(value, file); err != nil {
+			return fmt.Errorf("failed to export log rate limit: %v", err)
+		}
+	}
+	return nil
+}
 
-	if entries, err := os.ReadDir(profile); err != nil {
-		return fmt.Errorf("Couldn't read profile directory: %w", err)
-	} else {
-		for _, entry := range entries {
-			if name := entry.Name(); name != "etc" {
-				c.BindReadOnly[filepath.Join(profile, name)] = "/" + name
-				continue
-			}
+// unexportLogRateLimit removes the journald rate limit of a machine's scope.
+func unexportLogRateLimit(dir, machine string) error {
+	intervalFile, burstFile := logRateLimitFiles(dir, machineScope(machine))
+	for _, file := range []string{intervalFile, burstFile} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
 
-			etcEntries, err := os.ReadDir(filepath.Join(profile, "etc"))
-			if err != nil {
-				return fmt.Errorf("Couldn't read profile's /etc directory: %w", err)
-			}
+// readyTimeout returns how long to wait for ready_unit. Validate ensures
+// ReadyTimeout parses.
+func (c *MachineConfig) readyTimeout() time.Duration {
+	if c.ReadyTimeout == "" {
+		return defaultReadyTimeout
+	}
+	d, _ := time.ParseDuration(c.ReadyTimeout)
+	return d
+}
 
-			for _, etcEntry := range etcEntries {
-				etcName := etcEntry.Name()
-				if etcName == "resolv.conf" {
-					// avoid interfering with the --resolv-conf flag
-					continue
-				}
-				c.BindReadOnly[filepath.Join(profile, "etc", etcName)] = "/etc/" + etcName
-			}
+// stopParams returns the signal and grace period used to stop the task.
+// stop_signal is used if Nomad passes no signal, stop_grace_period replaces
+// the kill_timeout of the task.
+func (c *MachineConfig) stopParams(signal string, timeout time.Duration) (string, time.Duration) {
+	if signal == "" {
+		signal = c.StopSignal
+	}
+	if c.StopGracePeriod != "" {
+		if d, err := time.ParseDuration(c.StopGracePeriod); err == nil {
+			timeout = d
 		}
 	}
+	return signal, timeout
+}
 
-	c.BindReadOnly[filepath.Join(closure, "registration")] = "/registration"
+// machineStopSignal returns the signal sent to the leader of the machine to
+// stop it gracefully, kill_signal if set. Otherwise booted containers are
+// powered off like `machinectl poweroff` does, systemd doesn't shut down on
+// the signal meant for nspawn, and others get signal or SIGTERM.
+func (c *MachineConfig) machineStopSignal(signal string) syscall.Signal {
+	if s, ok := SignalLookup[c.KillSignal]; ok {
+		return s.(syscall.Signal)
+	}
+	if c.Boot {
+		return SignalLookup["SIGRTMIN+4"].(syscall.Signal)
+	}
+	if s, ok := SignalLookup[signal]; ok {
+		return s.(syscall.Signal)
+	}
+	return syscall.SIGTERM
+}
 
-	requisites, err := nixRequisites(closure)
-	if err != nil {
-		return fmt.Errorf("Couldn't determine flake requisites: %v", err)
+// signalsLeader reports whether signal is sent to the leader of the machine
+// through machined rather than to systemd-nspawn. nspawn doesn't handle
+// realtime signals, which would kill it, and only forwards some signals to
+// the init of booted containers.
+func (c *MachineConfig) signalsLeader(signal syscall.Signal) bool {
+	if !c.register() {
+		return false
 	}
+	return c.Boot || signal >= sigRTMin
+}
 
-	for _, requisite := range requisites {
-		c.BindReadOnly[requisite] = requisite
+// delegateCgroup reports whether the container gets its own cgroup subtree
+// to manage. Booted containers run systemd, which needs one, and so do
+// nested containers.
+func (c *MachineConfig) delegateCgroup() bool {
+	if c.DelegateCgroup != nil {
+		return *c.DelegateCgroup
 	}
+	return c.Boot || c.Nested
+}
 
-	c.Directory = dir
-	c.createUsr()
+// nestedCapabilities are added to containers running containers themselves,
+// which set up the networks of their own containers.
+var nestedCapabilities = []string{"CAP_NET_ADMIN"}
 
-	if _, found := c.Environment["PATH"]; !found {
-		c.Environment["PATH"] = "/bin"
+// delegateCgroupProps delegates the cgroup subtree of the machine's scope to
+// the container. On hosts using the unified hierarchy, nspawn is told to
+// mount it in a cgroup namespace, so the container only sees its subtree.
+func (c *MachineConfig) delegateCgroupProps(cgroupVersion, systemdVersion int) error {
+	if systemdVersion < minDelegateSystemdVersion {
+		return fmt.Errorf("delegate_cgroup requires systemd %d or newer, found %d", minDelegateSystemdVersion, systemdVersion)
 	}
 
-	return nil
-}
+	if c.Properties == nil {
+		c.Properties = make(hclutils.MapStrStr)
+	}
+	if _, ok := c.Properties["Delegate"]; !ok {
+		c.Properties["Delegate"] = "yes"
+	}
 
-func (c *MachineConfig) createUsr() {
-	needUsr := true
-	for _, guestDir := range c.BindReadOnly {
-		if strings.HasPrefix("/usr/", guestDir) {
-			needUsr = false
-			break
+	if cgroupVersion == 2 {
+		if c.nspawnEnv == nil {
+			c.nspawnEnv = make(map[string]string)
 		}
+		c.nspawnEnv["SYSTEMD_NSPAWN_UNIFIED_HIERARCHY"] = "1"
+		c.nspawnEnv["SYSTEMD_NSPAWN_USE_CGNS"] = "1"
 	}
+	return nil
+}
 
-	if needUsr {
-		os.MkdirAll(filepath.Join(c.Directory, "usr"), 0777)
+// cgroupRoot is where the host mounts its cgroup hierarchy.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupVersion returns 2 if path is the unified cgroup hierarchy and 1 for
+// legacy and hybrid setups.
+func cgroupVersion(path string) (int, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	if uint32(stat.Type) == cgroup2SuperMagic {
+		return 2, nil
+	}
+	return 1, nil
+}
+
+// hostSystemdVersion returns the major version of the host's systemd.
+func hostSystemdVersion() (int, error) {
+	version, err := systemdVersion()
+	if err != nil {
+		return 0, fmt.Errorf("failed to determine systemd version: %v", err)
+	}
+	sdVersion, err := strconv.Atoi(version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse systemd version %q: %v", version, err)
+	}
+	return sdVersion, nil
+}
+
+// oomPolicyProps sets what systemd does with the scope of the machine if a
+// process in it gets OOM killed. Older systemd rejects the scope with it.
+func (c *MachineConfig) oomPolicyProps(systemdVersion int) error {
+	if systemdVersion < minOOMPolicySystemdVersion {
+		return fmt.Errorf("oom_policy requires systemd %d or newer, found %d", minOOMPolicySystemdVersion, systemdVersion)
+	}
+	if c.Properties == nil {
+		c.Properties = make(hclutils.MapStrStr)
+	}
+	c.Properties["OOMPolicy"] = c.OOMPolicy
+	return nil
+}
+
+// setupCgroupDelegation detects the host's cgroup and systemd versions and
+// delegates the machine's cgroup subtree accordingly.
+func setupCgroupDelegation(c *MachineConfig) error {
+	sdVersion, err := hostSystemdVersion()
+	if err != nil {
+		return err
+	}
+
+	cgVersion, err := cgroupVersion(cgroupRoot)
+	if err != nil {
+		return fmt.Errorf("failed to determine cgroup version: %v", err)
+	}
+
+	return c.delegateCgroupProps(cgVersion, sdVersion)
+}
+
+// envForwarded reports whether a variable Nomad set for the task is passed
+// into the container. Names are matched by prefix; an empty allow list
+// allows every name not denied.
+func envForwarded(name string, allow, deny []string) bool {
+	for _, prefix := range deny {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, prefix := range allow {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func envMap(environ []string) map[string]string {
+	m := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			m[kv[:i]] = kv[i+1:]
+		}
+	}
+	return m
+}
+
+// commandLine joins entrypoint and command, wrapping them in a login shell if
+// requested.
+func (c *MachineConfig) commandLine() []string {
+	argv := append(append([]string{}, c.Entrypoint...), c.Command...)
+	if c.LoginShell && len(argv) > 0 {
+		argv = append([]string{"/bin/sh", "-l", "-c", `exec "$@"`, "sh"}, argv...)
+	}
+	return argv
+}
+
+// capabilityRegexp matches the capability names accepted by systemd-nspawn's
+// --capability.
+var capabilityRegexp = regexp.MustCompile(`^(CAP_[A-Z0-9_]+|all)$`)
+
+func validCapability(c string) bool {
+	return capabilityRegexp.MatchString(c)
+}
+
+// mergeCapabilities appends the capabilities in extra that aren't in caps yet.
+func mergeCapabilities(caps []string, extra []string) []string {
+	seen := make(map[string]bool, len(caps)+len(extra))
+	merged := make([]string, 0, len(caps)+len(extra))
+	for _, c := range append(append([]string{}, caps...), extra...) {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		merged = append(merged, c)
+	}
+	return merged
+}
+
+// privateNetwork reports whether the container gets its own network
+// namespace.
+func (c *MachineConfig) privateNetwork() bool {
+	return c.NetworkVeth || len(c.NetworkVethExtra) > 0 || c.NetworkZone != "" || c.NetworkBridge != "" ||
+		c.NetworkNamespace != "" || c.CNINetwork != "" || c.lanNetwork()
+}
+
+// lanNetwork reports whether the container gets macvlan or ipvlan links to
+// interfaces of the host. Those are moved into the container as mv-IFACE
+// and iv-IFACE, leaving nothing on the host for machined to report or for
+// iptables to forward.
+func (c *MachineConfig) lanNetwork() bool {
+	return len(c.NetworkMacvlan) > 0 || len(c.NetworkIpvlan) > 0
+}
+
+// privateUsers reports whether the container runs in a user namespace.
+func (c *MachineConfig) privateUsers() bool {
+	if c.PrivateUsers != "" {
+		return c.PrivateUsers != "no"
+	}
+	return c.UserNamespacing
+}
+
+// validPrivateUsers checks the value against the modes accepted by
+// systemd-nspawn's --private-users, including an explicit UIDBASE:NUIDS
+// range.
+func validPrivateUsers(mode string) bool {
+	switch mode {
+	case "no", "yes", "identity", "pick":
+		return true
+	}
+
+	parts := strings.SplitN(mode, ":", 2)
+	base, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return false
+	}
+	if len(parts) == 1 {
+		return true
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 32)
+	return err == nil && n > 0 && base+n <= math.MaxUint32+1
+}
+
+// vethExtraHostInterfaces returns the host side names of the
+// network_veth_extra links.
+func (c *MachineConfig) vethExtraHostInterfaces() []string {
+	var names []string
+	for _, veth := range c.NetworkVethExtra {
+		names = append(names, strings.SplitN(veth, ":", 2)[0])
+	}
+	return names
+}
+
+// validInterfaceName checks name against the rules of the kernel for network
+// interface names.
+func validInterfaceName(name string) bool {
+	return name != "" && len(name) < 16 && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/: \t\n")
+}
+
+// setDefaultResolvConf picks copy-host unless the container has a private
+// network and the host uses the systemd-resolved stub listener on 127.0.0.53,
+// which isn't reachable from there. It reports whether an explicitly set mode
+// is likely to leave the container without working DNS.
+func (c *MachineConfig) setDefaultResolvConf(resolved bool) bool {
+	// systemd-resolved in the container manages its resolv.conf
+	if len(c.DNSOverTLS) > 0 && c.ResolvConf == "" {
+		c.ResolvConf = "off"
+		return false
+	}
+
+	stub := resolved && c.privateNetwork()
+	if c.ResolvConf == "" {
+		c.ResolvConf = "copy-host"
+		if stub {
+			c.ResolvConf = "bind-uplink"
+		}
+		return false
+	}
+	return stub && strings.HasSuffix(c.ResolvConf, "-host")
+}
+
+// validLinkJournal checks the value against the modes accepted by
+// systemd-nspawn's --link-journal.
+func validLinkJournal(mode string) bool {
+	switch mode {
+	case "", "no", "host", "try-host", "guest", "try-guest", "auto":
+		return true
+	}
+	return false
+}
+
+// imageKind reports whether the resolved image path is a directory tree or a
+// raw disk image.
+func (c *MachineConfig) imageKind() (string, error) {
+	imageStat, err := os.Stat(c.imagePath)
+	if err != nil {
+		return "", err
+	}
+	if imageStat.IsDir() {
+		return DirectoryImage, nil
+	}
+	return RawImage, nil
+}
+
+func (c *MachineConfig) Validate() error {
+	if !validLinkJournal(c.LinkJournal) {
+		return fmt.Errorf("invalid parameter for link_journal")
+	}
+
+	switch c.Volatile {
+	case "", "yes", "state", "overlay", "no":
+	default:
+		return fmt.Errorf("invalid parameter for volatile")
+	}
+
+	switch c.Console {
+	case "", "interactive", "read-only", "passive", "pipe":
+	default:
+		return fmt.Errorf("invalid parameter for console")
+	}
+
+	switch c.ResolvConf {
+	case "", "off", "copy-host", "copy-static", "copy-uplink", "copy-stub",
+		"replace-host", "replace-static", "replace-uplink", "replace-stub",
+		"bind-host", "bind-static", "bind-uplink", "bind-stub", "delete", "auto":
+	default:
+		return fmt.Errorf("invalid parameter for resolv_conf")
+	}
+
+	for _, filter := range c.SystemCallFilter {
+		if !systemCallFilterRegexp.MatchString(filter) {
+			return fmt.Errorf("invalid parameter for system_call_filter: %q is not a system call, @group or ~ followed by either", filter)
+		}
+	}
+
+	switch c.Timezone {
+	case "", "off", "copy", "bind", "symlink", "delete", "auto":
+	default:
+		return fmt.Errorf("invalid parameter for timezone")
+	}
+
+	// the stub listener of systemd-resolved only listens on the host's
+	// loopback interface
+	if strings.HasSuffix(c.ResolvConf, "-stub") && c.privateNetwork() {
+		return fmt.Errorf("resolv_conf %q points to the systemd-resolved stub on 127.0.0.53, which is not reachable from the container's private network. Use a -uplink or -static mode instead", c.ResolvConf)
+	}
+
+	if len(c.DNSOverTLS) > 0 {
+		if !c.Boot {
+			return fmt.Errorf("dns_over_tls requires boot, as it is implemented by systemd-resolved in the container")
+		}
+		if c.ResolvConf != "" && c.ResolvConf != "off" {
+			return fmt.Errorf("dns_over_tls and resolv_conf may not be combined")
+		}
+		for _, resolver := range c.DNSOverTLS {
+			if err := validDNSOverTLSResolver(resolver); err != nil {
+				return fmt.Errorf("invalid resolver %q in dns_over_tls: %v", resolver, err)
+			}
+		}
+	}
+
+	switch c.ExecServiceType {
+	case "", "simple", "exec", "forking", "oneshot", "dbus", "notify", "idle":
+	default:
+		return fmt.Errorf("invalid parameter for exec_service_type")
+	}
+
+	for _, drop := range c.DropCapability {
+		if !validCapability(drop) {
+			return fmt.Errorf("invalid parameter for drop_capability")
+		}
+		for _, add := range c.Capability {
+			if add == drop {
+				return fmt.Errorf("%s is listed in both capability and drop_capability", drop)
+			}
+		}
+	}
+
+	if c.Hostname != "" {
+		if len(c.Hostname) > 64 || !hostnameRegexp.MatchString(c.Hostname) {
+			return fmt.Errorf("invalid parameter for hostname")
+		}
+	}
+
+	if c.ExecUser != "" && !validExecUser(c.ExecUser) {
+		return fmt.Errorf("invalid parameter for exec_user")
+	}
+	if c.ExecWorkingDirectory != "" && !path.IsAbs(c.ExecWorkingDirectory) {
+		return fmt.Errorf("exec_working_directory must be an absolute path")
+	}
+
+	if c.CleanupImage && c.ImageDownload == nil {
+		return fmt.Errorf("cleanup_image requires image_download")
+	}
+
+	if c.Slice != "" {
+		if !sliceRegexp.MatchString(c.Slice) {
+			return fmt.Errorf("invalid parameter for slice")
+		}
+		// the container runs in the unit of the executor instead
+		if c.KeepUnit {
+			return fmt.Errorf("slice and keep_unit may not be combined")
+		}
+	}
+
+	if c.KillSignal != "" {
+		if _, ok := SignalLookup[c.KillSignal]; !ok {
+			return fmt.Errorf("invalid parameter for kill_signal")
+		}
+	}
+
+	if c.StopSignal != "" {
+		if _, ok := SignalLookup[c.StopSignal]; !ok {
+			return fmt.Errorf("invalid parameter for stop_signal")
+		}
+		// the executor sends stop_signal to nspawn, not to the container
+		if isRealtimeSignal(c.StopSignal) {
+			return fmt.Errorf("stop_signal may not be a realtime signal, use kill_signal for the signal of the container's PID 1")
+		}
+	}
+
+	if c.StopGracePeriod != "" {
+		if d, err := time.ParseDuration(c.StopGracePeriod); err != nil || d < 0 {
+			return fmt.Errorf("invalid parameter for stop_grace_period")
+		}
+	}
+
+	if c.ReadyUnit != "" {
+		if !c.Boot {
+			return fmt.Errorf("ready_unit requires boot")
+		}
+		if !c.register() {
+			return fmt.Errorf("ready_unit requires register")
+		}
+		if strings.ContainsAny(c.ReadyUnit, "/ ") || strings.HasPrefix(c.ReadyUnit, "-") {
+			return fmt.Errorf("invalid parameter for ready_unit")
+		}
+	}
+
+	if c.ReadyTimeout != "" {
+		if d, err := time.ParseDuration(c.ReadyTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid parameter for ready_timeout")
+		}
+	}
+
+	if c.HostMachineID {
+		switch c.LinkJournal {
+		case "", "no", "auto":
+		default:
+			return fmt.Errorf("host_machine_id may only be combined with link_journal \"no\" or \"auto\"")
+		}
+	}
+
+	for name, value := range c.Environment {
+		for _, ref := range machinePropertyRegexp.FindAllStringSubmatch(value, -1) {
+			if !machineProperties[ref[1]] {
+				return fmt.Errorf("environment variable %s references unknown machine property %s", name, ref[1])
+			}
+		}
+	}
+
+	hostInterfaces := map[string]bool{}
+	for _, veth := range c.NetworkVethExtra {
+		parts := strings.SplitN(veth, ":", 2)
+		for _, name := range parts {
+			if !validInterfaceName(name) {
+				return fmt.Errorf("invalid parameter for network_veth_extra: %q is not of the form host:container", veth)
+			}
+		}
+		if hostInterfaces[parts[0]] {
+			return fmt.Errorf("network_veth_extra: host interface %s is used more than once", parts[0])
+		}
+		hostInterfaces[parts[0]] = true
+	}
+	if len(c.NetworkVethExtra) > 0 && (c.NetworkNamespace != "" || c.CNINetwork != "") {
+		return fmt.Errorf("network_veth_extra may not be combined with cni_network or a network namespace")
+	}
+
+	// a host interface can't be the parent of both kinds of links
+	lanInterfaces := map[string]bool{}
+	for _, links := range []struct {
+		attr   string
+		ifaces []string
+	}{{"network_macvlan", c.NetworkMacvlan}, {"network_ipvlan", c.NetworkIpvlan}} {
+		for _, iface := range links.ifaces {
+			if !validInterfaceName(iface) {
+				return fmt.Errorf("invalid parameter for %s: %q is not an interface name", links.attr, iface)
+			}
+			if lanInterfaces[iface] {
+				return fmt.Errorf("host interface %s is used more than once by network_macvlan and network_ipvlan", iface)
+			}
+			lanInterfaces[iface] = true
+		}
+	}
+	if c.lanNetwork() && (c.NetworkNamespace != "" || c.CNINetwork != "") {
+		return fmt.Errorf("network_macvlan and network_ipvlan may not be combined with cni_network or a network namespace")
+	}
+
+	// nspawn creates the veth link of network_bridge itself
+	if c.NetworkBridge != "" {
+		if !validInterfaceName(c.NetworkBridge) {
+			return fmt.Errorf("invalid parameter for network_bridge")
+		}
+		if c.NetworkVeth {
+			return fmt.Errorf("network_bridge and network_veth may not be combined")
+		}
+		if c.NetworkZone != "" {
+			return fmt.Errorf("network_bridge and network_zone may not be combined")
+		}
+		if c.NetworkNamespace != "" || c.CNINetwork != "" {
+			return fmt.Errorf("network_bridge may not be combined with cni_network or a network namespace")
+		}
+	}
+
+	if c.NixSSLCertFile != "" && !isTaskDirPath(c.NixSSLCertFile) {
+		return fmt.Errorf("nix_ssl_cert_file must be a path inside the task directory")
+	}
+	for name, proxy := range map[string]string{
+		"nix_http_proxy":  c.NixHTTPProxy,
+		"nix_https_proxy": c.NixHTTPSProxy,
+	} {
+		if proxy != "" && !validProxyURL(proxy) {
+			return fmt.Errorf("invalid parameter for %s", name)
+		}
+	}
+
+	if c.NixBuildLog != "" {
+		if !isTaskDirPath(c.NixBuildLog) {
+			return fmt.Errorf("nix_build_log must be a path inside the task directory")
+		}
+		if !c.isNixOS() && !c.isNixPackages() {
+			return fmt.Errorf("nix_build_log requires nixos, nixos_toplevel or packages")
+		}
+	}
+
+	if c.RestartOnOOM < 0 {
+		return fmt.Errorf("invalid parameter for restart_on_oom")
+	}
+
+	if !c.register() {
+		// the addresses of veth links are looked up through machined and
+		// OOM kills are matched by the scope machined creates
+		if c.NetworkVeth || c.NetworkZone != "" || c.NetworkBridge != "" || len(c.NetworkVethExtra) > 0 {
+			return fmt.Errorf("network_veth, network_zone, network_bridge and network_veth_extra require register")
+		}
+		if c.RestartOnOOM > 0 {
+			return fmt.Errorf("restart_on_oom requires register")
+		}
+	}
+	// without registering, nspawn would keep the unit of the executor,
+	// which is the unit of the Nomad client
+	if c.KeepUnit && c.register() {
+		return fmt.Errorf("keep_unit requires register = false")
+	}
+
+	if c.NixSystem != "" && !nixSystemRegexp.MatchString(c.NixSystem) {
+		return fmt.Errorf("invalid parameter for nix_system")
+	}
+
+	// PATH[:OPTIONS], with mount options like mode=1777 or size=64M
+	for _, t := range c.Tmpfs {
+		if path := strings.SplitN(t, ":", 2)[0]; !filepath.IsAbs(path) {
+			return fmt.Errorf("tmpfs path %q must be absolute", path)
+		}
+	}
+
+	if _, err := taskDirMountFlags(c.TaskDirMountOptions); err != nil {
+		return err
+	}
+
+	for _, cred := range c.LoadCredential {
+		if err := validCredential(cred, "path"); err != nil {
+			return fmt.Errorf("invalid load_credential: %v", err)
+		}
+	}
+	for _, cred := range c.SetCredential {
+		if err := validCredential(cred, "value"); err != nil {
+			return fmt.Errorf("invalid set_credential: %v", err)
+		}
+	}
+
+	for _, o := range c.Overlay {
+		if err := validOverlay(o, false); err != nil {
+			return fmt.Errorf("invalid overlay: %v", err)
+		}
+	}
+	for _, o := range c.OverlayReadOnly {
+		if err := validOverlay(o, true); err != nil {
+			return fmt.Errorf("invalid overlay_read_only: %v", err)
+		}
+	}
+
+	if c.LogRateLimitInterval != "" {
+		if d, err := time.ParseDuration(c.LogRateLimitInterval); err != nil || d < 0 {
+			return fmt.Errorf("invalid parameter for log_rate_limit_interval")
+		}
+	}
+	if c.LogRateLimitBurst != nil && *c.LogRateLimitBurst < 0 {
+		return fmt.Errorf("invalid parameter for log_rate_limit_burst")
+	}
+
+	if c.NUMANode != nil && *c.NUMANode < 0 {
+		return fmt.Errorf("invalid parameter for numa_node")
+	}
+
+	if c.Nested && c.DelegateCgroup != nil && !*c.DelegateCgroup {
+		return fmt.Errorf("nested requires delegate_cgroup")
+	}
+
+	switch c.OOMPolicy {
+	case "", "continue", "stop", "kill":
+	default:
+		return fmt.Errorf("invalid parameter for oom_policy")
+	}
+
+	if c.Stdin != "" && c.Console != "pipe" {
+		return fmt.Errorf("stdin may only be used with console = \"pipe\"")
+	}
+
+	if c.Stdin != "" && !isTaskDirPath(c.Stdin) {
+		return fmt.Errorf("stdin must be a path inside the task directory")
+	}
+
+	if c.Boot && c.ProcessTwo {
+		return fmt.Errorf("boot and process_two may not be combined")
+	}
+
+	// without a command nspawn would start an interactive shell, which exits
+	// right away without a console
+	if c.ProcessTwo && len(c.commandLine()) == 0 {
+		return fmt.Errorf("process_two requires a command")
+	}
+
+	if c.Boot && len(c.Entrypoint) > 0 {
+		return fmt.Errorf("boot and entrypoint may not be combined")
+	}
+
+	if c.Boot && c.LoginShell {
+		return fmt.Errorf("boot and login_shell may not be combined")
+	}
+
+	if c.LoginShell && len(c.Entrypoint)+len(c.Command) == 0 {
+		return fmt.Errorf("login_shell requires a command or entrypoint")
+	}
+
+	if c.Volatile != "" && c.UserNamespacing {
+		return fmt.Errorf("volatile and user_namespacing may not be combined")
+	}
+
+	// chown rewrites the ownership of the whole image, which is impossible
+	// for a read-only one. This is checked first to give a clearer error than
+	// the general conflict of read_only and user namespaces below.
+	if c.PrivateUsersOwnership != "" {
+		switch c.PrivateUsersOwnership {
+		case "no", "yes", "chown", "map", "auto":
+		default:
+			return fmt.Errorf("invalid parameter for private_users_ownership")
+		}
+		if !c.privateUsers() {
+			return fmt.Errorf("private_users_ownership requires user_namespacing or private_users")
+		}
+		if c.ReadOnly && (c.PrivateUsersOwnership == "chown" || c.PrivateUsersOwnership == "yes") {
+			return fmt.Errorf("private_users_ownership = \"chown\" and read_only may not be combined")
+		}
+	}
+
+	if c.PrivateUsers != "" {
+		if !validPrivateUsers(c.PrivateUsers) {
+			return fmt.Errorf("invalid parameter for private_users")
+		}
+		if c.UserNamespacing {
+			return fmt.Errorf("private_users and user_namespacing may not be combined")
+		}
+		if c.PrivateUsers != "no" && c.Volatile != "" {
+			return fmt.Errorf("volatile and private_users may not be combined")
+		}
+		if c.PrivateUsers != "no" && c.ReadOnly {
+			return fmt.Errorf("read_only and private_users may not be combined")
+		}
+	}
+
+	if c.ReadOnly && c.UserNamespacing {
+		return fmt.Errorf("read_only and user_namespacing may not be combined")
+	}
+
+	// bound users get UIDs from 60514 in the container, which an identity
+	// mapping or a smaller range doesn't leave to nspawn
+	if len(c.BindUser) > 0 {
+		for _, user := range c.BindUser {
+			if !userNameRegexp.MatchString(user) {
+				return fmt.Errorf("invalid parameter for bind_user")
+			}
+		}
+		if !c.privateUsers() {
+			return fmt.Errorf("bind_user requires user_namespacing or private_users")
+		}
+		if c.PrivateUsers == "identity" {
+			return fmt.Errorf("bind_user and private_users = \"identity\" may not be combined")
+		}
+		if parts := strings.SplitN(c.PrivateUsers, ":", 2); len(parts) == 2 {
+			if n, _ := strconv.ParseUint(parts[1], 10, 32); n < 65536 {
+				return fmt.Errorf("bind_user requires a private_users range of 65536 UIDs")
+			}
+		}
+	}
+
+	if len(c.WritablePaths) > 0 && !c.ReadOnly {
+		return fmt.Errorf("writable_paths requires read_only")
+	}
+	if err := validWritablePaths(c.WritablePaths); err != nil {
+		return err
+	}
+
+	for _, name := range c.InheritEnv {
+		if !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("inherit_env entry %q is not a valid variable name", name)
+		}
+	}
+
+	for _, prefix := range append(append([]string{}, c.EnvAllow...), c.EnvDeny...) {
+		if prefix == "" {
+			return fmt.Errorf("env_allow and env_deny may not contain empty prefixes")
+		}
+	}
+
+	if c.UserID < 0 {
+		return fmt.Errorf("user_id may not be negative")
+	}
+
+	if c.UserID != 0 && c.User == "" {
+		return fmt.Errorf("user_id requires user")
+	}
+
+	if c.WorkingDirectory != "" && !filepath.IsAbs(c.WorkingDirectory) {
+		return fmt.Errorf("working_directory is not an absolute path")
+	}
+
+	if c.PivotRoot != "" {
+		for _, p := range strings.Split(c.PivotRoot, ":") {
+			if !filepath.IsAbs(p) {
+				return fmt.Errorf("pivot_root is not an absolute path")
+			}
+		}
+	}
+
+	if c.Image == "/" && !(c.Ephemeral || c.Volatile == "yes" || c.Volatile == "state") {
+		return fmt.Errorf("starting a container from the root directory is not supported. Use ephemeral or volatile")
+	}
+
+	if c.ImageDownload != nil {
+		switch c.ImageDownload.Type {
+		case "raw", "tar":
+		default:
+			return fmt.Errorf("invalid parameter for image_download.type")
+		}
+
+		switch c.ImageDownload.Verify {
+		case "no", "checksum", "signature":
+		default:
+			return fmt.Errorf("invalid parameter for image_download.verify")
+		}
+
+		if err := c.ImageDownload.validateChecksums(); err != nil {
+			return err
+		}
+
+		if c.ImageDownload.Checksum != "" {
+			if !imageChecksumRegexp.MatchString(c.ImageDownload.Checksum) {
+				return fmt.Errorf("invalid parameter for image_download.checksum")
+			}
+			if c.ImageDownload.Verify != "checksum" {
+				return fmt.Errorf("image_download.checksum requires verify = \"checksum\"")
+			}
+			if c.ImageDownload.Checksums != "" {
+				return fmt.Errorf("image_download.checksum and image_download.checksums may not be combined")
+			}
+		}
+
+		for _, mirror := range c.ImageDownload.Mirrors {
+			if u, err := url.Parse(mirror); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid parameter for image_download.mirrors")
+			}
+		}
+
+		if c.ImageDownload.Timeout != "" {
+			if d, err := time.ParseDuration(c.ImageDownload.Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("invalid parameter for image_download.timeout")
+			}
+		}
+	}
+
+	if c.DiskQuota < 0 {
+		return fmt.Errorf("disk_quota may not be negative")
+	}
+
+	if c.DiskQuota > 0 && c.Image == "" {
+		return fmt.Errorf("disk_quota requires an image")
+	}
+
+	if c.DiskQuota > 0 && filepath.IsAbs(c.Image) {
+		return fmt.Errorf("disk_quota requires an image managed by machinectl")
+	}
+
+	if c.MemoryMin < 0 || c.MemoryLow < 0 {
+		return fmt.Errorf("memory_min and memory_low may not be negative")
+	}
+
+	if c.DiskQuota > 0 && c.Ephemeral {
+		return fmt.Errorf("disk_quota and ephemeral may not be combined")
+	}
+
+	for _, p := range c.ExtraStorePaths {
+		if !storePathRegexp.MatchString(p) {
+			return fmt.Errorf("extra_store_paths entry %q is not a valid store path", p)
+		}
+	}
+
+	if c.isNixOS() && c.isNixPackages() {
+		return fmt.Errorf("nixos and packages may not be combined")
+	}
+
+	for _, pkg := range c.NixPackages {
+		if err := validFlakeRef(pkg, false); err != nil {
+			return fmt.Errorf("invalid packages entry %q: %v", pkg, err)
+		}
+	}
+	if c.NixOS != "" {
+		if err := validFlakeRef(c.NixOS, true); err != nil {
+			return fmt.Errorf("invalid nixos %q: %v", c.NixOS, err)
+		}
+	}
+
+	if c.NixOS != "" && c.NixOSToplevel != "" {
+		return fmt.Errorf("nixos and nixos_toplevel may not be combined")
+	}
+
+	if c.NixOSToplevel != "" && !storePathRegexp.MatchString(c.NixOSToplevel) {
+		return fmt.Errorf("nixos_toplevel %q is not a valid store path", c.NixOSToplevel)
+	}
+
+	return nil
+}
+
+// warnings returns the features a valid config gives up or risks, which
+// StartTask reports instead of failing the task.
+func (c *MachineConfig) warnings() []string {
+	var warnings []string
+	if !c.register() {
+		warnings = append(warnings, "register = false: the container isn't known to machined, so exec and OOM "+
+			"detection don't work, resource usage is measured by the executor and only the Nomad network address is reported")
+	}
+	if c.KeepUnit {
+		warnings = append(warnings, "keep_unit: the container runs in the unit of the executor, so no scope "+
+			"with its own memory and CPU limits is created")
+	}
+	// changes to an image outlive the container and may be lost on a crash
+	if c.SuppressSync && c.Image != "" && !c.Ephemeral && (c.Volatile == "" || c.Volatile == "no") {
+		warnings = append(warnings, "suppress_sync: writes to the image aren't synced to disk and may be lost "+
+			"if the host crashes, use it with ephemeral or volatile")
+	}
+	return warnings
+}
+
+// isTaskDirPath reports whether path is relative and doesn't escape the task
+// directory it will be resolved against.
+func isTaskDirPath(path string) bool {
+	if filepath.IsAbs(path) {
+		return false
+	}
+	clean := filepath.Clean(path)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// resolveTaskDirPath resolves path against the task directory, following
+// symlinks, and fails if the result lies outside of it.
+func resolveTaskDirPath(taskDir, path string) (string, error) {
+	if !isTaskDirPath(path) {
+		return "", fmt.Errorf("%s is not a path inside the task directory", path)
+	}
+
+	root, err := filepath.EvalSymlinks(taskDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || !isTaskDirPath(rel) {
+		return "", fmt.Errorf("%s resolves to a path outside of the task directory", path)
+	}
+
+	return resolved, nil
+}
+
+// nixOptions holds the settings applied to every nix invocation of a task.
+type nixOptions struct {
+	// Env is added to the environment inherited from the driver
+	Env []string
+	// Settings are passed as --option NAME VALUE
+	Settings map[string]string
+	// Log receives the complete output of every build, see nix_build_log
+	Log *os.File
+	// NixpkgsFlake is the nixpkgs closure info is built with
+	NixpkgsFlake string
+	// System is the Nix system packages are built for, see nix_system
+	System string
+	// Progress is called with every line nix writes to stderr while the
+	// build runs
+	Progress func(line string)
+	// Cache has the builds of other tasks to reuse, if set
+	Cache *nixBuildCache
+	// ErrorLines limits the output of failed builds included in errors,
+	// see nix_build_error_lines
+	ErrorLines int
+}
+
+func (o *nixOptions) command(args ...string) *exec.Cmd {
+	for name, value := range o.Settings {
+		args = append(args, "--option", name, value)
+	}
+	if o.Log != nil {
+		args = append(args, "--print-build-logs")
+	}
+
+	cmd := exec.Command("nix", args...)
+	if len(o.Env) > 0 {
+		cmd.Env = append(os.Environ(), o.Env...)
+	}
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, "$ %s\n", joinArgs(cmd.Args))
+	}
+	return cmd
+}
+
+// stderr returns the writer for the stderr of a nix command, which goes to
+// buf, the build log and the progress callback.
+func (o *nixOptions) stderr(buf *bytes.Buffer) io.Writer {
+	writers := []io.Writer{buf}
+	if o.Log != nil {
+		writers = append(writers, o.Log)
+	}
+	if o.Progress != nil {
+		writers = append(writers, &lineWriter{fn: o.Progress})
+	}
+	if len(writers) == 1 {
+		return buf
+	}
+	return io.MultiWriter(writers...)
+}
+
+// defaultNixBuildErrorLines is how much of the output of a failed build is
+// shown, see nix_build_error_lines
+const defaultNixBuildErrorLines = 20
+
+// nixFailedBuilderRegexp matches the derivation whose builder failed, and
+// nixDrvRegexp any derivation in case nix failed before building.
+// nixBuildingRegexp matches the line nix prints when it starts a build.
+var (
+	nixFailedBuilderRegexp = regexp.MustCompile(`builder for '(/nix/store/[^']+\.drv)' failed`)
+	nixDrvRegexp           = regexp.MustCompile(`/nix/store/[0-9a-z]{32}-[^'"\s]+\.drv`)
+	nixBuildingRegexp      = regexp.MustCompile(`^building '(/nix/store/[^']+\.drv)'`)
+)
+
+// buildingDerivation returns the derivation a line of nix output starts to
+// build. Other lines, like the build logs, aren't progress worth an event.
+func buildingDerivation(line string) (string, bool) {
+	match := nixBuildingRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// nixBuildError is a failed nix command. Its message only has the last
+// lines of the output, which is kept completely for the logs.
+type nixBuildError struct {
+	Args   []string
+	Output string
+	Err    error
+	Lines  int
+}
+
+// buildError returns the error for cmd failing with err and output.
+func (o *nixOptions) buildError(cmd *exec.Cmd, output string, err error) *nixBuildError {
+	lines := o.ErrorLines
+	if lines <= 0 {
+		lines = defaultNixBuildErrorLines
+	}
+	return &nixBuildError{Args: cmd.Args, Output: output, Err: err, Lines: lines}
+}
+
+func (e *nixBuildError) Error() string {
+	return fmt.Sprintf("%v failed: %s. Err: %v", e.Args, e.tail(), e.Err)
+}
+
+// tail returns the last Lines non-empty lines of the output.
+func (e *nixBuildError) tail() string {
+	var lines []string
+	for _, line := range strings.Split(e.Output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > e.Lines {
+		lines = append([]string{"..."}, lines[len(lines)-e.Lines:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// derivation returns the derivation that failed to build, if nix names one.
+func (e *nixBuildError) derivation() string {
+	if match := nixFailedBuilderRegexp.FindStringSubmatch(e.Output); match != nil {
+		return match[1]
+	}
+	return nixDrvRegexp.FindString(e.Output)
+}
+
+// lineWriter calls fn with every non-empty line written to it. A trailing
+// incomplete line is held back until it is completed.
+type lineWriter struct {
+	fn  func(line string)
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			w.fn(line)
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes the build log.
+func (o *nixOptions) Close() error {
+	if o == nil || o.Log == nil {
+		return nil
+	}
+	return o.Log.Close()
+}
+
+// nixOptions builds the options for the nix invocations of this task,
+// including credentials for private flake inputs. The credential files are
+// usually rendered into the secrets directory by a template stanza.
+func (c *MachineConfig) nixOptions(taskDir string) (*nixOptions, error) {
+	opts := &nixOptions{Settings: map[string]string{}, NixpkgsFlake: c.nixpkgsFlake, System: hostNixSystem()}
+
+	// flakes resolve their packages for the system nix builds for
+	if c.NixSystem != "" {
+		opts.System = c.NixSystem
+		opts.Settings["system"] = c.NixSystem
+	}
+
+	if c.NixSSHKey != "" {
+		key, err := secretFile(taskDir, c.NixSSHKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nix_ssh_key: %v", err)
+		}
+		opts.Env = append(opts.Env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", shellQuote(key)))
+	}
+
+	// the substituters of the plugin config replace the ones of nix.conf,
+	// e.g. cache.nixos.org
+	if len(c.substituters) > 0 {
+		opts.Settings["substituters"] = strings.Join(c.substituters, " ")
+	}
+	if len(c.trustedKeys) > 0 {
+		opts.Settings["trusted-public-keys"] = strings.Join(c.trustedKeys, " ")
+	}
+
+	if c.NixNetrc != "" {
+		netrc, err := secretFile(taskDir, c.NixNetrc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nix_netrc: %v", err)
+		}
+		opts.Settings["netrc-file"] = netrc
+	}
+
+	// a CA bundle of the task takes precedence over the one of the plugin
+	cert := c.hostSSLCertFile
+	if c.NixSSLCertFile != "" {
+		var err error
+		if cert, err = resolveTaskDirPath(taskDir, c.NixSSLCertFile); err != nil {
+			return nil, fmt.Errorf("invalid nix_ssl_cert_file: %v", err)
+		}
+		if err := regularFile(cert); err != nil {
+			return nil, fmt.Errorf("invalid nix_ssl_cert_file: %v", err)
+		}
+	}
+	if cert != "" {
+		opts.Env = append(opts.Env, "NIX_SSL_CERT_FILE="+cert)
+	}
+	opts.Env = append(opts.Env, proxyEnv(c.NixHTTPProxy, c.NixHTTPSProxy, c.NixNoProxy)...)
+
+	if c.NixBuildLog != "" {
+		log, err := openBuildLog(taskDir, c.NixBuildLog)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nix_build_log: %v", err)
+		}
+		opts.Log = log
+	}
+
+	return opts, nil
+}
+
+// proxyEnv returns the variables pointing nix and the git and curl it runs
+// to the given proxies. Both spellings are set, as tools disagree on which
+// one they read.
+func proxyEnv(httpProxy, httpsProxy, noProxy string) []string {
+	var env []string
+	for name, value := range map[string]string{
+		"http_proxy":  httpProxy,
+		"https_proxy": httpsProxy,
+		"no_proxy":    noProxy,
+	} {
+		if value != "" {
+			env = append(env, name+"="+value, strings.ToUpper(name)+"="+value)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// validProxyURL checks that a proxy is given as absolute URL.
+func validProxyURL(proxy string) bool {
+	u, err := url.Parse(proxy)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// regularFile checks that path exists and is a regular file.
+func regularFile(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	return nil
+}
+
+// openBuildLog opens the nix_build_log for appending, so the logs of earlier
+// starts of the task are kept. Its directory has to exist within the task
+// directory and the log itself may not be a symlink.
+func openBuildLog(taskDir, path string) (*os.File, error) {
+	dir, err := resolveTaskDirPath(taskDir, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(dir, filepath.Base(path)),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW, 0640)
+}
+
+// secretFile resolves path relative to the task directory and makes sure it
+// is a regular file in the secrets directory that isn't readable by everyone.
+// Files outside of it, like the credentials of the host, are refused.
+func secretFile(taskDir, path string) (string, error) {
+	clean := filepath.Clean(path)
+	if !strings.HasPrefix(clean, "secrets/") {
+		return "", fmt.Errorf("%s is not a path inside the secrets directory", path)
+	}
+
+	path, err := resolveTaskDirPath(filepath.Join(taskDir, "secrets"), strings.TrimPrefix(clean, "secrets/"))
+	if err != nil {
+		return "", err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	if stat.Mode().Perm()&0004 != 0 {
+		return "", fmt.Errorf("%s must not be world-readable", path)
+	}
+
+	return path, nil
+}
+
+// shellQuote quotes s for use as a single word in a shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (c *MachineConfig) prepareNixOS(dir string, opts *nixOptions) error {
+	if err := nixInstalled(); err != nil {
+		return err
+	}
+
+	var closure, toplevel string
+	var requisites []string
+	var err error
+	key := nixBuildKey("nixos", []string{c.NixOS}, opts)
+	if c.NixOSToplevel != "" {
+		toplevel = c.NixOSToplevel
+		if closure, err = nixPrebuiltNixOS(opts, toplevel, dir); err != nil {
+			return fmt.Errorf("Couldn't use prebuilt NixOS %s: %w", toplevel, err)
+		}
+	} else if cached := opts.cachedBuild(key, dir, "toplevel", "closure"); cached != nil {
+		toplevel, closure, requisites = cached.Paths["toplevel"], cached.Paths["closure"], cached.Requisites
+	} else if closure, toplevel, err = nixBuildNixOS(opts, c.NixOS); err != nil {
+		return fmt.Errorf("Build of the flake failed: %w", err)
+	} else if err := nixAddRoots(dir, map[string]string{"toplevel": toplevel, "closure": closure}); err != nil {
+		return fmt.Errorf("Couldn't register GC roots: %v", err)
+	}
+
+	if c.BindReadOnly == nil {
+		c.BindReadOnly = make(hclutils.MapStrStr)
+	}
+
+	c.BindReadOnly[toplevel] = toplevel
+	c.BindReadOnly[filepath.Join(closure, "registration")] = "/registration"
+	c.BindReadOnly[filepath.Join(toplevel, "init")] = "/init"
+	c.BindReadOnly[filepath.Join(toplevel, "sw")] = "/sw"
+
+	if requisites == nil {
+		if requisites, err = nixRequisites(closure); err != nil {
+			return fmt.Errorf("Couldn't determine flake requisites: %v", err)
+		}
+		if c.NixOS != "" {
+			opts.cacheBuild(key, []string{c.NixOS}, map[string]string{"toplevel": toplevel, "closure": closure}, requisites)
+		}
+	}
+
+	for _, requisite := range requisites {
+		c.BindReadOnly[requisite] = requisite
+	}
+
+	c.Directory = dir
+	c.createUsr()
+
+	if err := c.prepareUsers(dir); err != nil {
+		return err
+	}
+
+	if err := c.prepareMachineID(dir); err != nil {
+		return err
+	}
+
+	if len(c.Entrypoint)+len(c.Command) == 0 {
+		c.Command = []string{"/init"}
+	}
+
+	return nil
+}
+
+func (c *MachineConfig) prepareNixPackages(dir string, opts *nixOptions) error {
+	if err := nixInstalled(); err != nil {
+		return err
+	}
+
+	var profile, closure string
+	var requisites []string
+	key := nixBuildKey("packages", c.NixPackages, opts)
+	if cached := opts.cachedBuild(key, dir, "profile", "closure"); cached != nil {
+		profile, closure, requisites = cached.Paths["profile"], cached.Paths["closure"], cached.Requisites
+	} else {
+		var err error
+		profileLink := filepath.Join(dir, "current-profile")
+		if profile, err = nixBuildProfile(opts, c.NixPackages, profileLink); err != nil {
+			return fmt.Errorf("Build of the flakes failed: %w", err)
+		}
+
+		closureLink := filepath.Join(dir, "current-closure")
+		if closure, err = nixBuildClosure(opts, profileLink, closureLink); err != nil {
+			return fmt.Errorf("Build of the flakes failed: %w", err)
+		}
+	}
+
+	if c.BindReadOnly == nil {
+		c.BindReadOnly = make(hclutils.MapStrStr)
+	}
+
+	c.BindReadOnly[profile] = profile
+
+	if entries, err := os.ReadDir(profile); err != nil {
+		return fmt.Errorf("Couldn't read profile directory: %w", err)
+	} else {
+		for _, entry := range entries {
+			if name := entry.Name(); name != "etc" {
+				c.BindReadOnly[filepath.Join(profile, name)] = "/" + name
+				continue
+			}
+
+			etcEntries, err := os.ReadDir(filepath.Join(profile, "etc"))
+			if err != nil {
+				return fmt.Errorf("Couldn't read profile's /etc directory: %w", err)
+			}
+
+			for _, etcEntry := range etcEntries {
+				etcName := etcEntry.Name()
+				if etcName == "resolv.conf" {
+					// avoid interfering with the --resolv-conf flag
+					continue
+				}
+				if etcName == "machine-id" && c.HostMachineID {
+					continue
+				}
+				c.BindReadOnly[filepath.Join(profile, "etc", etcName)] = "/etc/" + etcName
+			}
+		}
+	}
+
+	c.BindReadOnly[filepath.Join(closure, "registration")] = "/registration"
+
+	if requisites == nil {
+		var err error
+		if requisites, err = nixRequisites(closure); err != nil {
+			return fmt.Errorf("Couldn't determine flake requisites: %v", err)
+		}
+		opts.cacheBuild(key, c.NixPackages, map[string]string{"profile": profile, "closure": closure}, requisites)
+	}
+
+	for _, requisite := range requisites {
+		c.BindReadOnly[requisite] = requisite
+	}
+
+	c.Directory = dir
+	c.createUsr()
+
+	if err := c.prepareUsers(dir); err != nil {
+		return err
+	}
+
+	if err := c.prepareHostname(dir); err != nil {
+		return err
+	}
+
+	if _, found := c.Environment["PATH"]; !found {
+		c.Environment["PATH"] = "/bin"
+	}
+
+	return nil
+}
+
+func (c *MachineConfig) prepareExtraStorePaths(dir string) error {
+	if c.BindReadOnly == nil {
+		c.BindReadOnly = make(hclutils.MapStrStr)
+	}
+
+	rootDir := filepath.Join(dir, "extra-store-paths")
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return fmt.Errorf("Couldn't create GC root directory: %w", err)
+	}
+
+	for _, path := range c.ExtraStorePaths {
+		if err := nixAddRoot(path, filepath.Join(rootDir, filepath.Base(path))); err != nil {
+			return fmt.Errorf("Couldn't register GC root for %s: %v", path, err)
+		}
+
+		requisites, err := nixRequisites(path)
+		if err != nil {
+			return fmt.Errorf("Couldn't determine requisites of %s: %v", path, err)
+		}
+
+		for _, requisite := range requisites {
+			c.BindReadOnly[requisite] = requisite
+		}
+	}
+
+	return nil
+}
+
+// validWritablePaths checks that writable_paths lists distinct absolute
+// paths below the root of the container.
+func validWritablePaths(paths []string) error {
+	seen := map[string]bool{}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) || filepath.Clean(p) != p || p == "/" {
+			return fmt.Errorf("writable_paths entry %q must be a clean absolute path below /", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("writable_paths entry %q is listed twice", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// prepareWritablePaths binds a directory of the task directory over each of
+// the writable_paths, so they can be written to on top of a read-only root.
+// Their content survives restarts of the task.
+func (c *MachineConfig) prepareWritablePaths(dir string) error {
+	if len(c.WritablePaths) == 0 {
+		return nil
+	}
+	if err := validWritablePaths(c.WritablePaths); err != nil {
+		return err
+	}
+
+	if c.Bind == nil {
+		c.Bind = make(hclutils.MapStrStr)
+	}
+	for _, p := range c.WritablePaths {
+		host := filepath.Join(dir, "writable", p)
+		if err := os.MkdirAll(host, 0755); err != nil {
+			return fmt.Errorf("Couldn't create writable path %s: %v", p, err)
+		}
+		if c.UserID > 0 {
+			if err := os.Chown(host, c.UserID, -1); err != nil {
+				return fmt.Errorf("Couldn't change owner of writable path %s: %v", p, err)
+			}
+		}
+		c.Bind[host] = p
+	}
+	return nil
+}
+
+// removeNixGCRoots removes the GC roots registered in the task directory, so
+// the store paths of a task that failed to start or was destroyed can be
+// collected.
+func removeNixGCRoots(dir string, logger hclog.Logger) {
+	roots, _ := filepath.Glob(filepath.Join(dir, "current-profile-*-link"))
+	roots = append(roots,
+		filepath.Join(dir, "current-profile"),
+		filepath.Join(dir, "current-closure"),
+		filepath.Join(dir, "current-toplevel"),
+		filepath.Join(dir, "extra-store-paths"),
+	)
+
+	for _, root := range roots {
+		if err := os.RemoveAll(root); err != nil {
+			logger.Error("failed to remove GC root", "path", root, "error", err)
+		}
+	}
+}
+
+// defaultUserID is used for users generated without a user_id
+const defaultUserID = 1000
+
+// prepareUsers makes sure the user the container runs as exists in the
+// assembled rootfs. Unless the profile provides an /etc/passwd, minimal
+// passwd and group files with root and the user are generated.
+func (c *MachineConfig) prepareUsers(dir string) error {
+	if c.User == "" {
+		return nil
+	}
+
+	passwd := ""
+	for host, guest := range c.BindReadOnly {
+		if guest == "/etc/passwd" {
+			passwd = host
+		}
+	}
+
+	if passwd == "" {
+		passwd = filepath.Join(dir, "etc", "passwd")
+		if err := writeUserDB(filepath.Join(dir, "etc"), c.User, c.UserID); err != nil {
+			return fmt.Errorf("Couldn't create user database: %v", err)
+		}
+	}
+
+	found, err := passwdHasUser(passwd, c.User)
+	if err != nil {
+		return fmt.Errorf("Couldn't read user database: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("user %q is not defined in the container's /etc/passwd", c.User)
+	}
+
+	return nil
+}
+
+// prepareMachineID makes sure the assembled rootfs has an /etc/machine-id,
+// which systemd needs to boot. Unless the profile provides one, it is
+// derived from the machine name, so it stays the same across restarts of the
+// task, and nspawn is told to use the same id.
+func (c *MachineConfig) prepareMachineID(dir string) error {
+	for _, guest := range c.BindReadOnly {
+		if guest == "/etc/machine-id" {
+			return nil
+		}
+	}
+
+	c.machineID = machineID(c.Machine)
+
+	etc := filepath.Join(dir, "etc")
+	if err := os.MkdirAll(etc, 0755); err != nil {
+		return fmt.Errorf("Couldn't create /etc: %v", err)
+	}
+	path := filepath.Join(etc, "machine-id")
+	// left read-only by an earlier start of the task
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Couldn't replace machine-id: %v", err)
 	}
+	if err := ioutil.WriteFile(path, []byte(c.machineID+"\n"), 0444); err != nil {
+		return fmt.Errorf("Couldn't write machine-id: %v", err)
+	}
+
+	written, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(written)) != c.machineID {
+		return fmt.Errorf("Couldn't write machine-id: %s does not contain %s", path, c.machineID)
+	}
+	return nil
 }
 
-var machineConn *machine1.Conn
-var machineConnM = sync.Mutex{}
+// resolveBindSources replaces bind sources that are symlinks by the paths
+// they point to. nspawn follows them itself, but fails with confusing mount
+// errors for dangling links. Sources relative to the container, marked with
+// a leading "+", and empty ones, which nspawn creates itself, are left alone.
+func (c *MachineConfig) resolveBindSources() error {
+	for _, binds := range []hclutils.MapStrStr{c.Bind, c.BindReadOnly} {
+		resolved := make(hclutils.MapStrStr, len(binds))
+		for host, guest := range binds {
+			source := host
+			if host != "" && !strings.HasPrefix(host, "+") {
+				if !filepath.IsAbs(host) {
+					return fmt.Errorf("bind source %s must be an absolute path", host)
+				}
+				real, err := filepath.EvalSymlinks(host)
+				if err != nil {
+					return fmt.Errorf("invalid bind source %s: %v", host, err)
+				}
+				source = real
+			}
+			if other, ok := resolved[source]; ok {
+				return fmt.Errorf("bind sources for %s and %s both resolve to %s", other, guest, source)
+			}
+			resolved[source] = guest
+		}
 
-func DescribeMachine(name string, timeout time.Duration) (*MachineProps, error) {
-	machineConnM.Lock()
-	defer machineConnM.Unlock()
+		for host := range binds {
+			delete(binds, host)
+		}
+		for host, guest := range resolved {
+			binds[host] = guest
+		}
+	}
+	return nil
+}
 
-	if machineConn == nil {
+// overlayArg returns the --overlay or --overlay-ro argument for an overlay
+// with the colon-separated lower directories, the upper directory and the
+// target in the container. An empty upper directory makes nspawn use a
+// temporary one; read-only overlays have none.
+func overlayArg(o map[string]string, readOnly bool) string {
+	parts := []string{o["lower"]}
+	if !readOnly {
+		parts = append(parts, o["upper"])
+	}
+	return strings.Join(append(parts, o["target"]), ":")
+}
+
+// validOverlay checks an overlay has lower directories and a target. Host
+// paths must be absolute, paths prefixed with + are relative to the root of
+// the container.
+func validOverlay(o map[string]string, readOnly bool) error {
+	for key := range o {
+		switch key {
+		case "lower", "target":
+		case "upper":
+			if readOnly {
+				return fmt.Errorf("read-only overlays have no upper directory")
+			}
+		default:
+			return fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	if o["lower"] == "" {
+		return fmt.Errorf("missing lower directory")
+	}
+	if !filepath.IsAbs(o["target"]) {
+		return fmt.Errorf("target must be an absolute path")
+	}
+
+	dirs := strings.Split(o["lower"], ":")
+	if o["upper"] != "" {
+		dirs = append(dirs, o["upper"])
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) && !strings.HasPrefix(dir, "+") {
+			return fmt.Errorf("%q must be an absolute path or start with +", dir)
+		}
+	}
+	return nil
+}
+
+// taskDirMountFlags returns the mount flags of task_dir_mount_options.
+func taskDirMountFlags(options []string) (uintptr, error) {
+	var flags uintptr
+	for _, o := range options {
+		switch o {
+		case "nosuid":
+			flags |= syscall.MS_NOSUID
+		case "nodev":
+			flags |= syscall.MS_NODEV
+		case "noexec":
+			flags |= syscall.MS_NOEXEC
+		default:
+			return 0, fmt.Errorf("invalid parameter for task_dir_mount_options: %q", o)
+		}
+	}
+	return flags, nil
+}
+
+// taskDirMountsDir is where the task directories are mounted with the flags
+// of task_dir_mount_options.
+func taskDirMountsDir(taskDir string) string {
+	return filepath.Join(taskDir, ".task-dir-mounts")
+}
+
+// restrictTaskDirs replaces the binds of the task directories with mounts of
+// them carrying the flags of task_dir_mount_options. nspawn's bind options
+// can't set mount flags, but bind mounts inherit the flags of their source.
+func (c *MachineConfig) restrictTaskDirs(taskDir string, dirs map[string]string) error {
+	flags, err := taskDirMountFlags(c.TaskDirMountOptions)
+	if err != nil {
+		return err
+	}
+
+	for name, source := range dirs {
+		guest, ok := c.Bind[source]
+		if !ok {
+			continue
+		}
+
+		target := filepath.Join(taskDirMountsDir(taskDir), name)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("Couldn't create mount point for %s: %v", name, err)
+		}
+		if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("Couldn't mount %s: %v", name, err)
+		}
+		if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, ""); err != nil {
+			return fmt.Errorf("Couldn't set mount options of %s: %v", name, err)
+		}
+
+		delete(c.Bind, source)
+		c.Bind[target] = guest
+	}
+	return nil
+}
+
+// unmountTaskDirs removes the mounts of restrictTaskDirs, which would keep
+// Nomad from removing the task directory.
+func unmountTaskDirs(taskDir string) error {
+	dir := taskDirMountsDir(taskDir)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		err := syscall.Unmount(filepath.Join(dir, e.Name()), syscall.MNT_DETACH)
+		if err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("failed to unmount %s: %v", e.Name(), err)
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// hostname returns the hostname nspawn sets for the container.
+func (c *MachineConfig) hostname() string {
+	if c.Hostname != "" {
+		return c.Hostname
+	}
+	return c.Machine
+}
+
+// prepareHostname writes /etc/hostname and an /etc/hosts resolving the
+// hostname to 127.0.1.1, the way Debian does, into the assembled rootfs, so
+// apps looking up their own hostname succeed. Files provided by the profile
+// are kept. NixOS manages both files itself on boot.
+func (c *MachineConfig) prepareHostname(dir string) error {
+	hostname := c.hostname()
+	files := map[string]string{
+		"hostname": hostname + "\n",
+		"hosts":    fmt.Sprintf("127.0.0.1\tlocalhost\n::1\tlocalhost\n127.0.1.1\t%s\n", hostname),
+	}
+
+	etc := filepath.Join(dir, "etc")
+	if err := os.MkdirAll(etc, 0755); err != nil {
+		return fmt.Errorf("Couldn't create /etc: %v", err)
+	}
+
+outer:
+	for name, content := range files {
+		for _, guest := range c.BindReadOnly {
+			if guest == "/etc/"+name {
+				continue outer
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(etc, name), []byte(content), 0644); err != nil {
+			return fmt.Errorf("Couldn't write /etc/%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// dnsOverTLSConf is the drop-in of systemd-resolved written for dns_over_tls.
+const dnsOverTLSConf = "/etc/systemd/resolved.conf.d/nomad-dns-over-tls.conf"
+
+// prepareDNSOverTLS writes a systemd-resolved drop-in sending all queries to
+// the resolvers of dns_over_tls, and binds it read-only into the container.
+// Queries are never sent unencrypted, so DNS fails instead of leaking if the
+// resolvers can't be reached.
+func (c *MachineConfig) prepareDNSOverTLS(dir string) error {
+	conf := fmt.Sprintf("[Resolve]\nDNS=%s\nDNSOverTLS=yes\nDomains=~.\nFallbackDNS=\nLLMNR=no\nMulticastDNS=no\n",
+		strings.Join(c.DNSOverTLS, " "))
+
+	path := filepath.Join(dir, "dns-over-tls.conf")
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("Couldn't write resolved configuration: %v", err)
+	}
+
+	if c.BindReadOnly == nil {
+		c.BindReadOnly = make(hclutils.MapStrStr)
+	}
+	c.BindReadOnly[path] = dnsOverTLSConf
+	return nil
+}
+
+// validDNSOverTLSResolver checks a resolver in the ADDRESS[:PORT]#SERVERNAME
+// syntax of systemd-resolved. The server name is required, as the
+// certificate of the resolver can't be verified without it.
+func validDNSOverTLSResolver(resolver string) error {
+	i := strings.LastIndex(resolver, "#")
+	if i < 0 || i == len(resolver)-1 {
+		return fmt.Errorf("missing server name to verify the resolver's certificate, e.g. 1.1.1.1#cloudflare-dns.com")
+	}
+	address, name := resolver[:i], resolver[i+1:]
+	if strings.ContainsAny(name, " \t\n#") {
+		return fmt.Errorf("invalid server name")
+	}
+
+	host, port := address, ""
+	if strings.HasPrefix(address, "[") || strings.Count(address, ":") == 1 {
 		var err error
-		machineConn, err = machine1.New()
+		if host, port, err = net.SplitHostPort(address); err != nil {
+			return err
+		}
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not an IP address", host)
+	}
+	if port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return nil
+}
+
+// credentialIDRegexp matches the credential names systemd accepts, which
+// are used as file names in $CREDENTIALS_DIRECTORY.
+var credentialIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// validCredential checks a credential has a valid id and the key holding its
+// path or value.
+func validCredential(cred map[string]string, valueKey string) error {
+	for key := range cred {
+		if key != "id" && key != valueKey {
+			return fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if id := cred["id"]; !credentialIDRegexp.MatchString(id) || id == "." || id == ".." {
+		return fmt.Errorf("invalid id %q", id)
+	}
+	if _, ok := cred[valueKey]; !ok {
+		return fmt.Errorf("missing %s", valueKey)
+	}
+	return nil
+}
+
+// prepareCredentials resolves the paths of load_credential, which have to be
+// in the secrets directory of the task, where templates render secrets.
+func (c *MachineConfig) prepareCredentials(taskDir string) error {
+	for i, cred := range c.LoadCredential {
+		path, err := secretFile(taskDir, cred["path"])
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("Couldn't load credential %s: %v", cred["id"], err)
+		}
+		c.LoadCredential[i] = map[string]string{"id": cred["id"], "path": path}
+	}
+	return nil
+}
+
+// redacted returns a copy of the config that is safe to log, with the values
+// of environment variables and credentials and the passwords in URLs
+// replaced. The environment holds everything Nomad passes to the task,
+// including secrets from Vault.
+func (c MachineConfig) redacted() MachineConfig {
+	if len(c.Environment) > 0 {
+		env := make(hclutils.MapStrStr, len(c.Environment))
+		for name := range c.Environment {
+			env[name] = "<redacted>"
+		}
+		c.Environment = env
+	}
+	if len(c.SetCredential) > 0 {
+		creds := make([]map[string]string, len(c.SetCredential))
+		for i, cred := range c.SetCredential {
+			creds[i] = map[string]string{"id": cred["id"], "value": "<redacted>"}
+		}
+		c.SetCredential = creds
+	}
+	if c.ImageDownload != nil {
+		download := *c.ImageDownload
+		download.URL = redactURL(download.URL)
+		download.Mirrors = make([]string, len(c.ImageDownload.Mirrors))
+		for i, mirror := range c.ImageDownload.Mirrors {
+			download.Mirrors[i] = redactURL(mirror)
 		}
+		c.ImageDownload = &download
 	}
+	c.NixHTTPProxy = redactURL(c.NixHTTPProxy)
+	c.NixHTTPSProxy = redactURL(c.NixHTTPSProxy)
+	return c
+}
+
+// String formats the config for logs, without secrets.
+func (c *MachineConfig) String() string {
+	return fmt.Sprintf("%+v", c.redacted())
+}
+
+// redactURL replaces the password in a URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+	return u.String()
+}
+
+// hostMachineIDPath is the machine-id of the host bound by host_machine_id.
+const hostMachineIDPath = "/etc/machine-id"
+
+// prepareHostMachineID binds the machine-id of the host read-only into the
+// container and tells nspawn to use it, so its journal entries are
+// attributed to the host. The id is no longer derived from the machine name.
+func (c *MachineConfig) prepareHostMachineID(path string) error {
+	for _, binds := range []hclutils.MapStrStr{c.Bind, c.BindReadOnly} {
+		for _, guest := range binds {
+			if guest == "/etc/machine-id" {
+				return fmt.Errorf("host_machine_id and a bind of /etc/machine-id may not be combined")
+			}
+		}
+	}
+
+	id, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read host machine-id: %v", err)
+	}
+	c.machineID = strings.TrimSpace(string(id))
+	if _, err := hex.DecodeString(c.machineID); err != nil || len(c.machineID) != 32 {
+		return fmt.Errorf("Couldn't read host machine-id: %s is not a valid machine-id", path)
+	}
+
+	if c.BindReadOnly == nil {
+		c.BindReadOnly = make(hclutils.MapStrStr)
+	}
+	c.BindReadOnly[path] = "/etc/machine-id"
+	return nil
+}
+
+// machineID derives a machine id from the machine name, formatted like the
+// random v4 UUIDs systemd generates.
+func machineID(machine string) string {
+	sum := sha256.Sum256([]byte(machine))
+	id := sum[:16]
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return hex.EncodeToString(id)
+}
+
+// writeUserDB writes passwd and group files defining root and the given user,
+// which is either a name or a numeric uid.
+func writeUserDB(etc, user string, uid int) error {
+	name := user
+	if id, err := strconv.Atoi(user); err == nil {
+		name = "nomad"
+		uid = id
+	} else if uid == 0 {
+		uid = defaultUserID
+	}
+
+	passwd := "root:x:0:0:root:/root:/bin/sh\n"
+	group := "root:x:0:\n"
+	if name != "root" && uid != 0 {
+		passwd += fmt.Sprintf("%s:x:%d:%d::/var/empty:/bin/sh\n", name, uid, uid)
+		group += fmt.Sprintf("%s:x:%d:\n", name, uid)
+	}
+
+	if err := os.MkdirAll(etc, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(etc, "passwd"), []byte(passwd), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(etc, "group"), []byte(group), 0644)
+}
+
+// passwdHasUser looks for user, a name or numeric uid, in a passwd file.
+func passwdHasUser(path, user string) (bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if fields[0] == user || fields[2] == user {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// passwdLookup returns the uid and gid of user, a name or numeric uid, from
+// a passwd file.
+func passwdLookup(path, user string) (string, string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[0] == user || fields[2] == user {
+			return fields[2], fields[3], nil
+		}
+	}
+	return "", "", fmt.Errorf("user %q is not defined in %s", user, path)
+}
+
+func (c *MachineConfig) createUsr() {
+	needUsr := true
+	for _, guestDir := range c.BindReadOnly {
+		if strings.HasPrefix("/usr/", guestDir) {
+			needUsr = false
+			break
+		}
+	}
+
+	if needUsr {
+		os.MkdirAll(filepath.Join(c.Directory, "usr"), 0777)
+	}
+}
+
+var machineConn *machine1.Conn
+var machineConnM = sync.Mutex{}
+
+// errMachineExited is returned by WaitForMachine if systemd-nspawn exited
+// before the machine was registered.
+var errMachineExited = fmt.Errorf("systemd-nspawn exited before the machine was registered")
+
+func DescribeMachine(name string, timeout time.Duration) (*MachineProps, error) {
+	return WaitForMachine(name, timeout, nil)
+}
+
+// WaitForMachine retries describing the machine until it's registered with
+// machined. It gives up once the timeout expires or exited is closed.
+func WaitForMachine(name string, timeout time.Duration, exited <-chan struct{}) (*MachineProps, error) {
+	if err := connectMachined(); err != nil {
+		return nil, err
+	}
+
+	return pollMachine(func() (*MachineProps, error) {
+		return describeMachine(name)
+	}, timeout, exited)
+}
 
+func pollMachine(describe func() (*MachineProps, error), timeout time.Duration, exited <-chan struct{}) (*MachineProps, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	for {
+		if p, err := describe(); err == nil {
+			return p, nil
+		}
+
 		select {
 		case <-ctx.Done():
 			return nil, fmt.Errorf("timed out while getting machine properties")
-		default:
-			if p, err := machineConn.DescribeMachine(name); err == nil {
-				return &MachineProps{
-					Name:               p["Name"].(string),
-					TimestampMonotonic: p["TimestampMonotonic"].(uint64),
-					Timestamp:          p["Timestamp"].(uint64),
-					NetworkInterfaces:  p["NetworkInterfaces"].([]int32),
-					ID:                 p["Id"].([]uint8),
-					Class:              p["Class"].(string),
-					Leader:             p["Leader"].(uint32),
-					RootDirectory:      p["RootDirectory"].(string),
-					Service:            p["Service"].(string),
-					State:              p["State"].(string),
-					Unit:               p["Unit"].(string),
-				}, nil
-			} else {
-				time.Sleep(10 * time.Millisecond)
+		case <-exited:
+			return nil, errMachineExited
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// unitState returns the state of a unit in a booted machine as reported by
+// `systemctl is-active`, e.g. "activating" or "active".
+func unitState(machine, unit string) (string, error) {
+	out, err := exec.Command("systemctl", "--machine", machine, "is-active", unit).Output()
+	state := strings.TrimSpace(string(out))
+	// is-active fails for all states but active, it's only an error
+	// if no state was printed
+	if state == "" && err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// waitForUnit polls the state of a unit every interval until it is active.
+// It fails if the unit failed, the context is done or exited is closed.
+func waitForUnit(ctx context.Context, unit string, state func() (string, error), exited <-chan struct{}, interval time.Duration) error {
+	last := ""
+	for {
+		s, err := state()
+		if err == nil {
+			switch s {
+			case "active":
+				return nil
+			case "failed":
+				return fmt.Errorf("unit %s failed", unit)
 			}
+			last = s
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("unit %s did not become active, last state %q: %v", unit, last, ctx.Err())
+		case <-exited:
+			return fmt.Errorf("systemd-nspawn exited before unit %s became active", unit)
+		case <-time.After(interval):
 		}
 	}
 }
 
-func ConfigureIPTablesRules(delete bool, interfaces []string) error {
-	if len(interfaces) == 0 {
-		return fmt.Errorf("no network interfaces configured")
+func connectMachined() error {
+	machineConnM.Lock()
+	defer machineConnM.Unlock()
+
+	if machineConn == nil {
+		var err error
+		machineConn, err = machine1.New()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func describeMachine(name string) (*MachineProps, error) {
+	machineConnM.Lock()
+	defer machineConnM.Unlock()
 
-	table, err := iptables.New()
+	p, err := machineConn.DescribeMachine(name)
 	if err != nil {
+		return nil, err
+	}
+
+	return &MachineProps{
+		Name:               p["Name"].(string),
+		TimestampMonotonic: p["TimestampMonotonic"].(uint64),
+		Timestamp:          p["Timestamp"].(uint64),
+		NetworkInterfaces:  p["NetworkInterfaces"].([]int32),
+		ID:                 p["Id"].([]uint8),
+		Class:              p["Class"].(string),
+		Leader:             p["Leader"].(uint32),
+		RootDirectory:      p["RootDirectory"].(string),
+		Service:            p["Service"].(string),
+		State:              p["State"].(string),
+		Unit:               p["Unit"].(string),
+	}, nil
+}
+
+// KillMachine sends signal to all processes of a machine.
+func KillMachine(name string, signal syscall.Signal) error {
+	if err := connectMachined(); err != nil {
+		return err
+	}
+
+	machineConnM.Lock()
+	defer machineConnM.Unlock()
+
+	return machineConn.KillMachine(name, "all", signal)
+}
+
+// SignalMachineLeader sends signal to the leader of a machine, its init
+// process if it's booted.
+func SignalMachineLeader(name string, signal syscall.Signal) error {
+	if err := connectMachined(); err != nil {
+		return err
+	}
+
+	machineConnM.Lock()
+	defer machineConnM.Unlock()
+
+	return machineConn.KillMachine(name, "leader", signal)
+}
+
+// WaitForMachineGone waits until the machine is no longer registered with
+// machined. It reports false if it's still there once the timeout expires.
+func WaitForMachineGone(name string, timeout time.Duration) bool {
+	if err := connectMachined(); err != nil {
+		return false
+	}
+
+	return pollMachineGone(func() error {
+		_, err := describeMachine(name)
 		return err
-	}
+	}, timeout, time.Second)
+}
+
+func pollMachineGone(describe func() error, timeout, interval time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	for _, i := range interfaces {
-		rules := [][]string{
-			{"-o", i, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
-			{"-i", i, "!", "-o", i, "-j", "ACCEPT"},
-			{"-i", i, "-o", i, "-j", "ACCEPT"},
+	for {
+		if err := describe(); err != nil {
+			return true
 		}
 
-		for _, r := range rules {
-			switch ok, err := table.Exists("filter", "FORWARD", r...); {
-			case err == nil && !ok:
-				err := table.Append("filter", "FORWARD", r...)
-				if err != nil {
-					return err
-				}
-			case err == nil && ok && delete:
-				err := table.Delete("filter", "FORWARD", r...)
-				if err != nil {
-					return err
-				}
-			case err != nil:
-				return err
-			}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(interval):
 		}
 	}
+}
 
-	return nil
+// attributes returns the properties of the machine shown as driver
+// attributes of the task.
+func (p *MachineProps) attributes() map[string]string {
+	return map[string]string{
+		"machine_state":          p.State,
+		"machine_leader":         strconv.FormatUint(uint64(p.Leader), 10),
+		"machine_root_directory": p.RootDirectory,
+		"machine_class":          p.Class,
+	}
 }
 
 func (p *MachineProps) GetNetworkInterfaces() ([]string, error) {
@@ -564,7 +3130,7 @@ func MachineAddresses(name string, timeout time.Duration) (*MachineAddrs, error)
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, fmt.Errorf("timed out while getting machine addresses: %+v", result.Err)
+			return nil, errNoMachineAddress
 		default:
 			result = obj.Call(fmt.Sprintf("%s.%s", dbusInterface, "GetMachineAddresses"), 0, name)
 			if result.Err != nil {
@@ -596,6 +3162,62 @@ func MachineAddresses(name string, timeout time.Duration) (*MachineAddrs, error)
 	}
 }
 
+// errNoMachineAddress is returned by MachineAddresses if machined reported no
+// address before the timeout.
+var errNoMachineAddress = fmt.Errorf("timed out while getting machine addresses")
+
+// namespaceAddresses reads the addresses of the network namespace of the
+// machine's leader from the local routes in /proc/<leader>/net/fib_trie. It
+// is the fallback for machined not reporting an address, e.g. if the
+// container configured its interface in a way machined didn't pick up.
+func namespaceAddresses(procDir string, leader uint32) (*MachineAddrs, error) {
+	f, err := os.Open(filepath.Join(procDir, strconv.FormatUint(uint64(leader), 10), "net", "fib_trie"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// addresses are followed by the routes to them, "/32 host LOCAL"
+	// marks the addresses of local interfaces
+	var last net.IP
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(strings.TrimLeft(s.Text(), " |+-"))
+		if len(fields) == 1 {
+			last = net.ParseIP(fields[0]).To4()
+			continue
+		}
+		if len(fields) == 3 && fields[0] == "/32" && fields[2] == "LOCAL" && last != nil &&
+			!last.IsLoopback() && !last.IsLinkLocalUnicast() {
+			return &MachineAddrs{IPv4: last}, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no address found in the network namespace of %d", leader)
+}
+
+// hostResolvConf is the resolv.conf of the host
+var hostResolvConf = "/etc/resolv.conf"
+
+// isResolvedActive reports whether the resolv.conf at path delegates to the
+// systemd-resolved stub listener.
+func isResolvedActive(path string) bool {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && fields[1] == "127.0.0.53" {
+			return true
+		}
+	}
+	return false
+}
+
 func isInstalled() error {
 	_, err := exec.LookPath("systemd-nspawn")
 	if err != nil {
@@ -608,6 +3230,15 @@ func isInstalled() error {
 	return nil
 }
 
+// nixInstalled checks for the nix binary that tasks with nixos,
+// nixos_toplevel or packages are built with.
+func nixInstalled() error {
+	if _, err := exec.LookPath("nix"); err != nil {
+		return fmt.Errorf("nix is not installed on this node, it must be installed to run tasks with nixos, nixos_toplevel or packages: %v", err)
+	}
+	return nil
+}
+
 // systemdVersion uses dbus to check which version of systemd is installed.
 func systemdVersion() (string, error) {
 	// check if systemd is running
@@ -634,6 +3265,16 @@ func systemdVersion() (string, error) {
 	return verNum, nil
 }
 
+// parseNixVersion extracts the version from the output of nix --version,
+// like "nix (Nix) 2.4".
+func parseNixVersion(out string) (string, error) {
+	fields := strings.Fields(out)
+	if len(fields) < 3 || fields[0] != "nix" {
+		return "", fmt.Errorf("unexpected output of nix --version: %q", out)
+	}
+	return fields[len(fields)-1], nil
+}
+
 func setupPrivateSystemBus() (conn *dbus.Conn, err error) {
 	conn, err = dbus.SystemBusPrivate()
 	if err != nil {
@@ -691,13 +3332,79 @@ func DescribeImage(name string) (*ImageProps, error) {
 	}, nil
 }
 
-func nixBuildProfile(flakes []string, link string) (string, error) {
-	cmd := exec.Command("nix", append([]string{"profile", "install", "--no-write-lock-file", "--profile", link}, flakes...)...)
+// RemoveImage removes an image known to machinectl.
+func RemoveImage(name string) error {
+	dbusConnM.Lock()
+	defer dbusConnM.Unlock()
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+
+	obj := conn.Object("org.freedesktop.machine1", "/org/freedesktop/machine1")
+	return obj.Call("org.freedesktop.machine1.Manager.RemoveImage", 0, name).Err
+}
+
+// CloneImage creates a writable copy of an image known to machinectl. For
+// btrfs subvolumes this is a cheap snapshot.
+func CloneImage(name, newName string) error {
+	dbusConnM.Lock()
+	defer dbusConnM.Unlock()
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+
+	obj := conn.Object("org.freedesktop.machine1", "/org/freedesktop/machine1")
+	return obj.Call("org.freedesktop.machine1.Manager.CloneImage", 0, name, newName, false).Err
+}
+
+// diskQuotaBytes converts the disk_quota in MiB to bytes.
+func diskQuotaBytes(mib int) uint64 {
+	return uint64(mib) * 1024 * 1024
+}
+
+// SetImageLimit sets the disk quota of an image known to machinectl. Only
+// images stored as btrfs subvolumes support quotas.
+func SetImageLimit(name string, limit uint64) error {
+	image, err := DescribeImage(name)
+	if err != nil {
+		return err
+	}
+
+	if image.Type != "subvolume" {
+		return fmt.Errorf("image %q is of type %q, quotas require a btrfs subvolume", name, image.Type)
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(image.Path, &stat); err != nil {
+		return err
+	}
+	if uint32(stat.Type) != btrfsSuperMagic {
+		return fmt.Errorf("image %q is not stored on btrfs, quotas are not supported", name)
+	}
+
+	dbusConnM.Lock()
+	defer dbusConnM.Unlock()
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+
+	obj := conn.Object("org.freedesktop.machine1", "/org/freedesktop/machine1")
+	return obj.Call("org.freedesktop.machine1.Manager.SetImageLimit", 0, name, limit).Err
+}
+
+func nixBuildProfile(opts *nixOptions, flakes []string, link string) (string, error) {
+	cmd := opts.command(append([]string{"profile", "install", "--no-write-lock-file", "--profile", link}, flakes...)...)
 	stderr := &bytes.Buffer{}
-	cmd.Stderr = stderr
+	cmd.Stderr = opts.stderr(stderr)
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("%v failed: %s. Err: %v", cmd.Args, stderr.String(), err)
+		return "", opts.buildError(cmd, stderr.String(), err)
 	}
 
 	if target, err := os.Readlink(link); err == nil {
@@ -707,56 +3414,142 @@ func nixBuildProfile(flakes []string, link string) (string, error) {
 	}
 }
 
-func nixBuildClosure(profile string, link string) (string, error) {
-	cmd := exec.Command(
-		"nix", "build",
+func nixBuildClosure(opts *nixOptions, profile string, link string) (string, error) {
+	nixpkgs := opts.NixpkgsFlake
+	if nixpkgs == "" {
+		nixpkgs = DefaultNixpkgsFlake
+	}
+	system := opts.System
+	if system == "" {
+		system = hostNixSystem()
+	}
+
+	cmd := opts.command(
+		"build",
 		"--out-link", link,
 		"--expr", closureNix,
 		"--impure",
 		"--no-write-lock-file",
-		"--argstr", "path", profile)
+		"--argstr", "path", profile,
+		"--argstr", "nixpkgsFlake", nixpkgs,
+		"--argstr", "system", system)
 
 	stderr := &bytes.Buffer{}
-	cmd.Stderr = stderr
+	cmd.Stderr = opts.stderr(stderr)
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("%v failed: %s. Err: %v", cmd.Args, stderr.String(), err)
+		return "", opts.buildError(cmd, stderr.String(), err)
 	}
 
 	return os.Readlink(link)
 }
 
-func nixBuildNixOS(flakePrefix string) (string, string, error) {
+func nixBuildNixOS(opts *nixOptions, flakePrefix string) (string, string, error) {
 	nixos := fmt.Sprintf("%s.config.system.build", flakePrefix)
-	closurePath, err := nixBuild(nixos + ".closure")
+	closurePath, err := nixBuild(opts, nixos+".closure")
 	if err != nil {
-		return "", "", fmt.Errorf("buildClosure failed: %v", err)
+		return "", "", fmt.Errorf("buildClosure failed: %w", err)
 	}
 
-	toplevelPath, err := nixBuild(nixos + ".toplevel")
+	toplevelPath, err := nixBuild(opts, nixos+".toplevel")
 	if err != nil {
-		return "", "", fmt.Errorf("buildToplevel failed: %v", err)
+		return "", "", fmt.Errorf("buildToplevel failed: %w", err)
 	}
 
 	return closurePath, toplevelPath, nil
 }
 
+// nixPrebuiltNixOS realises a NixOS toplevel built elsewhere, e.g. by CI, and
+// registers GC roots for it and the closure info built for it, which it
+// returns.
+func nixPrebuiltNixOS(opts *nixOptions, toplevel string, dir string) (string, error) {
+	if !storePathRegexp.MatchString(toplevel) {
+		return "", fmt.Errorf("not a valid store path")
+	}
+
+	if err := nixAddRoot(toplevel, filepath.Join(dir, "current-toplevel")); err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(toplevel, "init")); err != nil {
+		return "", fmt.Errorf("%s is not a NixOS system: %v", toplevel, err)
+	}
+
+	return nixBuildClosure(opts, toplevel, filepath.Join(dir, "current-closure"))
+}
+
+// nixAddRoots registers GC roots named current-NAME in the task directory
+// for the store paths by name.
+func nixAddRoots(dir string, paths map[string]string) error {
+	for name, path := range paths {
+		if err := nixAddRoot(path, filepath.Join(dir, "current-"+name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedBuild returns the build of another task for key, with GC roots for
+// the named paths registered in the task directory, or nil if there is none
+// to reuse.
+func (o *nixOptions) cachedBuild(key, dir string, names ...string) *nixBuildCacheEntry {
+	entry := o.Cache.Get(key)
+	if entry == nil {
+		return nil
+	}
+	paths := map[string]string{}
+	for _, name := range names {
+		if entry.Paths[name] == "" {
+			return nil
+		}
+		paths[name] = entry.Paths[name]
+	}
+	// the task that built them may be gone along with its roots
+	if err := nixAddRoots(dir, paths); err != nil {
+		return nil
+	}
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, "reusing build from %s\n", entry.BuiltAt.Format(time.RFC3339))
+	}
+	return entry
+}
+
+// cacheBuild offers the build to other tasks. The cache is best effort, a
+// failure to write it only means the next task builds again.
+func (o *nixOptions) cacheBuild(key string, flakes []string, paths map[string]string, requisites []string) {
+	o.Cache.Put(key, &nixBuildCacheEntry{Flakes: flakes, Paths: paths, Requisites: requisites})
+}
+
+// nixAddRoot realises the store path and registers an indirect GC root for it
+// at link, so it stays alive for as long as the task directory exists.
+func nixAddRoot(path string, link string) error {
+	cmd := exec.Command("nix-store", "--realise", path, "--add-root", link, "--indirect")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v failed: %s. Err: %v", cmd.Args, stderr.String(), err)
+	}
+
+	return nil
+}
+
 type nixBuildResult struct {
 	DrvPath string
 	Outputs map[string]string
 }
 
-func nixBuild(flake string) (string, error) {
-	cmd := exec.Command("nix", "build", "--no-link", "--no-write-lock-file", "--json", flake)
+func nixBuild(opts *nixOptions, flake string) (string, error) {
+	cmd := opts.command("build", "--no-link", "--no-write-lock-file", "--json", flake)
 
 	stdout := &bytes.Buffer{}
 	cmd.Stdout = stdout
 
 	stderr := &bytes.Buffer{}
-	cmd.Stderr = stderr
+	cmd.Stderr = opts.stderr(stderr)
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("%v failed: %s. Err: %v", cmd.Args, stderr.String(), err)
+		return "", opts.buildError(cmd, stderr.String(), err)
 	}
 
 	result := []*nixBuildResult{}
@@ -803,26 +3596,58 @@ func nixRequisites(path string) ([]string, error) {
 	return requisites, nil
 }
 
-func DownloadImage(url, name, verify, imageType string, force bool, logger hclog.Logger) error {
+// imageURLAllowed reports whether rawURL lies below one of the allowed
+// prefixes. Scheme and host have to match exactly and path prefixes only
+// match whole path segments of the cleaned path, so "https://example.com/images" doesn't allow
+// "https://example.com.evil/images" or "https://example.com/images-evil".
+// Without prefixes every URL is allowed.
+func imageURLAllowed(allowed []string, rawURL string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range allowed {
+		p, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if !strings.EqualFold(u.Scheme, p.Scheme) || !strings.EqualFold(u.Host, p.Host) {
+			continue
+		}
+		dir := strings.TrimSuffix(p.Path, "/")
+		if clean := path.Clean("/" + u.Path); clean == dir || strings.HasPrefix(clean, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadImage pulls an image through importd. It reports whether the image
+// was actually downloaded, as opposed to being present already. progress, if
+// not nil, is called with the progress of the transfer between 0 and 1.
+func DownloadImage(ctx context.Context, url, name, verify, imageType string, force bool, progress func(float64), logger hclog.Logger) (bool, error) {
 	c, err := import1.New()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if imageType != TarImage && imageType != RawImage {
-		return fmt.Errorf("unsupported image type")
+		return false, fmt.Errorf("unsupported image type")
 	}
 
 	// systemd-importd only allows one transfer for each unique URL at a
 	// time. To not run into API errors, we need to ensure we do not try to
 	// download an image from the same URL multiple times at one. We do this
 	// by creating a simple map containing a Mutex for each URL and only
-	// start our download if we can hold the lock for a given URL. This
-	// naively assumes we are the only process making regular use of the
-	// systemd-importd api on the host.
+	// start our download if we can hold the lock for a given URL.
 	//
-	// In the future it would probably be better to make use of the built-in
-	// signals in systemd-importd as described here:
+	// Completion is tracked through the TransferRemoved signal of our own
+	// transfer, so transfers started by other processes don't confuse us:
 	// https://www.freedesktop.org/wiki/Software/systemd/importd/
 
 	// get global lock
@@ -846,6 +3671,21 @@ func DownloadImage(url, name, verify, imageType string, force bool, logger hclog
 	// release lock for remote when done
 	defer l.Unlock()
 
+	// without force, an image that is already present is good enough
+	if !force {
+		if _, err := DescribeImage(name); err == nil {
+			logger.Info("image already exists, skipping download", "image", name)
+			return false, nil
+		}
+	}
+
+	// subscribe before starting the transfer to not miss its completion
+	w, err := newTransferWatcher()
+	if err != nil {
+		return false, err
+	}
+	defer w.Close()
+
 	var t *import1.Transfer
 	switch imageType {
 	case TarImage:
@@ -853,54 +3693,306 @@ func DownloadImage(url, name, verify, imageType string, force bool, logger hclog
 	case RawImage:
 		t, err = c.PullRaw(url, name, verify, force)
 	default:
-		return fmt.Errorf("unsupported image type")
+		return false, fmt.Errorf("unsupported image type")
 	}
 	if err != nil {
-		return err
+		if !force && isImageExistsError(err) {
+			logger.Info("image already exists, skipping download", "image", name)
+			return false, nil
+		}
+		return false, err
 	}
 
 	// wait until transfer is finished
 	logger.Info("downloading image", "image", name)
-	done := false
-	ticker := time.NewTicker(2 * time.Second)
-	for !done {
+	if err := w.Wait(ctx, t.Id, transferProgress(c, t.Id, name, progress, logger)); err != nil {
+		cancelTransfer(ctx, c, t.Id, logger)
+		return false, err
+	}
+
+	logger.Info("downloaded image", "image", name)
+	return true, nil
+}
+
+// isImageExistsError reports whether importd refused a transfer because an
+// image with the requested name is already present.
+func isImageExistsError(err error) bool {
+	var name string
+	switch e := err.(type) {
+	case dbus.Error:
+		name = e.Name
+	case *dbus.Error:
+		name = e.Name
+	}
+	if name == "org.freedesktop.DBus.Error.FileExists" {
+		return true
+	}
+	return strings.Contains(err.Error(), "already exists")
+}
+
+// errTransferTimeout is returned when a transfer exceeds its deadline.
+var errTransferTimeout = errors.New("timed out")
+
+// transferWatcher receives the TransferRemoved signals of importd.
+type transferWatcher struct {
+	conn    *dbus.Conn
+	signals chan *dbus.Signal
+
+	// interval between checks that the transfer is still running
+	interval time.Duration
+}
+
+func newTransferWatcher() (*transferWatcher, error) {
+	conn, err := setupPrivateSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to dbus: %+v", err)
+	}
+
+	match := "type='signal',interface='org.freedesktop.import1.Manager',member='TransferRemoved'"
+	if err := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, match).Err; err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	w := &transferWatcher{
+		conn:     conn,
+		signals:  make(chan *dbus.Signal, 16),
+		interval: 2 * time.Second,
+	}
+	conn.Signal(w.signals)
+
+	return w, nil
+}
+
+func (w *transferWatcher) Close() {
+	if w.conn != nil {
+		w.conn.RemoveSignal(w.signals)
+		w.conn.Close()
+	}
+}
+
+// Wait blocks until the transfer with the given id was removed and returns an
+// error unless it completed successfully. Removals of other transfers are
+// ignored. running, if not nil, is called periodically and reports whether
+// the transfer is still known to importd, so a missed signal, e.g. because
+// importd restarted, doesn't block forever.
+func (w *transferWatcher) Wait(ctx context.Context, id uint32, running func() bool) error {
+	interval := w.interval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
 		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("transfer %d did not finish: %w", id, errTransferTimeout)
+			}
+			return fmt.Errorf("transfer %d did not finish: %v", id, ctx.Err())
 		case <-ticker.C:
-			tf, _ := c.ListTransfers()
-			if len(tf) == 0 {
-				done = true
-				ticker.Stop()
+			if running == nil || running() {
 				continue
 			}
-			found := false
-			for _, v := range tf {
-				if v.Id == t.Id {
-					found = true
-					if !(math.IsNaN(v.Progress) || math.IsInf(v.Progress, 0) || math.Abs(v.Progress) == math.MaxFloat64) {
-						logger.Info("downloading image", "image", name, "progress", v.Progress)
+			// the signal may have arrived in the meantime
+		drain:
+			for {
+				select {
+				case sig, ok := <-w.signals:
+					if !ok {
+						break drain
+					}
+					if done, err := transferResult(sig, id); done {
+						return err
 					}
+				default:
+					break drain
 				}
 			}
-			if !found {
-				done = true
-				ticker.Stop()
+			return fmt.Errorf("transfer %d disappeared without completing", id)
+		case sig, ok := <-w.signals:
+			if !ok {
+				return fmt.Errorf("dbus connection closed while waiting for transfer %d", id)
+			}
+			if done, err := transferResult(sig, id); done {
+				return err
 			}
 		}
 	}
+}
 
-	logger.Info("downloaded image", "image", name)
+// transferResult checks whether sig reports the removal of the transfer and
+// if so, whether it failed.
+func transferResult(sig *dbus.Signal, id uint32) (bool, error) {
+	removed, result, ok := parseTransferRemoved(sig)
+	if !ok || removed != id {
+		return false, nil
+	}
+	if result != "done" {
+		return true, fmt.Errorf("transfer %d %s", id, result)
+	}
+	return true, nil
+}
+
+// parseTransferRemoved extracts the transfer id and result, one of "done",
+// "canceled" or "failed", from a TransferRemoved signal.
+func parseTransferRemoved(sig *dbus.Signal) (uint32, string, bool) {
+	if sig == nil || sig.Name != "org.freedesktop.import1.Manager.TransferRemoved" || len(sig.Body) != 3 {
+		return 0, "", false
+	}
+
+	id, ok := sig.Body[0].(uint32)
+	if !ok {
+		return 0, "", false
+	}
+	result, ok := sig.Body[2].(string)
+	if !ok {
+		return 0, "", false
+	}
+
+	return id, result, true
+}
+
+// transferProgress returns a function logging the progress of the transfer,
+// passing it on to progress if not nil, and reporting whether it's still
+// listed by importd.
+func transferProgress(c *import1.Conn, id uint32, name string, progress func(float64), logger hclog.Logger) func() bool {
+	return func() bool {
+		tf, err := c.ListTransfers()
+		if err != nil {
+			// don't give up on the transfer because of a failed call
+			logger.Warn("failed to list transfers", "error", err)
+			return true
+		}
+		for _, v := range tf {
+			if v.Id != id {
+				continue
+			}
+			if !(math.IsNaN(v.Progress) || math.IsInf(v.Progress, 0) || math.Abs(v.Progress) == math.MaxFloat64) {
+				logger.Info("transferring image", "image", name, "progress", v.Progress)
+				if progress != nil {
+					progress(v.Progress)
+				}
+			}
+			return true
+		}
+		return false
+	}
+}
+
+// progressThrottle limits how often the progress of a transfer is reported,
+// to once it advanced by step or interval passed since the last report.
+type progressThrottle struct {
+	step     float64
+	interval time.Duration
+
+	reported bool
+	last     float64
+	lastAt   time.Time
+}
+
+// due reports whether progress should be reported at now, and if so
+// remembers it as the last report.
+func (t *progressThrottle) due(progress float64, now time.Time) bool {
+	if t.reported && progress-t.last < t.step && now.Sub(t.lastAt) < t.interval {
+		return false
+	}
+	t.reported = true
+	t.last = progress
+	t.lastAt = now
+	return true
+}
+
+// cancelTransfer stops a transfer that was given up on, so it doesn't keep
+// running in importd.
+func cancelTransfer(ctx context.Context, c *import1.Conn, id uint32, logger hclog.Logger) {
+	if ctx.Err() == nil {
+		return
+	}
+	if err := c.CancelTransfer(id); err != nil {
+		logger.Warn("failed to cancel transfer", "transfer", id, "error", err)
+	}
+}
+
+// tarSuffixes lists the file extensions importd accepts for tar images.
+var tarSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".txz", ".tar.bz2", ".tbz2", ".tar.zst"}
+
+// isTarImage reports whether the file at path is a (possibly compressed) tar
+// archive rather than a raw disk image that nspawn can boot directly.
+func isTarImage(path string) (bool, error) {
+	for _, suffix := range tarSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// uncompressed tar archives carry the "ustar" magic at offset 257
+	magic := make([]byte, 5)
+	if _, err := f.ReadAt(magic, 257); err != nil {
+		return false, nil
+	}
+	return string(magic) == "ustar", nil
+}
+
+// ImportImage imports a local tar archive or raw image, e.g. one fetched by an
+// artifact stanza, into machinectl under the given name, replacing an image
+// of that name.
+func ImportImage(ctx context.Context, path, name, imageType string, logger hclog.Logger) error {
+	c, err := import1.New()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := newTransferWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	var t *import1.Transfer
+	switch imageType {
+	case TarImage:
+		t, err = c.ImportTar(f, name, true, false)
+	case RawImage:
+		t, err = c.ImportRaw(f, name, true, false)
+	default:
+		return fmt.Errorf("unsupported image type")
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("importing image", "image", name, "path", path)
+	if err := w.Wait(ctx, t.Id, transferProgress(c, t.Id, name, nil, logger)); err != nil {
+		cancelTransfer(ctx, c, t.Id, logger)
+		return err
+	}
+
+	logger.Info("imported image", "image", name)
 	return nil
 }
 
-func (c *MachineConfig) GetImagePath() (string, error) {
+// GetImagePath resolves the image to a path on the host. Relative paths are
+// looked up in the task directory, so artifacts fetched by Nomad can be used
+// directly, before falling back to images known to machinectl.
+func (c *MachineConfig) GetImagePath(taskDir string) (string, error) {
 	// check if image is absolute or relative path
 	imagePath := c.Image
 	if !filepath.IsAbs(c.Image) {
-		pwd, e := os.Getwd()
-		if e != nil {
-			return "", e
-		}
-		imagePath = filepath.Join(pwd, c.Image)
+		imagePath = filepath.Join(taskDir, c.Image)
 	}
 	// check if image exists
 	_, err := os.Stat(imagePath)
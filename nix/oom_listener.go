@@ -2,11 +2,13 @@ package nix
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/hashicorp/go-hclog"
@@ -21,6 +23,30 @@ type OOM struct {
 	MachineID string
 	Task      string
 	PID       uint64
+
+	// TotalVM and AnonRSS are the memory of the killed process in kB, if the
+	// kernel logged it
+	TotalVM uint64
+	AnonRSS uint64
+}
+
+// message describes the OOM kill for the exit result of the task.
+func (oom *OOM) message() string {
+	if oom == nil || (oom.TotalVM == 0 && oom.AnonRSS == 0) {
+		return "Out of memory"
+	}
+	return fmt.Sprintf("Out of memory: killed %s (pid %d) using %d MiB of memory and %d MiB of address space",
+		oom.Task, oom.PID, oom.AnonRSS/1024, oom.TotalVM/1024)
+}
+
+// oomDetailsTimeout is how long an OOM kill is held back for the line with
+// the memory of the killed process, which the kernel logs right after.
+const oomDetailsTimeout = time.Second
+
+// pendingOOM is an OOM kill waiting for the memory of the killed process.
+type pendingOOM struct {
+	sync.Mutex
+	oom *OOM
 }
 
 type OOMListener struct {
@@ -28,6 +54,7 @@ type OOMListener struct {
 	register   chan *registration
 	deregister chan string
 	oom        chan *OOM
+	pending    *pendingOOM
 }
 
 func NewOOMListener(log log.Logger) *OOMListener {
@@ -36,6 +63,7 @@ func NewOOMListener(log log.Logger) *OOMListener {
 		register:   make(chan *registration, 10),
 		deregister: make(chan string, 10),
 		oom:        make(chan *OOM, 10),
+		pending:    &pendingOOM{},
 	}
 
 	go listener.loop()
@@ -82,38 +110,76 @@ func (self OOMListener) Deregister(machineID string) {
 	self.deregister <- machineID
 }
 
+const (
+	// journalctlMinBackoff and journalctlMaxBackoff bound the delay before
+	// journalctl is started again after it failed
+	journalctlMinBackoff = time.Second
+	journalctlMaxBackoff = time.Minute
+)
+
+// Start follows the kernel log for OOM kills, starting journalctl again with
+// an increasing delay whenever it fails.
 func (self OOMListener) Start() {
+	backoff := journalctlMinBackoff
+	var since time.Time
+
 	for {
-		self.journalctlListener()
+		started := time.Now()
+		err := self.journalctlListener(since)
+
+		// only back off further if journalctl keeps failing right away
+		if time.Since(started) > journalctlMaxBackoff {
+			backoff = journalctlMinBackoff
+		}
+		self.log.Error("failed to follow the kernel log for OOM kills, retrying", "error", err, "backoff", backoff)
+
+		// don't miss OOM kills logged while journalctl isn't running
+		since = time.Now()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > journalctlMaxBackoff {
+			backoff = journalctlMaxBackoff
+		}
 	}
 }
 
-func (self OOMListener) journalctlListener() {
-	cmd := exec.Command("journalctl", "-e", "-f", "-k", "-o", "json", "-g", "oom-kill:")
+// journalctlListener runs journalctl until it fails, which it returns. Entries
+// logged since the given time are read again, if it's set.
+func (self OOMListener) journalctlListener(since time.Time) error {
+	args := []string{"-e", "-f", "-k", "-o", "json", "-g", "^(oom-kill:|Memory cgroup out of memory:)"}
+	if !since.IsZero() {
+		args = append(args, "--since", since.Format("2006-01-02 15:04:05"))
+	}
+	cmd := exec.Command("journalctl", args...)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to create pipe for journalctl: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start journalctl: %v", err)
 	}
 
-	journaldChan := make(chan *journaldLine)
-	go self.journalctlReader(stdout, journaldChan)
-
-	go func() {
-		err = cmd.Run()
-		if err != nil {
-			self.log.Error("failed running journalctl", err)
-		}
-	}()
-
-	for line := range journaldChan {
+	readErr := self.journalctlReader(stdout, func(line *journaldLine) {
 		self.parseLine(line.Message)
+	})
+	if readErr != nil {
+		// journalctl doesn't exit by itself when its output is garbled
+		cmd.Process.Kill()
 	}
-}
 
-func (self OOMListener) journalctlReader(reader io.ReadCloser, out chan *journaldLine) {
-	defer reader.Close()
+	waitErr := cmd.Wait()
+	switch {
+	case readErr != nil:
+		return readErr
+	case waitErr != nil:
+		return fmt.Errorf("journalctl failed: %v", waitErr)
+	}
+	return fmt.Errorf("journalctl exited")
+}
 
+// journalctlReader passes the kernel messages journalctl writes to reader to
+// handle until it's done writing.
+func (self OOMListener) journalctlReader(reader io.Reader, handle func(*journaldLine)) error {
 	dec := json.NewDecoder(reader)
 
 	for {
@@ -121,17 +187,45 @@ func (self OOMListener) journalctlReader(reader io.ReadCloser, out chan *journal
 		err := dec.Decode(line)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
-			panic(err)
+			return fmt.Errorf("failed to decode journalctl output: %v", err)
 		}
 
 		if line.SyslogIdentifier == "kernel" {
-			out <- line
+			handle(line)
 		}
 	}
+}
+
+// oomKilledProcessRegexp matches the line with the memory of the process
+// killed in a cgroup, capturing its PID, total-vm and anon-rss.
+var oomKilledProcessRegexp = regexp.MustCompile(`^Memory cgroup out of memory: Killed process (\d+) \(.*\) total-vm:(\d+)kB, anon-rss:(\d+)kB`)
 
-	close(out)
+// hold keeps oom back until the memory of the killed process is read, or
+// oomDetailsTimeout passed.
+func (self OOMListener) hold(oom *OOM) {
+	self.pending.Lock()
+	previous := self.pending.oom
+	self.pending.oom = oom
+	self.pending.Unlock()
+
+	if previous != nil {
+		self.oom <- previous
+	}
+	time.AfterFunc(oomDetailsTimeout, func() { self.release(oom) })
+}
+
+// release passes on oom if it's still held.
+func (self OOMListener) release(oom *OOM) {
+	self.pending.Lock()
+	if self.pending.oom != oom {
+		self.pending.Unlock()
+		return
+	}
+	self.pending.oom = nil
+	self.pending.Unlock()
+	self.oom <- oom
 }
 
 func (self OOMListener) parseLine(line string) {
@@ -142,7 +236,8 @@ func (self OOMListener) parseLine(line string) {
 		var task string
 		var id string
 
-		for _, field := range strings.Split(line, ",") {
+		// the first field follows the prefix
+		for _, field := range strings.Split(strings.TrimPrefix(line, "oom-kill:"), ",") {
 			parts := strings.SplitN(field, "=", 2)
 
 			if len(parts) != 2 {
@@ -152,7 +247,8 @@ func (self OOMListener) parseLine(line string) {
 
 			switch parts[0] {
 			case "oom_memcg":
-				r := regexp.MustCompile(`^/machine\.slice/machine-(.+)\.scope$`)
+				// the scope is in machine.slice unless the task sets a slice
+				r := regexp.MustCompile(`^/([^/]+\.slice/)*machine-([^/]+)\.scope$`)
 				scope := strings.Replace(parts[1], "\\x2d", "-", -1)
 				match := r.FindStringSubmatch(scope)
 				if len(match) == 0 {
@@ -160,7 +256,7 @@ func (self OOMListener) parseLine(line string) {
 					return
 				}
 
-				id = match[1]
+				id = match[2]
 			case "pid":
 				var err error
 				pid, err = strconv.ParseUint(parts[1], 10, 64)
@@ -173,11 +269,25 @@ func (self OOMListener) parseLine(line string) {
 			}
 		}
 
-		oom := &OOM{PID: pid, Task: task, MachineID: id}
-		self.oom <- oom
-	} else if strings.HasPrefix(line, "Memory cgroup out of memory:") {
-		// TODO: parse this line and add info about memory?
+		self.hold(&OOM{PID: pid, Task: task, MachineID: id})
+	} else if match := oomKilledProcessRegexp.FindStringSubmatch(line); match != nil {
 		// Memory cgroup out of memory: Killed process 2933082 (bash) total-vm:1051956kB, anon-rss:101820kB, file-rss:1632kB, shmem-rss:0kB, UID:0 pgtables:252kB oom_score_adj:0
+		pid, _ := strconv.ParseUint(match[1], 10, 64)
+		totalVM, _ := strconv.ParseUint(match[2], 10, 64)
+		anonRSS, _ := strconv.ParseUint(match[3], 10, 64)
+
+		self.pending.Lock()
+		oom := self.pending.oom
+		if oom == nil || oom.PID != pid {
+			self.pending.Unlock()
+			return
+		}
+		self.pending.oom = nil
+		self.pending.Unlock()
+
+		oom.TotalVM = totalVM
+		oom.AnonRSS = anonRSS
+		self.oom <- oom
 	} else if strings.HasPrefix(line, "oom_reaper:") {
 		// NOTE: nothing particularly useful about this line, but it shows resources after the kill.
 		// oom_reaper: reaped process 2931684 (bash), now anon-rss:0kB, file-rss:0kB, shmem-rss:0kB
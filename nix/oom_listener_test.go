@@ -0,0 +1,68 @@
+package nix
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOOMListener_JournalctlReader(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	listener := OOMListener{}
+	var messages []string
+	handle := func(line *journaldLine) { messages = append(messages, line.Message) }
+
+	output := `{"MESSAGE":"oom-kill:task=bash,pid=42","SYSLOG_IDENTIFIER":"kernel"}
+{"MESSAGE":"oom-kill: not from the kernel","SYSLOG_IDENTIFIER":"logger"}
+`
+	require.NoError(listener.journalctlReader(strings.NewReader(output), handle))
+	require.Equal([]string{"oom-kill:task=bash,pid=42"}, messages)
+
+	// garbled output is an error rather than a panic
+	err := listener.journalctlReader(strings.NewReader(`{"MESSAGE":`+"\n"+`}`), handle)
+	require.Error(err)
+	require.Contains(err.Error(), "failed to decode journalctl output")
+}
+
+func TestOOMListener_ParseLine(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	listener := OOMListener{
+		log:     hclog.NewNullLogger(),
+		oom:     make(chan *OOM, 10),
+		pending: &pendingOOM{},
+	}
+
+	listener.parseLine(`oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=payload,mems_allowed=0,oom_memcg=/machine.slice/machine-web\x2d6f2b4c1e.scope,task_memcg=/machine.slice/machine-web\x2d6f2b4c1e.scope/payload,task=bash,pid=2933082,uid=0`)
+	listener.parseLine(`Memory cgroup out of memory: Killed process 2933082 (bash) total-vm:1051956kB, anon-rss:101820kB, file-rss:1632kB, shmem-rss:0kB, UID:0 pgtables:252kB oom_score_adj:0`)
+
+	oom := <-listener.oom
+	require.Equal("web-6f2b4c1e", oom.MachineID)
+	require.Equal(uint64(2933082), oom.PID)
+	require.Equal(uint64(1051956), oom.TotalVM)
+	require.Equal(uint64(101820), oom.AnonRSS)
+	require.Equal("Out of memory: killed bash (pid 2933082) using 99 MiB of memory and 1027 MiB of address space", oom.message())
+
+	// scopes of containers in a custom slice
+	listener.parseLine(`oom-kill:oom_memcg=/customer.slice/customer-a.slice/machine-db.scope,task=postgres,pid=7`)
+	listener.parseLine(`Memory cgroup out of memory: Killed process 7 (postgres) total-vm:2048kB, anon-rss:1024kB, file-rss:0kB, shmem-rss:0kB, UID:0 pgtables:252kB oom_score_adj:0`)
+	oom = <-listener.oom
+	require.Equal("db", oom.MachineID)
+
+	// without the memory of the process, the kill is passed on after a while
+	listener.parseLine(`oom-kill:oom_memcg=/machine.slice/machine-web.scope,task=bash,pid=42`)
+	select {
+	case oom = <-listener.oom:
+	case <-time.After(5 * oomDetailsTimeout):
+		t.Fatal("OOM kill was not passed on")
+	}
+	require.Equal(uint64(42), oom.PID)
+	require.Equal("web", oom.MachineID)
+	require.Equal("Out of memory", oom.message())
+}
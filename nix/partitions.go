@@ -0,0 +1,189 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// rootPartitionTypes are the GPT partition types of root partitions per
+// GOARCH, following the Discoverable Partitions Specification.
+var rootPartitionTypes = map[string]string{
+	"386":     "44479540-f297-41b2-9af7-d131d5f0458a",
+	"amd64":   "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+	"arm":     "69dad710-2ce4-4e3c-b16c-21a1d49abed3",
+	"arm64":   "b921b045-1df0-41c3-af44-4c6f280d3fae",
+	"riscv64": "72ec70a6-cf74-40e6-bd49-4bda08e8f224",
+	"ppc64le": "c31c45e6-3f39-412e-80fb-4809c4980599",
+}
+
+const (
+	// linuxDataPartitionType is the generic Linux filesystem data type,
+	// which nspawn uses as root if only one partition has it
+	linuxDataPartitionType = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+
+	// gptFlagNoAuto excludes a partition from automatic discovery
+	gptFlagNoAuto = 1 << 63
+
+	mbrLinuxPartitionType = 0x83
+	mbrProtectivePartType = 0xee
+)
+
+// gptPartition is an entry of a GUID partition table.
+type gptPartition struct {
+	Type       string
+	Attributes uint64
+}
+
+// checkRawImage makes sure nspawn finds a root partition in the raw image at
+// path when it runs on arch. Images without a partition table are plain
+// filesystems, which nspawn mounts as root directly.
+func checkRawImage(path, arch string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	partitions, found, err := readGPT(f)
+	if err != nil {
+		return err
+	}
+	if found {
+		return checkGPTRoot(partitions, arch)
+	}
+	return checkMBR(f)
+}
+
+// readGPT reads the partition table of an image with a GUID partition table,
+// trying the common sector sizes. It reports whether the image has one.
+func readGPT(r io.ReaderAt) ([]gptPartition, bool, error) {
+	for _, sectorSize := range []int64{512, 4096} {
+		header := make([]byte, 92)
+		if _, err := r.ReadAt(header, sectorSize); err != nil {
+			continue
+		}
+		if !bytes.Equal(header[:8], []byte("EFI PART")) {
+			continue
+		}
+
+		entriesLBA := int64(binary.LittleEndian.Uint64(header[72:80]))
+		count := binary.LittleEndian.Uint32(header[80:84])
+		size := binary.LittleEndian.Uint32(header[84:88])
+		// entries are 128 bytes or a multiple thereof, checked before
+		// allocating them for malformed images
+		if size < 128 || size > 4096 || size%128 != 0 || count > 1024 {
+			return nil, true, fmt.Errorf("invalid GUID partition table header")
+		}
+
+		entries := make([]byte, int64(count)*int64(size))
+		if _, err := r.ReadAt(entries, entriesLBA*sectorSize); err != nil {
+			return nil, true, fmt.Errorf("failed to read GUID partition table: %v", err)
+		}
+
+		var partitions []gptPartition
+		for i := uint32(0); i < count; i++ {
+			entry := entries[i*size : (i+1)*size]
+			if bytes.Equal(entry[:16], make([]byte, 16)) {
+				continue
+			}
+			partitions = append(partitions, gptPartition{
+				Type:       formatGUID(entry[:16]),
+				Attributes: binary.LittleEndian.Uint64(entry[48:56]),
+			})
+		}
+		return partitions, true, nil
+	}
+	return nil, false, nil
+}
+
+// checkGPTRoot finds the root partition the way nspawn does: a root
+// partition for the architecture, or else the only Linux data partition.
+func checkGPTRoot(partitions []gptPartition, arch string) error {
+	rootType, ok := rootPartitionTypes[arch]
+	if !ok {
+		return fmt.Errorf("partitioned images are not supported on %s", arch)
+	}
+
+	linuxData := 0
+	var otherArches []string
+	for _, p := range partitions {
+		if p.Attributes&gptFlagNoAuto != 0 {
+			continue
+		}
+		switch p.Type {
+		case rootType:
+			return nil
+		case linuxDataPartitionType:
+			linuxData++
+		}
+		for a, t := range rootPartitionTypes {
+			if p.Type == t {
+				otherArches = append(otherArches, a)
+			}
+		}
+	}
+
+	if len(otherArches) > 0 {
+		sort.Strings(otherArches)
+		return fmt.Errorf("the image only has root partitions for %s, not for %s", strings.Join(otherArches, ", "), arch)
+	}
+	if linuxData == 1 {
+		return nil
+	}
+	return fmt.Errorf("the image has no root partition of type %s as defined by the Discoverable Partitions Specification, "+
+		"and no single Linux data partition nspawn could use instead. Set the type of the root partition, e.g. with sfdisk --part-type", rootType)
+}
+
+// checkMBR accepts images with a master boot record if they have a single
+// Linux partition, which is all nspawn supports, as well as filesystems
+// without a partition table.
+func checkMBR(r io.ReaderAt) error {
+	sector := make([]byte, 512)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		// too small for a partition table
+		return nil
+	}
+	if sector[510] != 0x55 || sector[511] != 0xaa {
+		return nil
+	}
+	// FAT filesystems carry the same boot signature
+	if bytes.HasPrefix(sector[54:], []byte("FAT")) || bytes.HasPrefix(sector[82:], []byte("FAT32")) {
+		return nil
+	}
+
+	var types []byte
+	for i := 0; i < 4; i++ {
+		entry := sector[446+i*16 : 446+(i+1)*16]
+		if entry[0] != 0x00 && entry[0] != 0x80 {
+			// boot code rather than a partition table
+			return nil
+		}
+		if entry[4] != 0 {
+			types = append(types, entry[4])
+		}
+	}
+
+	switch {
+	case len(types) == 0:
+		return nil
+	case len(types) == 1 && types[0] == mbrProtectivePartType:
+		return fmt.Errorf("the image has a protective MBR but no valid GUID partition table")
+	case len(types) == 1 && types[0] == mbrLinuxPartitionType:
+		return nil
+	}
+	return fmt.Errorf("images with an MBR partition table need exactly one Linux partition, convert the image to GPT to use more")
+}
+
+// formatGUID formats a GUID stored in the mixed-endian layout of GPT.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
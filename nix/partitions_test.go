@@ -0,0 +1,100 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeGPTImage writes a disk image with 512 byte sectors and a GUID
+// partition table with partitions of the given types.
+func writeGPTImage(t *testing.T, types ...string) string {
+	image := make([]byte, 34*512)
+	image[446+4] = mbrProtectivePartType
+	image[510], image[511] = 0x55, 0xaa
+
+	header := image[512:]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+
+	for i, typ := range types {
+		raw, err := hex.DecodeString(strings.ReplaceAll(typ, "-", ""))
+		require.NoError(t, err)
+		entry := image[1024+i*128:]
+		// the first three fields of GUIDs are little endian
+		entry[0], entry[1], entry[2], entry[3] = raw[3], raw[2], raw[1], raw[0]
+		entry[4], entry[5] = raw[5], raw[4]
+		entry[6], entry[7] = raw[7], raw[6]
+		copy(entry[8:16], raw[8:16])
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, ioutil.WriteFile(path, image, 0644))
+	return path
+}
+
+func TestCheckRawImage(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	esp := "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	amd64 := rootPartitionTypes["amd64"]
+	arm64 := rootPartitionTypes["arm64"]
+
+	require.NoError(checkRawImage(writeGPTImage(t, esp, amd64), "amd64"))
+	require.NoError(checkRawImage(writeGPTImage(t, esp, linuxDataPartitionType), "amd64"))
+
+	err := checkRawImage(writeGPTImage(t, esp, arm64), "amd64")
+	require.Error(err)
+	require.Contains(err.Error(), "only has root partitions for arm64")
+
+	err = checkRawImage(writeGPTImage(t, esp, linuxDataPartitionType, linuxDataPartitionType), "amd64")
+	require.Error(err)
+	require.Contains(err.Error(), "Discoverable Partitions Specification")
+
+	// filesystems without a partition table are mounted directly
+	fs := filepath.Join(t.TempDir(), "rootfs.raw")
+	require.NoError(ioutil.WriteFile(fs, make([]byte, 4096), 0644))
+	require.NoError(checkRawImage(fs, "amd64"))
+
+	mbr := make([]byte, 512)
+	mbr[446+4] = mbrLinuxPartitionType
+	mbr[462+4] = mbrLinuxPartitionType
+	mbr[510], mbr[511] = 0x55, 0xaa
+	require.NoError(ioutil.WriteFile(fs, mbr, 0644))
+	err = checkRawImage(fs, "amd64")
+	require.Error(err)
+	require.Contains(err.Error(), "exactly one Linux partition")
+}
+
+func TestReadGPT_InvalidEntrySize(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	for _, size := range []uint32{64, 200, 8192, 0xffffff80} {
+		path := writeGPTImage(t)
+		image, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		binary.LittleEndian.PutUint32(image[512+84:], size)
+
+		_, found, err := readGPT(bytes.NewReader(image))
+		require.True(found)
+		require.Error(err, "size %d", size)
+		require.Contains(err.Error(), "invalid GUID partition table header")
+	}
+}
+
+func TestFormatGUID(t *testing.T) {
+	t.Parallel()
+
+	b := []byte{0xe3, 0xbc, 0x68, 0x4f, 0xcd, 0xe8, 0xb1, 0x4d, 0x96, 0xe7, 0xfb, 0xca, 0xf9, 0x84, 0xb7, 0x09}
+	require.Equal(t, "4f68bce3-e8cd-4db1-96e7-fbcaf984b709", formatGUID(b))
+}
@@ -0,0 +1,182 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/stats"
+	"github.com/hashicorp/nomad/drivers/shared/executor"
+	shelpers "github.com/hashicorp/nomad/helper/stats"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// cgroupMeasuredMemStats are the memory stats read from the cgroup of a
+// machine.
+var cgroupMeasuredMemStats = []string{"RSS", "Cache", "Swap", "Usage", "Max Usage"}
+
+// initCPUStats initializes the CPU info of the host, which converts CPU
+// percentages to ticks. The executor does this in its own process.
+var initCPUStats sync.Once
+
+// machineCgroup returns the cgroup of the scope of machine m on the unified
+// hierarchy mounted at root. The scope is found in the cgroup of the leader,
+// which sits in a sub-cgroup of the scope if the cgroup is delegated.
+func machineCgroup(root, procDir string, m *MachineProps) (string, error) {
+	if m.Unit == "" {
+		return "", fmt.Errorf("machine %s has no scope unit", m.Name)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(procDir, strconv.FormatUint(uint64(m.Leader), 10), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "0::") {
+			continue
+		}
+		path := strings.TrimPrefix(line, "0::")
+		i := strings.Index(path+"/", "/"+m.Unit+"/")
+		if i < 0 {
+			break
+		}
+		return filepath.Join(root, path[:i+len(m.Unit)+1]), nil
+	}
+	return "", fmt.Errorf("leader of machine %s is not in the cgroup of %s", m.Name, m.Unit)
+}
+
+// cgroupStats samples the resource usage of all processes of a container
+// from its cgroup, rather than only those of the nspawn process tree the
+// executor sees.
+type cgroupStats struct {
+	dir string
+
+	totalCPU  *stats.CpuStats
+	userCPU   *stats.CpuStats
+	systemCPU *stats.CpuStats
+
+	// maxUsage is the highest memory usage sampled, for kernels without
+	// memory.peak
+	maxUsage uint64
+}
+
+func newCgroupStats(dir string) *cgroupStats {
+	initCPUStats.Do(func() { shelpers.Init() })
+	return &cgroupStats{
+		dir:       dir,
+		totalCPU:  stats.NewCpuStats(),
+		userCPU:   stats.NewCpuStats(),
+		systemCPU: stats.NewCpuStats(),
+	}
+}
+
+// collect reads memory.current, memory.stat and cpu.stat of the cgroup.
+func (c *cgroupStats) collect() (*drivers.ResourceUsage, error) {
+	usage, err := readCgroupUint(filepath.Join(c.dir, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	memStat, err := readCgroupKeyed(filepath.Join(c.dir, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+	cpuStat, err := readCgroupKeyed(filepath.Join(c.dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	// the files below depend on the kernel version and swap accounting
+	swap, _ := readCgroupUint(filepath.Join(c.dir, "memory.swap.current"))
+	if peak, err := readCgroupUint(filepath.Join(c.dir, "memory.peak")); err == nil {
+		c.maxUsage = peak
+	} else if usage > c.maxUsage {
+		c.maxUsage = usage
+	}
+
+	// cpu.stat counts microseconds, CpuStats expects nanoseconds
+	totalPercent := c.totalCPU.Percent(float64(cpuStat["usage_usec"] * 1000))
+	return &drivers.ResourceUsage{
+		MemoryStats: &drivers.MemoryStats{
+			RSS:      memStat["anon"],
+			Cache:    memStat["file"],
+			Swap:     swap,
+			Usage:    usage,
+			MaxUsage: c.maxUsage,
+			Measured: cgroupMeasuredMemStats,
+		},
+		CpuStats: &drivers.CpuStats{
+			SystemMode:       c.systemCPU.Percent(float64(cpuStat["system_usec"] * 1000)),
+			UserMode:         c.userCPU.Percent(float64(cpuStat["user_usec"] * 1000)),
+			Percent:          totalPercent,
+			ThrottledPeriods: cpuStat["nr_throttled"],
+			ThrottledTime:    cpuStat["throttled_usec"] * 1000,
+			TotalTicks:       c.totalCPU.TicksConsumed(totalPercent),
+			Measured:         executor.ExecutorCgroupMeasuredCpuStats,
+		},
+	}, nil
+}
+
+// mergeCgroupStats replaces the memory and CPU stats the executor reports
+// with those of the cgroup of the container. The per process stats of the
+// executor are kept.
+func mergeCgroupStats(ctx context.Context, in <-chan *drivers.TaskResourceUsage, c *cgroupStats, logger hclog.Logger) <-chan *drivers.TaskResourceUsage {
+	out := make(chan *drivers.TaskResourceUsage)
+	go func() {
+		defer close(out)
+		for usage := range in {
+			if usage.ResourceUsage != nil {
+				if ru, err := c.collect(); err != nil {
+					logger.Debug("failed to read cgroup stats", "cgroup", c.dir, "error", err)
+				} else {
+					usage.ResourceUsage.MemoryStats = ru.MemoryStats
+					usage.ResourceUsage.CpuStats = ru.CpuStats
+				}
+			}
+			select {
+			case out <- usage:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func readCgroupUint(path string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(bytes.TrimSpace(content)), 10, 64)
+}
+
+// readCgroupKeyed reads a flat keyed cgroup file like cpu.stat.
+func readCgroupKeyed(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %s: %q", path, scanner.Text())
+		}
+		values[fields[0]] = v
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,76 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineCgroup(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	procDir := t.TempDir()
+	require.NoError(os.MkdirAll(filepath.Join(procDir, "4242"), 0755))
+	cgroup := filepath.Join(procDir, "4242", "cgroup")
+	m := &MachineProps{Name: "web-6f2b4c1e", Leader: 4242, Unit: "machine-web\\x2d6f2b4c1e.scope"}
+
+	require.NoError(ioutil.WriteFile(cgroup, []byte("0::/machine.slice/machine-web\\x2d6f2b4c1e.scope/payload\n"), 0644))
+	dir, err := machineCgroup("/sys/fs/cgroup", procDir, m)
+	require.NoError(err)
+	require.Equal("/sys/fs/cgroup/machine.slice/machine-web\\x2d6f2b4c1e.scope", dir)
+
+	require.NoError(ioutil.WriteFile(cgroup, []byte("0::/machine.slice/machine-web\\x2d6f2b4c1e.scope\n"), 0644))
+	dir, err = machineCgroup("/sys/fs/cgroup", procDir, m)
+	require.NoError(err)
+	require.Equal("/sys/fs/cgroup/machine.slice/machine-web\\x2d6f2b4c1e.scope", dir)
+
+	// containers in a custom slice are nested below its parents
+	require.NoError(ioutil.WriteFile(cgroup, []byte("0::/customer.slice/customer-a.slice/machine-web\\x2d6f2b4c1e.scope/payload\n"), 0644))
+	dir, err = machineCgroup("/sys/fs/cgroup", procDir, m)
+	require.NoError(err)
+	require.Equal("/sys/fs/cgroup/customer.slice/customer-a.slice/machine-web\\x2d6f2b4c1e.scope", dir)
+
+	require.NoError(ioutil.WriteFile(cgroup, []byte("0::/system.slice/nomad.service\n"), 0644))
+	_, err = machineCgroup("/sys/fs/cgroup", procDir, m)
+	require.Error(err)
+}
+
+func TestCgroupStats(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"memory.current": "104857600\n",
+		"memory.stat":    "anon 73400320\nfile 20971520\nkernel_stack 98304\n",
+		"cpu.stat":       "usage_usec 2000\nuser_usec 1500\nsystem_usec 500\nnr_periods 10\nnr_throttled 3\nthrottled_usec 700\n",
+	}
+	for name, content := range files {
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	c := newCgroupStats(dir)
+	ru, err := c.collect()
+	require.NoError(err)
+	require.Equal(uint64(104857600), ru.MemoryStats.Usage)
+	require.Equal(uint64(104857600), ru.MemoryStats.MaxUsage)
+	require.Equal(uint64(73400320), ru.MemoryStats.RSS)
+	require.Equal(uint64(20971520), ru.MemoryStats.Cache)
+	require.Equal(uint64(3), ru.CpuStats.ThrottledPeriods)
+	require.Equal(uint64(700000), ru.CpuStats.ThrottledTime)
+
+	// the highest usage is kept without memory.peak
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "memory.current"), []byte("52428800\n"), 0644))
+	ru, err = c.collect()
+	require.NoError(err)
+	require.Equal(uint64(52428800), ru.MemoryStats.Usage)
+	require.Equal(uint64(104857600), ru.MemoryStats.MaxUsage)
+
+	require.NoError(os.Remove(filepath.Join(dir, "cpu.stat")))
+	_, err = c.collect()
+	require.Error(err)
+}
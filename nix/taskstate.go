@@ -0,0 +1,70 @@
+package nix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// restartedTasks keeps the state of tasks whose container was started again
+// after an OOM kill. Nomad only stores the handle state returned by
+// StartTask, which points at the executor of the first container, so
+// RecoverTask prefers the state kept here.
+type restartedTasks struct {
+	dir string
+}
+
+func newRestartedTasks(stateDir string) *restartedTasks {
+	return &restartedTasks{dir: filepath.Join(stateDir, "restarted-tasks")}
+}
+
+func (r *restartedTasks) path(taskID string) string {
+	// task IDs contain slashes
+	sum := sha256.Sum256([]byte(taskID))
+	return filepath.Join(r.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get returns the state of the restarted task, or nil if its container
+// wasn't restarted.
+func (r *restartedTasks) Get(taskID string) (*TaskState, error) {
+	data, err := ioutil.ReadFile(r.path(taskID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state of restarted task: %v", err)
+	}
+	state := &TaskState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state of restarted task: %v", err)
+	}
+	return state, nil
+}
+
+// Put stores the state of the task, replacing the file atomically.
+func (r *restartedTasks) Put(taskID string, state *TaskState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory of restarted tasks: %v", err)
+	}
+	path := r.path(taskID)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state of restarted task: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Delete drops the state of the task once it is destroyed.
+func (r *restartedTasks) Delete(taskID string) error {
+	if err := os.Remove(r.path(taskID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
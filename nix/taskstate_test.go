@@ -0,0 +1,41 @@
+package nix
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartedTasks(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	restarted := newRestartedTasks(t.TempDir())
+	id := "6f2b4c1e/web/2f0c4d8a"
+
+	state, err := restarted.Get(id)
+	require.NoError(err)
+	require.Nil(state)
+
+	want := &TaskState{
+		ReattachConfig: &structs.ReattachConfig{Network: "unix", Addr: "/tmp/plugin.sock", Pid: 4242},
+		MachineName:    "web-6f2b4c1e",
+		StartedAt:      time.Now().UTC().Round(time.Millisecond),
+		CNI:            &CNIAttachment{Network: "bridge", PortMappings: []cniPortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}},
+	}
+	require.NoError(restarted.Put(id, want))
+	state, err = restarted.Get(id)
+	require.NoError(err)
+	require.Equal(want.ReattachConfig, state.ReattachConfig)
+	require.Equal(want.MachineName, state.MachineName)
+	require.Equal(want.StartedAt, state.StartedAt)
+	require.Equal(want.CNI.PortMappings, state.CNI.PortMappings)
+
+	require.NoError(restarted.Delete(id))
+	require.NoError(restarted.Delete(id))
+	state, err = restarted.Get(id)
+	require.NoError(err)
+	require.Nil(state)
+}
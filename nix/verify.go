@@ -0,0 +1,184 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// importPubrings are the keyrings importd verifies signatures with, in order
+// of precedence.
+var importPubrings = []string{
+	"/etc/systemd/import-pubring.gpg",
+	"/usr/lib/systemd/import-pubring.gpg",
+}
+
+// downloadVerifiedImage downloads an image into the task directory and
+// verifies it against the SHA256SUMS file given by image_download.checksums,
+// which in turn is verified against image_download.signature if set. importd
+// can only fetch these files from next to the image, so mirrors serving them
+// separately are handled here. The path of the image relative to the task
+// directory is returned.
+func downloadVerifiedImage(ctx context.Context, taskDir string, opts *ImageDownloadOpts) (string, error) {
+	sums, err := resolveTaskDirPath(taskDir, opts.Checksums)
+	if err != nil {
+		return "", fmt.Errorf("invalid image_download.checksums: %v", err)
+	}
+	if _, err := os.Stat(sums); err != nil {
+		return "", fmt.Errorf("invalid image_download.checksums: %v", err)
+	}
+
+	if opts.Signature != "" {
+		sig, err := resolveTaskDirPath(taskDir, opts.Signature)
+		if err != nil {
+			return "", fmt.Errorf("invalid image_download.signature: %v", err)
+		}
+		if _, err := os.Stat(sig); err != nil {
+			return "", fmt.Errorf("invalid image_download.signature: %v", err)
+		}
+		if err := verifySignature(sums, sig); err != nil {
+			return "", err
+		}
+	}
+
+	name, err := downloadFileName(opts.URL)
+	if err != nil {
+		return "", err
+	}
+
+	want, err := checksumFor(sums, name)
+	if err != nil {
+		return "", err
+	}
+
+	return fetchVerifiedFile(ctx, taskDir, opts.URL, name, want)
+}
+
+// downloadFileName returns the name of the file rawURL points to.
+func downloadFileName(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("%s does not name a file", redactURL(rawURL))
+	}
+	return name, nil
+}
+
+// fetchVerifiedFile downloads url into the task directory as name and checks
+// it against the hex encoded SHA256 want. The path of the file relative to the
+// task directory is returned.
+func fetchVerifiedFile(ctx context.Context, taskDir, url, name, want string) (string, error) {
+	rel := filepath.Join("local", "image-download", name)
+	dest := filepath.Join(taskDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	got, err := fetchFile(ctx, url, dest+".part")
+	if err != nil {
+		os.Remove(dest + ".part")
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("download of %s did not finish: %w", redactURL(url), errTransferTimeout)
+		}
+		return "", err
+	}
+	if got != want {
+		os.Remove(dest + ".part")
+		return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, want, got)
+	}
+
+	return rel, os.Rename(dest+".part", dest)
+}
+
+// fetchFile downloads url to dest and returns the hex encoded SHA256 of its
+// content.
+func fetchFile(ctx context.Context, url, dest string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), f.Close()
+}
+
+// checksumFor looks up the checksum of the named file in a SHA256SUMS file as
+// written by sha256sum.
+func checksumFor(sums, name string) (string, error) {
+	f, err := os.Open(sums)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// binary mode entries are prefixed with an asterisk
+		if strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s is not listed in %s", name, filepath.Base(sums))
+}
+
+// verifySignature checks the detached signature of the checksums with the
+// keyring importd uses.
+func verifySignature(sums, sig string) error {
+	keyring := ""
+	for _, k := range importPubrings {
+		if _, err := os.Stat(k); err == nil {
+			keyring = k
+			break
+		}
+	}
+	if keyring == "" {
+		return fmt.Errorf("no keyring found to verify signatures, tried %s", strings.Join(importPubrings, ", "))
+	}
+
+	cmd := exec.Command("gpgv", "--keyring", keyring, sig, sums)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v failed: %s. Err: %v", cmd.Args, stderr.String(), err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package nix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumFor(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	sums := filepath.Join(t.TempDir(), "SHA256SUMS")
+	require.NoError(ioutil.WriteFile(sums, []byte(
+		"0123456789ABCDEF0123456789abcdef0123456789abcdef0123456789abcdef *alpine.tar.xz\n"+
+			"fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210  debian.raw\n"), 0644))
+
+	sum, err := checksumFor(sums, "alpine.tar.xz")
+	require.NoError(err)
+	require.Equal("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", sum)
+
+	sum, err = checksumFor(sums, "debian.raw")
+	require.NoError(err)
+	require.Equal("fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210", sum)
+
+	_, err = checksumFor(sums, "fedora.raw")
+	require.Error(err)
+	require.Contains(err.Error(), "not listed")
+}
+
+func TestDownloadVerifiedImage(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	image := []byte("not really a tar archive")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/alpine.tar" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(image)
+	}))
+	defer srv.Close()
+
+	taskDir := t.TempDir()
+	require.NoError(os.MkdirAll(filepath.Join(taskDir, "local"), 0755))
+	sum := sha256.Sum256(image)
+	writeSums := func(sum string) {
+		require.NoError(ioutil.WriteFile(filepath.Join(taskDir, "local", "SHA256SUMS"),
+			[]byte(fmt.Sprintf("%s *alpine.tar\n", sum)), 0644))
+	}
+
+	opts := &ImageDownloadOpts{
+		URL:       srv.URL + "/images/alpine.tar",
+		Type:      "tar",
+		Verify:    "checksum",
+		Checksums: "local/SHA256SUMS",
+	}
+
+	// the checksums file has to exist
+	_, err := downloadVerifiedImage(context.Background(), taskDir, opts)
+	require.Error(err)
+	require.Contains(err.Error(), "image_download.checksums")
+
+	writeSums(hex.EncodeToString(sum[:]))
+	path, err := downloadVerifiedImage(context.Background(), taskDir, opts)
+	require.NoError(err)
+	require.Equal(filepath.Join("local", "image-download", "alpine.tar"), path)
+	content, err := ioutil.ReadFile(filepath.Join(taskDir, path))
+	require.NoError(err)
+	require.Equal(image, content)
+
+	// a tampered image is discarded
+	require.NoError(os.Remove(filepath.Join(taskDir, path)))
+	writeSums("0000000000000000000000000000000000000000000000000000000000000000")
+	_, err = downloadVerifiedImage(context.Background(), taskDir, opts)
+	require.Error(err)
+	require.Contains(err.Error(), "checksum mismatch")
+	_, err = os.Stat(filepath.Join(taskDir, path))
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(taskDir, path+".part"))
+	require.True(os.IsNotExist(err))
+
+	opts.URL = srv.URL + "/images/missing.tar"
+	_, err = downloadVerifiedImage(context.Background(), taskDir, opts)
+	require.Error(err)
+}